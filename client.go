@@ -0,0 +1,433 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to a login server. A Client is safe for concurrent use
+// by multiple goroutines and should be reused instead of created per
+// request.
+type Client struct {
+	baseURL   string
+	authURL   string
+	verifyURL string
+	tokenURL  string
+
+	exchangeURL   string
+	deviceCodeURL string
+
+	hc        *http.Client
+	timeout   time.Duration
+	userAgent string
+
+	cookieName   string
+	cookieDomain string
+	cookieMaxAge time.Duration
+
+	refreshCookieName string
+
+	// keys is non-nil if tokens are verified offline.
+	keys     *keySet
+	issuer   string
+	audience string
+
+	// revoked is non-nil if offline verification checks the
+	// revocation list of the login server.
+	revoked         *revocationList
+	revocationCheck *bool
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBaseURL sets the base URL of the login server, for instance
+// "https://login.changkun.de".
+func WithBaseURL(u string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(u, "/") }
+}
+
+// WithHTTPClient sets the HTTP client used to reach the login server.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.hc = hc }
+}
+
+// WithTimeout bounds every request to the login server. A zero
+// duration disables the timeout, in which case only the deadline of
+// the given context applies.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithUserAgent sets the User-Agent header sent to the login server.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// WithCookieName sets the name of the cookie that carries the token.
+func WithCookieName(name string) Option {
+	return func(c *Client) { c.cookieName = name }
+}
+
+// WithCookieDomain sets the domain of the cookie that carries the
+// token. An empty domain scopes the cookie to the current host.
+func WithCookieDomain(domain string) Option {
+	return func(c *Client) { c.cookieDomain = domain }
+}
+
+// WithCookieMaxAge sets the lifetime of the cookie that carries the token.
+func WithCookieMaxAge(d time.Duration) Option {
+	return func(c *Client) { c.cookieMaxAge = d }
+}
+
+// WithRefreshCookieName sets the name of the cookie that carries the
+// refresh token, which renews expired tokens of browser sessions. An
+// empty name disables the renewal.
+func WithRefreshCookieName(name string) Option {
+	return func(c *Client) { c.refreshCookieName = name }
+}
+
+// NewClient returns a new Client. Without options the client talks to
+// DefaultBaseURL with a ten seconds timeout and stores tokens in the
+// "auth" cookie of changkun.de.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL:      DefaultBaseURL,
+		hc:           http.DefaultClient,
+		timeout:      10 * time.Second,
+		userAgent:    "changkun.de/x/login",
+		cookieName:   "auth",
+		cookieDomain: "changkun.de",
+		cookieMaxAge: 60 * 24 * time.Hour,
+		issuer:       DefaultIssuer,
+
+		refreshCookieName: "auth_refresh",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.hc == nil {
+		c.hc = http.DefaultClient
+	}
+	c.setBaseURL(c.baseURL)
+	if c.revocationCheck != nil && *c.revocationCheck ||
+		c.revocationCheck == nil && c.keys != nil && c.keys.jwks {
+		c.revoked = &revocationList{}
+	}
+	return c
+}
+
+// setBaseURL derives the endpoints of the client from the base URL of
+// the login server.
+func (c *Client) setBaseURL(u string) {
+	c.baseURL = u
+	c.authURL = u + "/auth"
+	c.verifyURL = u + "/verify"
+	c.tokenURL = u + "/token"
+	c.exchangeURL = u + "/exchange"
+	c.deviceCodeURL = u + "/device/code"
+}
+
+// Verify checks if the given login token is valid and returns the
+// username it belongs to. See VerifyToken for how tokens are verified.
+func (c *Client) Verify(ctx context.Context, token string) (string, error) {
+	id, err := c.VerifyToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return id.Username, nil
+}
+
+// tokenBody returns the request body of the verify endpoint. The
+// token is sent in the body in addition to the Authorization header
+// for login servers that predate bearer token support, next to the
+// audience of the client and the address of the user from ctx, see
+// ContextWithClientIP.
+func (c *Client) tokenBody(ctx context.Context, token string) []byte {
+	b, _ := json.Marshal(struct {
+		Token    string `json:"token"`
+		Audience string `json:"audience,omitempty"`
+		IP       string `json:"ip,omitempty"`
+	}{
+		Token:    token,
+		Audience: c.audience,
+		IP:       clientIPFromContext(ctx),
+	})
+	return b
+}
+
+// HandleAuth handles authentication by checking the code or token
+// query parameter, the "Authorization: Bearer" header and the cookie,
+// in this order. If a token from the query parameter or the cookie is
+// valid, the cookie is (re)issued to w. If the token of a browser
+// session expired, it is renewed with the refresh cookie.
+func (c *Client) HandleAuth(w http.ResponseWriter, r *http.Request) (string, error) {
+	id, err := c.HandleAuthIdentity(w, r)
+	if err != nil {
+		return "", err
+	}
+	return id.Username, nil
+}
+
+// HandleAuthIdentity is like HandleAuth but returns the identity of
+// the token, which carries the roles and groups of the user:
+//
+//	id, err := c.HandleAuthIdentity(w, r)
+//	if err != nil || !id.HasRole("admin") {
+//		http.Error(w, "forbidden", http.StatusForbidden)
+//		return
+//	}
+func (c *Client) HandleAuthIdentity(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	r = withClientIP(r)
+	token, fromQuery, err := c.tokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrUnauthorized
+	var id *Identity
+	if token != "" {
+		id, err = c.VerifyToken(r.Context(), token)
+	}
+	if errors.Is(err, ErrUnauthorized) && bearerToken(r) == "" {
+		if rid, rerr := c.refreshSession(w, r); rerr == nil {
+			return rid, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fromQuery || bearerToken(r) == "" {
+		c.SetCookie(w, token)
+	}
+	return id, nil
+}
+
+// oauthError is an error response of the login server with an error
+// code, such as "invalid_grant". It is an ErrUnauthorized.
+type oauthError struct {
+	code string
+}
+
+func (e *oauthError) Error() string { return ErrUnauthorized.Error() + ": " + e.code }
+func (e *oauthError) Unwrap() error { return ErrUnauthorized }
+
+// Tokens are the tokens of a login session.
+type Tokens struct {
+	// AccessToken is the short-lived login token.
+	AccessToken string
+	// RefreshToken renews the access token, see Client.Refresh. It is
+	// empty if the login server did not issue a new one.
+	RefreshToken string
+	// ExpiresIn is the lifetime of the access token, or zero if the
+	// login server did not tell.
+	ExpiresIn time.Duration
+}
+
+// Refresh renews a login session with the given refresh token. The
+// refresh token is rotated by the login server and must be replaced
+// by the returned one, using it again revokes the session.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	body := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+	var result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	err := c.send(ctx, c.tokenURL, "application/x-www-form-urlencoded", []byte(body.Encode()), "", &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.AccessToken == "" {
+		return nil, ErrUnauthorized
+	}
+	return &Tokens{
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+		ExpiresIn:    time.Duration(result.ExpiresIn) * time.Second,
+	}, nil
+}
+
+// Exchange exchanges the authorization code of a login redirect for
+// the login token. Codes expire after a minute and can be exchanged
+// once, so the exchange has to happen when the redirect arrives.
+func (c *Client) Exchange(ctx context.Context, code string) (*Tokens, error) {
+	body := url.Values{"code": {code}}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err := c.send(ctx, c.exchangeURL, "application/x-www-form-urlencoded", []byte(body.Encode()), "", &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.AccessToken == "" {
+		return nil, ErrUnauthorized
+	}
+	return &Tokens{
+		AccessToken: result.AccessToken,
+		ExpiresIn:   time.Duration(result.ExpiresIn) * time.Second,
+	}, nil
+}
+
+// refreshSession renews the session of a browser with the refresh
+// cookie and sets the new cookies.
+func (c *Client) refreshSession(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	if c.refreshCookieName == "" {
+		return nil, ErrUnauthorized
+	}
+	ck, err := r.Cookie(c.refreshCookieName)
+	if err != nil || ck.Value == "" {
+		return nil, ErrUnauthorized
+	}
+	t, err := c.Refresh(r.Context(), ck.Value)
+	if err != nil {
+		return nil, err
+	}
+	id, err := c.VerifyToken(r.Context(), t.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	c.SetCookie(w, t.AccessToken)
+	if t.RefreshToken != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.refreshCookieName,
+			Value:    t.RefreshToken,
+			Domain:   c.cookieDomain,
+			Path:     "/",
+			MaxAge:   int(c.cookieMaxAge / time.Second),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return id, nil
+}
+
+// SetCookie writes the cookie that carries the given token to w.
+func (c *Client) SetCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookieName,
+		Value:    token,
+		Domain:   c.cookieDomain,
+		Path:     "/",
+		MaxAge:   int(c.cookieMaxAge / time.Second),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// RequestToken requests the login endpoint and returns the token for login.
+func (c *Client) RequestToken(ctx context.Context, user, pass string) (string, error) {
+	t, err := c.RequestTokens(ctx, user, pass)
+	if err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+// RequestTokens requests the login endpoint and returns the tokens of
+// the new login session, which can be renewed with Refresh.
+func (c *Client) RequestTokens(ctx context.Context, user, pass string) (*Tokens, error) {
+	b, _ := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{Username: user, Password: pass})
+
+	var result struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	err := c.post(ctx, c.authURL, b, "", &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Token == "" {
+		return nil, ErrUnauthorized
+	}
+	return &Tokens{
+		AccessToken:  result.Token,
+		RefreshToken: result.RefreshToken,
+		ExpiresIn:    time.Duration(result.ExpiresIn) * time.Second,
+	}, nil
+}
+
+// post sends body as JSON to the given endpoint, see send.
+func (c *Client) post(ctx context.Context, endpoint string, body []byte, token string, out interface{}) error {
+	return c.send(ctx, endpoint, "application/json", body, token, out)
+}
+
+// send sends body of the given content type to the given endpoint and
+// decodes the JSON response into out. A non-empty token is sent as
+// bearer token. Transport failures and malformed responses are
+// reported as ErrBadRequest, non-200 responses as ErrUnauthorized,
+// which is wrapped in an *oauthError if the response has an error
+// code.
+func (c *Client) send(ctx context.Context, endpoint, contentType string, body []byte, token string, out interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err == nil {
+			err = json.Unmarshal(b, &e)
+		}
+		switch {
+		case resp.StatusCode == http.StatusForbidden:
+			// The access policy of the service denied the user.
+			return fmt.Errorf("%w: %s", ErrForbidden, e.Reason)
+		case err == nil && e.Error != "":
+			return &oauthError{e.Error}
+		}
+		return ErrUnauthorized
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	err = json.Unmarshal(b, out)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return nil
+}
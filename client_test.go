@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"changkun.de/x/login"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		var lo struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		json.NewDecoder(r.Body).Decode(&lo)
+		if lo.Username != "changkun" || lo.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"good","refresh_token":"refresh","expires_in":900}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"good","token_type":"Bearer","expires_in":900,"refresh_token":"rotated"}`))
+	})
+	mux.HandleFunc("/exchange", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"good","token_type":"Bearer","expires_in":900,"username":"changkun"}`))
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Token    string `json:"token"`
+			Audience string `json:"audience"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get("Authorization") != "Bearer "+body.Token {
+			t.Errorf("expect the token to be sent as bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		// The private service only allows admins.
+		if body.Audience == "private" && body.Token == "good" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"access_denied","reason":"user changkun is not allowed"}`))
+			return
+		}
+		switch body.Token {
+		case "good":
+			w.Write([]byte(`{"username":"changkun"}`))
+		case "admin":
+			w.Write([]byte(`{"username":"changkun","roles":["admin"],"groups":["family"]}`))
+		case "slow":
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestClient(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	token, err := c.RequestToken(context.Background(), "changkun", "secret")
+	if err != nil {
+		t.Fatalf("failed to request token: %v", err)
+	}
+	u, err := c.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatalf("expect to be valid, but failed: %v", err)
+	}
+	if u != "changkun" {
+		t.Fatalf("unexpected username: got %v want changkun", u)
+	}
+
+	_, err = c.RequestToken(context.Background(), "changkun", "wrong")
+	if !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+	_, err = c.Verify(context.Background(), "bad")
+	if !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL), login.WithTimeout(50*time.Millisecond))
+
+	_, err := c.Verify(context.Background(), "slow")
+	if !errors.Is(err, login.ErrBadRequest) {
+		t.Fatalf("expect bad request after timeout, got: %v", err)
+	}
+}
+
+func TestClientHandleAuth(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(
+		login.WithBaseURL(ts.URL),
+		login.WithCookieName("session"),
+		login.WithCookieDomain("example.com"),
+	)
+
+	req := httptest.NewRequest("GET", "/?token=good", nil)
+	rr := httptest.NewRecorder()
+	u, err := c.HandleAuth(rr, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "changkun" {
+		t.Fatalf("unexpected username: got %v want changkun", u)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Domain != "example.com" || cookies[0].Value != "good" {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "good"})
+	u, err = c.HandleAuth(httptest.NewRecorder(), req)
+	if err != nil || u != "changkun" {
+		t.Fatalf("expect cookie to be accepted, got %v, %v", u, err)
+	}
+
+	// The identity carries the roles and groups of the user.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	id, err := c.HandleAuthIdentity(httptest.NewRecorder(), req)
+	if err != nil || !id.HasRole("admin") || !id.HasGroup("family") || id.HasGroup("friends") {
+		t.Fatalf("unexpected identity: %+v, %v", id, err)
+	}
+}
+
+func TestClientRefresh(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	tokens, err := c.RequestTokens(context.Background(), "changkun", "secret")
+	if err != nil || tokens.RefreshToken != "refresh" || tokens.ExpiresIn != 15*time.Minute {
+		t.Fatalf("unexpected tokens: %+v, %v", tokens, err)
+	}
+	tokens, err = c.Refresh(context.Background(), tokens.RefreshToken)
+	if err != nil || tokens.AccessToken != "good" || tokens.RefreshToken != "rotated" {
+		t.Fatalf("unexpected refreshed tokens: %+v, %v", tokens, err)
+	}
+	_, err = c.Refresh(context.Background(), "stolen")
+	if !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+
+	// An expired cookie is renewed with the refresh cookie.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: "expired"})
+	req.AddCookie(&http.Cookie{Name: "auth_refresh", Value: "refresh"})
+	rr := httptest.NewRecorder()
+	u, err := c.HandleAuth(rr, req)
+	if err != nil || u != "changkun" {
+		t.Fatalf("expect session to be renewed, got %v, %v", u, err)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, ck := range rr.Result().Cookies() {
+		cookies[ck.Name] = ck
+	}
+	if cookies["auth"] == nil || cookies["auth"].Value != "good" ||
+		cookies["auth_refresh"] == nil || cookies["auth_refresh"].Value != "rotated" || !cookies["auth_refresh"].HttpOnly {
+		t.Fatalf("unexpected cookies: %v", rr.Result().Cookies())
+	}
+
+	// Bearer tokens are never renewed from cookies.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer expired")
+	req.AddCookie(&http.Cookie{Name: "auth_refresh", Value: "refresh"})
+	if _, err := c.HandleAuth(httptest.NewRecorder(), req); !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect expired bearer token to be rejected, got: %v", err)
+	}
+}
+
+func TestClientExchange(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	tokens, err := c.Exchange(context.Background(), "code")
+	if err != nil || tokens.AccessToken != "good" || tokens.ExpiresIn != 15*time.Minute {
+		t.Fatalf("unexpected tokens: %+v, %v", tokens, err)
+	}
+	if _, err := c.Exchange(context.Background(), "used"); !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+
+	// The code of a login redirect is exchanged and stored as cookie.
+	rr := httptest.NewRecorder()
+	u, err := c.HandleAuth(rr, httptest.NewRequest("GET", "/?code=code", nil))
+	if err != nil || u != "changkun" {
+		t.Fatalf("expect code to be exchanged, got %v, %v", u, err)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != "good" {
+		t.Fatalf("expect the token to be stored in the cookie, got %v", cookies)
+	}
+
+	// A used code falls back to the cookie, for instance on reload.
+	req := httptest.NewRequest("GET", "/?code=used", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: "good"})
+	if u, err := c.HandleAuth(httptest.NewRecorder(), req); err != nil || u != "changkun" {
+		t.Fatalf("expect cookie to be used, got %v, %v", u, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"changkun.de/x/login/internal/qr"
+)
+
+var errInvalidCode = errors.New("invalid code")
+
+// session returns the claims of the valid login token of the request,
+// which is read from the auth cookie or the bearer header.
+func session(r *http.Request) (*tokenClaims, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		c, err := r.Cookie("auth")
+		if err != nil {
+			return nil, false
+		}
+		token = c.Value
+	}
+	claims, err := parseToken(token)
+	if err != nil || !checkSession(claims) {
+		return nil, false
+	}
+	return claims, true
+}
+
+// accountfunc shows the account page of the logged in user, where the
+// user manages the second factor and passkeys.
+func accountfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Coming back from the login page, the login is in the query.
+	if q := r.URL.Query(); q.Get("code") != "" || q.Get("token") != "" {
+		token := loginToken(q)
+		if claims, err := parseToken(token); err == nil && checkSession(claims) {
+			setAuthCookie(w, token)
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	claims, ok := session(r)
+	if !ok {
+		http.Redirect(w, r, "/?redirect="+url.QueryEscape("/account"), http.StatusSeeOther)
+		return
+	}
+	acc, err := lookupUser(claims.user())
+	if err != nil || acc == nil {
+		log.Printf("failed to load user %s: %v", claims.user(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	list, err := listSessions(acc.Username)
+	if err != nil {
+		log.Printf("failed to load sessions of %s: %v", acc.Username, err)
+	}
+	accountTmpl.Execute(w, struct {
+		Username      string
+		TOTP          bool
+		RecoveryCodes int
+		Passkeys      []*passkey
+		Sessions      []*loginSession
+		Current       string
+	}{acc.Username, acc.TOTP != "", len(acc.RecoveryCodes), acc.Passkeys, list, claims.SID})
+}
+
+// totpfunc manages the TOTP second factor of the logged in user. The
+// request body is {"action", "code"}, where action is one of
+//
+//   - "enroll": creates a new pending secret and returns it, with its
+//     otpauth:// URI and the URI as QR code in SVG;
+//   - "confirm": enables the pending secret if code is valid for it,
+//     and returns a new token that includes the second factor and new
+//     recovery codes;
+//   - "recovery": replaces the recovery codes with new ones if code is
+//     valid;
+//   - "disable": disables the second factor if code is valid.
+func totpfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		switch {
+		case errors.Is(err, errUnauthorized):
+			w.WriteHeader(http.StatusUnauthorized)
+		case errors.Is(err, errInvalidCode):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_code"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		log.Println(err)
+	}()
+	// Requiring JSON prevents cross-site form submissions.
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = errors.New("unsupported request")
+		return
+	}
+	claims, ok := session(r)
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	u := claims.user()
+
+	// Codes are rate limited like logins, so that a stolen session
+	// cannot guess them.
+	ip := readIP(r)
+	if blocked(ip) {
+		err = fmt.Errorf("%w: too much failure attempts", errUnauthorized)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read request body: %w", err)
+		return
+	}
+	var req struct {
+		Action string `json:"action"`
+		Code   string `json:"code"`
+	}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		err = fmt.Errorf("failed to parse request body: %w", err)
+		return
+	}
+	code := strings.ReplaceAll(req.Code, " ", "")
+
+	var resp interface{}
+	switch req.Action {
+	case "enroll":
+		var secret string
+		secret, err = newTOTPSecret()
+		if err != nil {
+			return
+		}
+		err = updateUser(u, func(acc *account) error {
+			if acc.TOTP != "" {
+				return errors.New("totp is already enabled")
+			}
+			acc.TOTPPending = secret
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		uri := totpURI(u, secret)
+		var c *qr.Code
+		c, err = qr.Encode(uri)
+		if err != nil {
+			return
+		}
+		resp = struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+			QR     string `json:"qr"`
+		}{secret, uri, c.SVG()}
+	case "confirm":
+		err = updateUser(u, func(acc *account) error {
+			step, ok := matchTOTP(acc.TOTPPending, code, time.Now(), 0)
+			if !ok {
+				return errInvalidCode
+			}
+			acc.TOTP, acc.TOTPPending, acc.TOTPStep = acc.TOTPPending, "", step
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		audit(r, "totp_enabled", u, "")
+
+		// The current session lacks the second factor and is no longer
+		// accepted, replace it.
+		var token string
+		token, _, err = startSession(w, r, u, []string{"pwd", "otp"})
+		if err != nil {
+			return
+		}
+
+		var codes []string
+		codes, err = resetRecoveryCodes(r, u)
+		if err != nil {
+			return
+		}
+		resp = struct {
+			Token         string   `json:"token"`
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{token, codes}
+	case "recovery":
+		acc, _ := lookupUser(u)
+		if acc == nil || acc.TOTP == "" {
+			err = errors.New("totp is not enabled")
+			return
+		}
+		if !checkTOTP(u, code) {
+			recordFailure(ip)
+			err = errInvalidCode
+			return
+		}
+		var codes []string
+		codes, err = resetRecoveryCodes(r, u)
+		if err != nil {
+			return
+		}
+		resp = struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes}
+	case "disable":
+		if !checkTOTP(u, code) {
+			recordFailure(ip)
+			err = errInvalidCode
+			return
+		}
+		err = updateUser(u, func(acc *account) error {
+			acc.TOTP, acc.TOTPPending, acc.TOTPStep, acc.RecoveryCodes = "", "", 0, nil
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		audit(r, "totp_disabled", u, "")
+		resp = struct{}{}
+	default:
+		err = fmt.Errorf("unsupported action: %q", req.Action)
+		return
+	}
+
+	b, _ = json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+var (
+	//go:embed account.html
+	accountFile string
+	accountTmpl = template.Must(template.New("account").Parse(accountFile))
+)
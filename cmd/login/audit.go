@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditEvent is an entry of the audit trail, which records security
+// relevant changes of accounts in the data directory as JSON lines.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	User   string    `json:"user,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// audit appends an event of the given user to the audit trail. r is
+// the request that caused the event, or nil for admin commands.
+func audit(r *http.Request, event, user, detail string) {
+	e := auditEvent{Time: time.Now().UTC(), Event: event, User: user, Detail: detail}
+	if r != nil {
+		e.IP = readIP(r)
+	}
+	b, _ := json.Marshal(e)
+	log.Printf("audit: %s", b)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	path := dataPath("audit.log")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Printf("failed to write audit trail: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("failed to write audit trail: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("failed to write audit trail: %v", err)
+	}
+}
@@ -5,33 +5,348 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"changkun.de/x/login/internal/argon2"
 )
 
+// account is a user that can log in.
+type account struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"` // encoded password hash, see hashPassword
+	Disabled bool      `json:"disabled,omitempty"`
+	Created  time.Time `json:"created"`
+
+	// TOTP is the base32 secret of the second factor. Logins require
+	// a TOTP code if it is set. TOTPPending is a secret that awaits
+	// confirmation with a first code, and TOTPStep the time step of
+	// the last used code, which cannot be used again.
+	TOTP        string `json:"totp,omitempty"`
+	TOTPPending string `json:"totp_pending,omitempty"`
+	TOTPStep    int64  `json:"totp_step,omitempty"`
+
+	// RecoveryCodes are the hashes of the unused recovery codes, which
+	// replace the TOTP code once each, see hashRecoveryCode.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// Passkeys are the registered WebAuthn credentials, and UserHandle
+	// the opaque user ID they were registered for.
+	Passkeys   []*passkey `json:"passkeys,omitempty"`
+	UserHandle string     `json:"user_handle,omitempty"`
+
+	// Epoch is the session generation of the user, which is embedded
+	// in tokens. Increasing it invalidates all tokens of the user, see
+	// logoutEverywhere.
+	Epoch int `json:"epoch,omitempty"`
+
+	// Roles and Groups are embedded in tokens, so that services can
+	// restrict access to some users, for instance to the "admin" role.
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Claims are custom claims that are embedded in tokens as "ext",
+	// for instance a display name or a tenant of the user.
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+// userDB is the user store persisted in the data directory.
+type userDB struct {
+	Users map[string]*account `json:"users"`
+}
+
 var (
-	loginUsername string
-	loginPassword string
+	// users is the user store of the server.
+	users *jsonFile[userDB]
+
+	// bootstrap is the account configured by LOGIN_USERNAME and
+	// LOGIN_PASSWORD, if any. It exists besides the user store so
+	// that a fresh deployment has an admin, which has the "admin"
+	// role, and is shadowed by a stored account of the same name.
+	bootstrap *account
 )
 
-func init() {
-	loginUsername = os.Getenv("LOGIN_USERNAME")
-	if loginUsername == "" {
-		log.Fatal("LOGIN_USERNAME is required")
+// openUsers opens the user store in the data directory.
+func openUsers() { users = newJSONFile[userDB](dataPath("users.json")) }
+
+// loadCredentials opens the user store and loads the bootstrap
+// account from the environment.
+func loadCredentials() error {
+	openUsers()
+	bootstrap = nil
+
+	username := os.Getenv("LOGIN_USERNAME")
+	password := os.Getenv("LOGIN_PASSWORD")
+	if username != "" && password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		bootstrap = &account{Username: username, Password: hash, Roles: []string{"admin"}}
+	} else if username != "" || password != "" {
+		return errors.New("LOGIN_USERNAME and LOGIN_PASSWORD must be set together")
+	}
+
+	var n int
+	err := users.view(func(db *userDB) error {
+		n = len(db.Users)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load users: %w", err)
+	}
+	if n == 0 && bootstrap == nil {
+		log.Println("no users configured, use LOGIN_USERNAME and LOGIN_PASSWORD or 'login users add'")
+	}
+	return nil
+}
+
+// lookupUser returns a copy of the account of the given user, or nil
+// if there is no such user.
+func lookupUser(u string) (*account, error) {
+	var acc *account
+	err := users.view(func(db *userDB) error {
+		if a, ok := db.Users[u]; ok {
+			cp := *a
+			acc = &cp
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	loginPassword = os.Getenv("LOGIN_PASSWORD")
-	if loginPassword == "" {
-		log.Fatal("LOGIN_PASSWORD is required")
+	if acc == nil && bootstrap != nil && u == bootstrap.Username {
+		cp := *bootstrap
+		acc = &cp
 	}
+	return acc, nil
+}
+
+// userEpoch returns the current epoch of the given user.
+func userEpoch(u string) (int, error) {
+	acc, err := lookupUser(u)
+	if err != nil {
+		return 0, err
+	}
+	if acc == nil {
+		return 0, fmt.Errorf("user %s does not exist", u)
+	}
+	return acc.Epoch, nil
 }
 
 func check(u, p string) bool {
 	if u == "" || p == "" {
 		return false
 	}
-	return u == loginUsername && p == loginPassword
+
+	acc, err := lookupUser(u)
+	if err != nil {
+		log.Printf("failed to load users: %v", err)
+		return false
+	}
+	if acc == nil {
+		// Spend the same time as for existing users, so that response
+		// times do not reveal which users exist.
+		verifyPassword(dummy(), p)
+		return false
+	}
+	return verifyPassword(acc.Password, p) && !acc.Disabled
+}
+
+// checkSession reports whether the token with the given claims still
+// grants access. Revoked tokens, tokens of ended sessions and tokens
+// of an earlier epoch of the user are rejected, and once a user enabled
+// TOTP, tokens that were issued without a second factor are no longer
+// accepted. Service tokens of clients are no user sessions, see
+// checkServiceToken.
+func checkSession(claims *tokenClaims) bool {
+	if claims.ClientID != "" {
+		return false
+	}
+	acc, err := lookupUser(claims.user())
+	if err != nil {
+		log.Printf("failed to load users: %v", err)
+		return false
+	}
+	if acc == nil || acc.Disabled || claims.Epoch != acc.Epoch || isRevoked(claims.Id) {
+		return false
+	}
+	if claims.SID != "" && !sessionActive(claims.SID) {
+		return false
+	}
+	return acc.TOTP == "" || claims.multiFactor()
+}
+
+// hashParams are the Argon2id parameters of new password hashes, as
+// recommended by RFC 9106 for memory constrained environments.
+var hashParams = struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}{time: 3, memory: 64 * 1024, threads: 4}
+
+var (
+	// hashSlots bounds the number of concurrent password hashes, each
+	// of which takes hashParams.memory KiB, so that parallel logins
+	// cannot exhaust the memory of the server. Hashes that do not get
+	// a slot within hashWait fail.
+	hashSlots = make(chan struct{}, 4)
+	hashWait  = 10 * time.Second
+
+	errHashBusy = errors.New("too many concurrent password hashes")
+)
+
+// argon2Key computes the Argon2id key of password in a hash slot.
+func argon2Key(password, salt []byte, iterations, memory uint32, threads uint8, keyLen uint32) ([]byte, error) {
+	timer := time.NewTimer(hashWait)
+	defer timer.Stop()
+	select {
+	case hashSlots <- struct{}{}:
+	case <-timer.C:
+		return nil, errHashBusy
+	}
+	defer func() { <-hashSlots }()
+	return argon2.IDKey(password, salt, iterations, memory, threads, keyLen), nil
+}
+
+var (
+	dummyMu   sync.Mutex
+	dummyHash string
+)
+
+// dummy returns a password hash to verify against for unknown users.
+// It is created on first use, which is retried if no hash slot was
+// free.
+func dummy() string {
+	dummyMu.Lock()
+	defer dummyMu.Unlock()
+	if dummyHash == "" {
+		dummyHash, _ = hashPassword("dummy")
+	}
+	return dummyHash
+}
+
+var b64 = base64.RawStdEncoding
+
+// hashPassword returns the Argon2id hash of the given password in the
+// PHC string format, e.g. "$argon2id$v=19$m=65536,t=3,p=4$salt$hash".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := hashParams
+	key, err := argon2Key([]byte(password), salt, p.time, p.memory, p.threads, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+		p.memory, p.time, p.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// verifyPassword reports whether password matches the encoded hash.
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != "v=19" {
+		return false
+	}
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || time == 0 || threads == 0 {
+		return false
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := b64.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	got, err := argon2Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if err != nil {
+		log.Printf("failed to verify password: %v", err)
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// setPassword sets the password of the given user, creating the user
+// if create is true.
+func setPassword(u, password string, create bool) error {
+	if u == "" || password == "" {
+		return errors.New("username and password must not be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return users.update(func(db *userDB) error {
+		acc, ok := db.Users[u]
+		switch {
+		case ok && create:
+			return fmt.Errorf("user %s already exists", u)
+		case !ok && !create:
+			return fmt.Errorf("user %s does not exist", u)
+		case !ok:
+			if db.Users == nil {
+				db.Users = map[string]*account{}
+			}
+			acc = &account{Username: u, Created: time.Now().UTC()}
+			db.Users[u] = acc
+		default:
+			// Sessions that were started with the old password end.
+			acc.Epoch++
+		}
+		acc.Password = hash
+		return nil
+	})
+}
+
+// updateUser calls fn with the stored account of the given user and
+// persists the changes. The bootstrap account is copied into the user
+// store on its first update.
+func updateUser(u string, fn func(acc *account) error) error {
+	return users.update(func(db *userDB) error {
+		acc, ok := db.Users[u]
+		if !ok && bootstrap != nil && u == bootstrap.Username {
+			if db.Users == nil {
+				db.Users = map[string]*account{}
+			}
+			cp := *bootstrap
+			cp.Created = time.Now().UTC()
+			acc, ok = &cp, true
+			db.Users[u] = acc
+		}
+		if !ok {
+			return fmt.Errorf("user %s does not exist", u)
+		}
+		return fn(acc)
+	})
 }
 
-func checkUser(u string) bool {
-	return u == loginUsername
+// listUsers returns the stored accounts sorted by username.
+func listUsers() ([]account, error) {
+	var accs []account
+	err := users.view(func(db *userDB) error {
+		for _, a := range db.Users {
+			accs = append(accs, *a)
+		}
+		return nil
+	})
+	sort.Slice(accs, func(i, j int) bool { return accs[i].Username < accs[j].Username })
+	return accs, err
 }
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStore(t *testing.T) {
+	setupData(t)
+
+	if err := setPassword("alice", "alice-pass", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPassword("bob", "bob-pass", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPassword("alice", "again", true); err == nil {
+		t.Fatalf("expect adding an existing user to fail")
+	}
+
+	accs, err := listUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accs) != 2 || !strings.HasPrefix(accs[0].Password, "$argon2id$v=19$") {
+		t.Fatalf("unexpected accounts: %+v", accs)
+	}
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "alice-pass", true},
+		{"bob", "bob-pass", true},
+		{"alice", "bob-pass", false},
+		{"carol", "carol-pass", false},
+		{"alice", "", false},
+	}
+	for _, tt := range tests {
+		if got := check(tt.user, tt.pass); got != tt.ok {
+			t.Errorf("check(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.ok)
+		}
+	}
+
+	err = updateUser("bob", func(acc *account) error {
+		acc.Disabled = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check("bob", "bob-pass") || checkSession(&tokenClaims{StandardClaims: testClaims("bob")}) {
+		t.Fatalf("expect disabled user to be rejected")
+	}
+
+	if err := setPassword("alice", "changed", false); err != nil {
+		t.Fatal(err)
+	}
+	if check("alice", "alice-pass") || !check("alice", "changed") {
+		t.Fatalf("expect password to be changed")
+	}
+}
+
+func TestBootstrapAccount(t *testing.T) {
+	setupData(t)
+	t.Setenv("LOGIN_USERNAME", "admin")
+	t.Setenv("LOGIN_PASSWORD", "admin-pass")
+	if err := loadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !check("admin", "admin-pass") || !checkSession(&tokenClaims{StandardClaims: testClaims("admin")}) {
+		t.Fatalf("expect bootstrap account to log in")
+	}
+	if acc, err := lookupUser("admin"); err != nil || len(acc.Roles) != 1 || acc.Roles[0] != "admin" {
+		t.Fatalf("expect bootstrap account to have the admin role, got %+v, %v", acc, err)
+	}
+
+	// A stored account of the same name takes precedence.
+	if err := setPassword("admin", "stored-pass", true); err != nil {
+		t.Fatal(err)
+	}
+	if check("admin", "admin-pass") || !check("admin", "stored-pass") {
+		t.Fatalf("expect stored account to shadow the bootstrap account")
+	}
+}
+
+func TestPasswordHashSlots(t *testing.T) {
+	setupData(t)
+	if err := setPassword("alice", "alice-pass", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logins fail instead of hashing once all slots are taken.
+	defer func(d time.Duration) { hashWait = d }(hashWait)
+	hashWait = 10 * time.Millisecond
+	for i := 0; i < cap(hashSlots); i++ {
+		hashSlots <- struct{}{}
+	}
+	if check("alice", "alice-pass") {
+		t.Fatalf("expect login to fail without a free hash slot")
+	}
+	if _, err := hashPassword("secret"); !errors.Is(err, errHashBusy) {
+		t.Fatalf("expect hashing to fail without a free hash slot, got %v", err)
+	}
+	for i := 0; i < cap(hashSlots); i++ {
+		<-hashSlots
+	}
+	if !check("alice", "alice-pass") {
+		t.Fatalf("expect login to succeed with free hash slots")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// client is a service that is registered with the login server.
+type client struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created"`
+
+	// RedirectURIs are the URLs the login server may redirect to after
+	// a login for the client. The query of a redirect is ignored when it
+	// is matched against them.
+	RedirectURIs []string `json:"redirect_uris,omitempty"`
+
+	// SecretHash is the SHA-256 hash of the client secret. Clients
+	// without a secret are public clients, which cannot keep a secret
+	// and have to use PKCE instead.
+	SecretHash string `json:"secret_hash,omitempty"`
+
+	// Audiences are the services the client may request service tokens
+	// for with the client credentials grant.
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// clientDB is the client registry persisted in the data directory.
+type clientDB struct {
+	Clients map[string]*client `json:"clients"`
+}
+
+// clients is the client registry of the server.
+var clients *jsonFile[clientDB]
+
+// openClients opens the client registry in the data directory.
+func openClients() { clients = newJSONFile[clientDB](dataPath("clients.json")) }
+
+// lookupClient returns a copy of the client with the given ID, or nil
+// if there is no such client.
+func lookupClient(id string) (*client, error) {
+	var c *client
+	err := clients.view(func(db *clientDB) error {
+		if cl, ok := db.Clients[id]; ok {
+			cp := *cl
+			c = &cp
+		}
+		return nil
+	})
+	return c, err
+}
+
+// listClients returns all clients sorted by ID.
+func listClients() ([]*client, error) {
+	var list []*client
+	err := clients.view(func(db *clientDB) error {
+		for _, c := range db.Clients {
+			cp := *c
+			list = append(list, &cp)
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, err
+}
+
+// addClient registers a new client with the given redirect URIs, which
+// machine clients do without.
+func addClient(id string, redirectURIs []string) error {
+	if id == "" {
+		return fmt.Errorf("client id must not be empty")
+	}
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			return fmt.Errorf("invalid redirect uri: %q", uri)
+		}
+	}
+	return clients.update(func(db *clientDB) error {
+		if _, ok := db.Clients[id]; ok {
+			return fmt.Errorf("client %s already exists", id)
+		}
+		if db.Clients == nil {
+			db.Clients = map[string]*client{}
+		}
+		db.Clients[id] = &client{ID: id, Created: time.Now().UTC(), RedirectURIs: redirectURIs}
+		return nil
+	})
+}
+
+// removeClient removes the client with the given ID.
+func removeClient(id string) error {
+	return clients.update(func(db *clientDB) error {
+		if _, ok := db.Clients[id]; !ok {
+			return fmt.Errorf("client %s does not exist", id)
+		}
+		delete(db.Clients, id)
+		return nil
+	})
+}
+
+// newClientSecret sets a new random secret of the client with the given
+// ID and returns it. Only its hash is stored.
+func newClientSecret(id string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := b64url.EncodeToString(b)
+	err := clients.update(func(db *clientDB) error {
+		c, ok := db.Clients[id]
+		if !ok {
+			return fmt.Errorf("client %s does not exist", id)
+		}
+		c.SecretHash = hashRefreshToken(secret)
+		return nil
+	})
+	return secret, err
+}
+
+// setClientAudiences sets the audiences of the client with the given ID.
+func setClientAudiences(id string, audiences []string) error {
+	return clients.update(func(db *clientDB) error {
+		c, ok := db.Clients[id]
+		if !ok {
+			return fmt.Errorf("client %s does not exist", id)
+		}
+		c.Audiences = audiences
+		return nil
+	})
+}
+
+// public reports whether the client has no secret.
+func (c *client) public() bool { return c.SecretHash == "" }
+
+// checkSecret reports whether the given secret is the secret of the
+// client.
+func (c *client) checkSecret(secret string) bool {
+	return !c.public() && subtle.ConstantTimeCompare([]byte(hashRefreshToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// hasRedirectURI reports whether uri is exactly one of the redirect
+// URIs of the client, as OpenID Connect requires.
+func (c *client) hasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAudience reports whether the client may request service tokens
+// for the given audience.
+func (c *client) hasAudience(aud string) bool {
+	for _, a := range c.Audiences {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRedirectURI reports whether u is one of the redirect URIs of
+// the client, ignoring its query.
+func (c *client) matchRedirectURI(u *url.URL) bool {
+	for _, uri := range c.RedirectURIs {
+		r, err := url.Parse(uri)
+		if err == nil && r.Scheme == u.Scheme && r.Host == u.Host && r.Path == u.Path {
+			return true
+		}
+	}
+	return false
+}
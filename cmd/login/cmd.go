@@ -0,0 +1,425 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"changkun.de/x/login/internal/policy"
+)
+
+// commands are the admin commands. They operate on the data directory
+// directly, and a running server picks up their changes.
+var commands = map[string]struct {
+	usage string
+	run   func(args []string) error
+}{
+	"keys":     {"keys list | keys rotate [-alg EdDSA|ES256|ES384|ES512|RS256] | keys import <file>", keyscmd},
+	"users":    {"users list | users add|passwd|enable|disable|remove|totp-reset|logout <username> | users roles|groups <username> [<name>...] | users claims <username> [<key>=<value>...]", userscmd},
+	"sessions": {"sessions list [<username>] | sessions revoke <id>", sessionscmd},
+	"clients":  {"clients list | clients add <id> [<redirect-uri>...] | clients audiences <id> <audience>... | clients secret|remove <id>", clientscmd},
+	"services": {"services list | services add|remove <id> | services users|groups <id> [<name>...] | services expr <id> [<expression>]", servicescmd},
+	"proxy":    {"proxy [-listen <addr>] [-login <url>] [-service <id>] [-cookie-domain <domain>] [-route <path>=<expression>]... <upstream-url>", proxycmd},
+	"policy":   {"policy test <expression> [user=<name>] [roles|groups|amr=<name>,...] [ip=<ip>] [service=<id>] [time=<RFC 3339 time>]", policycmd},
+}
+
+// runCommand runs the admin command given by args.
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var usages []string
+		for _, c := range commands {
+			usages = append(usages, "\tlogin "+c.usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("unknown command %q, usage:\n\tlogin\n%s", args[0], strings.Join(usages, "\n"))
+	}
+	err := cmd.run(args[1:])
+	if err == flag.ErrHelp {
+		return fmt.Errorf("usage: login %s", cmd.usage)
+	}
+	return err
+}
+
+func keyscmd(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	openKeys()
+
+	switch args[0] {
+	case "list":
+		return keys.view(func(ring *keyRing) error {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "KID\tALG\tCREATED\tSTATUS")
+			for _, e := range ring.Keys {
+				status := "active"
+				switch {
+				case e.Kid == ring.Active:
+				case e.expired(time.Now()):
+					status = "expired"
+				default:
+					status = "retired, verifies until " + e.Retired.Add(tokenLifetime).Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Kid, e.Alg, e.Created.Format(time.RFC3339), status)
+			}
+			return tw.Flush()
+		})
+	case "rotate":
+		fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+		alg := fs.String("alg", "EdDSA", "signing algorithm of the new key")
+		err := fs.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		key, err := generateKey(*alg)
+		if err != nil {
+			return err
+		}
+		err = rotateKey(key)
+		if err != nil {
+			return err
+		}
+		kid, _ := keyID(key)
+		fmt.Printf("rotated to new %s key %s\n", *alg, kid)
+		return nil
+	case "import":
+		if len(args) != 2 {
+			return flag.ErrHelp
+		}
+		b, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		key, err := parsePrivateKey(b)
+		if err != nil {
+			return err
+		}
+		err = rotateKey(key)
+		if err != nil {
+			return err
+		}
+		kid, _ := keyID(key)
+		fmt.Printf("rotated to imported key %s\n", kid)
+		return nil
+	default:
+		return flag.ErrHelp
+	}
+}
+
+func userscmd(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	openUsers()
+
+	if args[0] == "list" {
+		accs, err := listUsers()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USERNAME\tCREATED\tSTATUS\t2FA\tROLES\tGROUPS")
+		for _, a := range accs {
+			status := "enabled"
+			if a.Disabled {
+				status = "disabled"
+			}
+			var factors []string
+			if a.TOTP != "" {
+				factors = append(factors, "totp")
+			}
+			if n := len(a.Passkeys); n > 0 {
+				factors = append(factors, fmt.Sprintf("%d passkey(s)", n))
+			}
+			if len(factors) == 0 {
+				factors = append(factors, "-")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Username, a.Created.Format(time.RFC3339), status,
+				strings.Join(factors, ", "), strings.Join(a.Roles, " "), strings.Join(a.Groups, " "))
+		}
+		return tw.Flush()
+	}
+
+	// Roles and groups are replaced by the given names, which take
+	// effect when the tokens of the user are renewed.
+	if (args[0] == "roles" || args[0] == "groups") && len(args) >= 2 {
+		names := args[2:]
+		return updateUser(args[1], func(acc *account) error {
+			if args[0] == "roles" {
+				acc.Roles = names
+			} else {
+				acc.Groups = names
+			}
+			return nil
+		})
+	}
+
+	// Custom claims are likewise replaced by the given ones.
+	if args[0] == "claims" && len(args) >= 2 {
+		var claims map[string]string
+		for _, kv := range args[2:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				return fmt.Errorf("invalid claim %q, want <key>=<value>", kv)
+			}
+			if claims == nil {
+				claims = map[string]string{}
+			}
+			claims[k] = v
+		}
+		return updateUser(args[1], func(acc *account) error {
+			acc.Claims = claims
+			return nil
+		})
+	}
+
+	if len(args) != 2 {
+		return flag.ErrHelp
+	}
+	u := args[1]
+	switch args[0] {
+	case "add", "passwd":
+		p, err := readPassword()
+		if err != nil {
+			return err
+		}
+		return setPassword(u, p, args[0] == "add")
+	case "enable", "disable":
+		return updateUser(u, func(acc *account) error {
+			acc.Disabled = args[0] == "disable"
+			return nil
+		})
+	case "totp-reset":
+		// For users who lost their authenticator and recovery codes.
+		err := updateUser(u, func(acc *account) error {
+			acc.TOTP, acc.TOTPPending, acc.TOTPStep, acc.RecoveryCodes = "", "", 0, nil
+			return nil
+		})
+		if err == nil {
+			audit(nil, "totp_reset", u, "by admin")
+		}
+		return err
+	case "logout":
+		openSessions()
+		openRefreshTokens()
+		openRevocations()
+		return logoutEverywhere(nil, u, "by admin")
+	case "remove":
+		return users.update(func(db *userDB) error {
+			if _, ok := db.Users[u]; !ok {
+				return fmt.Errorf("user %s does not exist", u)
+			}
+			delete(db.Users, u)
+			return nil
+		})
+	default:
+		return flag.ErrHelp
+	}
+}
+
+func sessionscmd(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	openSessions()
+	openRefreshTokens()
+	openRevocations()
+
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		u := ""
+		if len(args) == 2 {
+			u = args[1]
+		}
+		list, err := listSessions(u)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSER\tIP\tCREATED\tLAST SEEN\tUSER AGENT")
+		for _, s := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.User, s.IP,
+				s.Created.Format(time.RFC3339), s.LastSeen.Format(time.RFC3339), s.UserAgent)
+		}
+		return tw.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		list, err := listSessions("")
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			if s.ID == args[1] {
+				err = endSession(s.ID)
+				if err == nil {
+					audit(nil, "session_revoked", s.User, s.ID+" by admin")
+				}
+				return err
+			}
+		}
+		return fmt.Errorf("session %s does not exist", args[1])
+	default:
+		return flag.ErrHelp
+	}
+}
+
+func clientscmd(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	openClients()
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := listClients()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tCREATED\tREDIRECT URIS\tAUDIENCES")
+		for _, c := range list {
+			typ := "confidential"
+			if c.public() {
+				typ = "public"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.ID, typ, c.Created.Format(time.RFC3339),
+				strings.Join(c.RedirectURIs, " "), strings.Join(c.Audiences, " "))
+		}
+		return tw.Flush()
+	case args[0] == "add" && len(args) >= 2:
+		return addClient(args[1], args[2:])
+	case args[0] == "audiences" && len(args) >= 2:
+		return setClientAudiences(args[1], args[2:])
+	case args[0] == "secret" && len(args) == 2:
+		// The secret is only shown once, a lost secret is replaced.
+		secret, err := newClientSecret(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	case args[0] == "remove" && len(args) == 2:
+		return removeClient(args[1])
+	default:
+		return flag.ErrHelp
+	}
+}
+
+// readPassword reads a password from the first line of the standard
+// input, so that it does not end up in the shell history.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func servicescmd(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	openServices()
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := listServices()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tUSERS\tGROUPS\tEXPR")
+		for _, s := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.Created.Format(time.RFC3339),
+				strings.Join(s.Policy.Users, " "), strings.Join(s.Policy.Groups, " "), s.Policy.Expr)
+		}
+		return tw.Flush()
+	case args[0] == "add" && len(args) == 2:
+		return addService(args[1])
+	case args[0] == "remove" && len(args) == 2:
+		return removeService(args[1])
+	case args[0] == "users" && len(args) >= 2:
+		// The allowed users and groups are replaced by the given
+		// names, which takes effect immediately.
+		return updatePolicy(args[1], func(p *access) { p.Users = args[2:] })
+	case args[0] == "groups" && len(args) >= 2:
+		return updatePolicy(args[1], func(p *access) { p.Groups = args[2:] })
+	case args[0] == "expr" && len(args) >= 2:
+		// The expression may be given as one or several arguments,
+		// and none removes it.
+		expr := strings.Join(args[2:], " ")
+		if expr != "" {
+			if _, err := policy.Compile(expr); err != nil {
+				return fmt.Errorf("invalid expression: %w", err)
+			}
+		}
+		return updatePolicy(args[1], func(p *access) { p.Expr = expr })
+	default:
+		return flag.ErrHelp
+	}
+}
+
+// policycmd evaluates an expression of the policy language against
+// the given sample input, which defaults to the current time. Times
+// are converted to the time zone of LOGIN_TIME_ZONE.
+func policycmd(args []string) error {
+	if len(args) < 2 || args[0] != "test" {
+		return flag.ErrHelp
+	}
+	e, err := policy.Compile(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid expression: %w", err)
+	}
+
+	if err := loadTimeZone(); err != nil {
+		return err
+	}
+	in := &policy.Input{Time: time.Now().In(policyLocation)}
+	for _, arg := range args[2:] {
+		k, v, ok := strings.Cut(arg, "=")
+		var list []string
+		if v != "" {
+			list = strings.Split(v, ",")
+		}
+		switch {
+		case !ok:
+			return fmt.Errorf("invalid input %q, want <name>=<value>", arg)
+		case k == "user":
+			in.User = v
+		case k == "roles":
+			in.Roles = list
+		case k == "groups":
+			in.Groups = list
+		case k == "amr":
+			in.AMR = list
+		case k == "ip":
+			in.IP = v
+		case k == "service":
+			in.Service = v
+		case k == "time":
+			in.Time, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("invalid time: %w", err)
+			}
+			in.Time = in.Time.In(policyLocation)
+		default:
+			return fmt.Errorf("unknown input %q", k)
+		}
+	}
+	if e.Eval(in) {
+		fmt.Println("allow")
+	} else {
+		fmt.Println("deny")
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// authCodeLifetime is how long an authorization code can be exchanged
+// for its token. It only has to cover the redirect to the service and
+// the request of the service to /exchange.
+const authCodeLifetime = time.Minute
+
+// authCodes are the pending authorization codes. They are single use
+// and expire after authCodeLifetime.
+var authCodes = struct {
+	sync.Mutex
+	m map[string]authCode
+}{m: map[string]authCode{}}
+
+type authCode struct {
+	token   string
+	expires time.Time
+}
+
+// legacyTokenRedirect makes the login redirect with the token itself
+// instead of an authorization code, for services that predate
+// /exchange.
+var legacyTokenRedirect bool
+
+// loadTokenRedirect enables the legacy token redirect if
+// LOGIN_LEGACY_TOKEN_REDIRECT is true.
+func loadTokenRedirect() error {
+	s := os.Getenv("LOGIN_LEGACY_TOKEN_REDIRECT")
+	if s == "" {
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid LOGIN_LEGACY_TOKEN_REDIRECT: %q", s)
+	}
+	legacyTokenRedirect = v
+	return nil
+}
+
+// newAuthCode returns a new authorization code for the given token.
+func newAuthCode(token string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := b64url.EncodeToString(b)
+
+	authCodes.Lock()
+	defer authCodes.Unlock()
+	now := time.Now()
+	for k, c := range authCodes.m {
+		if now.After(c.expires) {
+			delete(authCodes.m, k)
+		}
+	}
+	authCodes.m[code] = authCode{token, now.Add(authCodeLifetime)}
+	return code, nil
+}
+
+// redeemAuthCode returns the token of the given authorization code and
+// removes the code.
+func redeemAuthCode(code string) (string, error) {
+	authCodes.Lock()
+	defer authCodes.Unlock()
+	c, ok := authCodes.m[code]
+	delete(authCodes.m, code)
+	if !ok || time.Now().After(c.expires) {
+		return "", fmt.Errorf("%w: unknown or expired code", errUnauthorized)
+	}
+	return c.token, nil
+}
+
+// loginToken returns the token of the login in the query of a redirect
+// from the login page. The token itself is only accepted in the legacy
+// mode, as otherwise anyone could log a browser into their own account
+// with a link.
+func loginToken(q url.Values) string {
+	if code := q.Get("code"); code != "" {
+		token, _ := redeemAuthCode(code)
+		return token
+	}
+	if legacyTokenRedirect {
+		return q.Get("token")
+	}
+	return ""
+}
+
+// loginRedirect adds the login of the given token to the query of the
+// redirect location: an authorization code, or the token itself in
+// the legacy mode. Paths on the login server are left as they are,
+// as the auth cookie carries the login.
+func loginRedirect(u *url.URL, token string) error {
+	if u.Host == "" {
+		return nil
+	}
+	q := u.Query()
+	q.Del("code")
+	q.Del("token")
+	if legacyTokenRedirect {
+		q.Set("token", token)
+	} else {
+		code, err := newAuthCode(token)
+		if err != nil {
+			return fmt.Errorf("failed to create authorization code: %w", err)
+		}
+		q.Set("code", code)
+	}
+	u.RawQuery = q.Encode()
+	return nil
+}
+
+// exchangefunc exchanges an authorization code from a login redirect
+// for its token. The code is sent as form value or JSON {"code"}.
+func exchangefunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		code := "invalid_request"
+		if errors.Is(err, errUnauthorized) {
+			code = "invalid_grant"
+		}
+		b, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{code})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(b)
+		log.Println(err)
+	}()
+	if r.Method != http.MethodPost {
+		err = errors.New("unsupported method")
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var b []byte
+		b, err = io.ReadAll(r.Body)
+		if err != nil {
+			err = fmt.Errorf("failed to read request body: %w", err)
+			return
+		}
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			err = fmt.Errorf("failed to parse request body: %w", err)
+			return
+		}
+	} else {
+		req.Code = r.PostFormValue("code")
+	}
+	if req.Code == "" {
+		err = errors.New("missing code")
+		return
+	}
+
+	token, err := redeemAuthCode(req.Code)
+	if err != nil {
+		return
+	}
+	// The session may have ended since the code was issued.
+	claims, err := parseToken(token)
+	if err != nil || !checkSession(claims) {
+		err = fmt.Errorf("%w: invalid session", errUnauthorized)
+		return
+	}
+	expiresIn := claims.ExpiresAt - time.Now().Unix()
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	writeJSON(w, struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Username    string `json:"username"`
+	}{token, "Bearer", expiresIn, claims.user()})
+}
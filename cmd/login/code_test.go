@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExchange(t *testing.T) {
+	setupUser(t)
+	login := func() (redirect *url.URL, token string) {
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret","redirect":"https://blog.changkun.de/?page=1"}`))
+		rr := httptest.NewRecorder()
+		authfunc(rr, req)
+		var out struct {
+			Redirect string `json:"redirect"`
+			Token    string `json:"token"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to log in: %v", rr.Code)
+		}
+		u, err := url.Parse(out.Redirect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u, out.Token
+	}
+	type result struct {
+		AccessToken string `json:"access_token"`
+		Username    string `json:"username"`
+		Error       string `json:"error"`
+	}
+	exchange := func(code string) (int, result) {
+		req := httptest.NewRequest("POST", "/exchange", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		exchangefunc(rr, req)
+		var out result
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+
+	// The redirect carries a code instead of the token.
+	u, token := login()
+	q := u.Query()
+	if q.Get("token") != "" || q.Get("code") == "" || q.Get("page") != "1" {
+		t.Fatalf("unexpected redirect: %v", u)
+	}
+	code, out := exchange(q.Get("code"))
+	if code != http.StatusOK || out.AccessToken != token || out.Username != "changkun" {
+		t.Fatalf("failed to exchange code: %v, %+v", code, out)
+	}
+
+	// Codes are single use.
+	if code, out := exchange(q.Get("code")); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect used code to be rejected, got %v, %+v", code, out)
+	}
+	if code, out := exchange(""); code != http.StatusBadRequest || out.Error != "invalid_request" {
+		t.Fatalf("expect missing code to be rejected, got %v, %+v", code, out)
+	}
+
+	// Codes expire.
+	u, _ = login()
+	authCodes.Lock()
+	c := authCodes.m[u.Query().Get("code")]
+	c.expires = time.Now().Add(-time.Second)
+	authCodes.m[u.Query().Get("code")] = c
+	authCodes.Unlock()
+	if code, _ := exchange(u.Query().Get("code")); code != http.StatusBadRequest {
+		t.Fatalf("expect expired code to be rejected, got %v", code)
+	}
+
+	// Codes of ended sessions are rejected.
+	u, token = login()
+	claims, _ := parseToken(token)
+	if err := endSession(claims.SID); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := exchange(u.Query().Get("code")); code != http.StatusBadRequest {
+		t.Fatalf("expect code of ended session to be rejected, got %v", code)
+	}
+
+	// The legacy mode redirects with the token.
+	t.Setenv("LOGIN_LEGACY_TOKEN_REDIRECT", "true")
+	t.Cleanup(func() { legacyTokenRedirect = false })
+	if err := loadTokenRedirect(); err != nil {
+		t.Fatal(err)
+	}
+	u, token = login()
+	if u.Query().Get("token") != token || u.Query().Get("code") != "" {
+		t.Fatalf("expect token in legacy redirect, got %v", u)
+	}
+}
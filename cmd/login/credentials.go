@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"changkun.de/x/login/internal/uuid"
+	"github.com/golang-jwt/jwt"
+)
+
+// Machine clients, such as backend jobs, authenticate with their client
+// secret and get service tokens with the client credentials grant, see
+// RFC 6749, Section 4.4. A service token is issued to the client for
+// one of its audiences, the services it may call, and is only accepted
+// by /verify if the calling service names that audience.
+
+// clientCredentialsGrant issues a service token to a confidential
+// client. The audience parameter selects the audience of the token,
+// and may be omitted if the client has a single audience.
+func clientCredentialsGrant(w http.ResponseWriter, r *http.Request, req *tokenRequest) error {
+	c, err := authenticateClient(r, req)
+	if err != nil {
+		return err
+	}
+	if c.public() {
+		return fmt.Errorf("%w: public client %s cannot use client credentials", errInvalidClient, c.ID)
+	}
+	aud := req.Audience
+	if aud == "" && len(c.Audiences) == 1 {
+		aud = c.Audiences[0]
+	}
+	if !c.hasAudience(aud) {
+		return fmt.Errorf("%w: audience %q not allowed for %s", errUnauthorized, aud, c.ID)
+	}
+
+	token, err := newServiceToken(c.ID, aud)
+	if err != nil {
+		return fmt.Errorf("failed to issue service token: %w", err)
+	}
+	audit(r, "service_token_issued", "", c.ID+" for "+aud)
+	writeJSON(w, struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{token, "Bearer", int(accessTokenLifetime / time.Second)})
+	return nil
+}
+
+// newServiceToken issues a token to the given client for calls to the
+// given audience.
+func newServiceToken(clientID, aud string) (string, error) {
+	now := time.Now().UTC()
+	return signToken(tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.Must(uuid.NewShort()),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(accessTokenLifetime).Unix(),
+			Audience:  aud,
+			Issuer:    issuer,
+			Subject:   clientID,
+		},
+		Version:  tokenVersion,
+		ClientID: clientID,
+	})
+}
+
+// checkServiceToken reports whether the service token with the given
+// claims still grants access to the given audience. Tokens of removed
+// clients and revoked tokens are rejected.
+func checkServiceToken(claims *tokenClaims, aud string) bool {
+	if claims.ClientID == "" || aud == "" || claims.Audience != aud || isRevoked(claims.Id) {
+		return false
+	}
+	c, err := lookupClient(claims.ClientID)
+	return err == nil && c != nil && c.hasAudience(aud)
+}
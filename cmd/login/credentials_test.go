@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientCredentials(t *testing.T) {
+	setupData(t)
+	if err := keyscmd([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientscmd([]string{"add", "backup"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientscmd([]string{"audiences", "backup", "storage.changkun.de"}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := newClientSecret("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	request := func(body url.Values) (int, result) {
+		body.Set("grant_type", "client_credentials")
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		tokenfunc(rr, req)
+		var out result
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+	verify := func(token, aud string) (int, string) {
+		req := httptest.NewRequest("POST", "/verify", strings.NewReader(`{"audience":"`+aud+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	if code, out := request(url.Values{"client_id": {"backup"}, "client_secret": {"wrong"}}); code != http.StatusUnauthorized || out.Error != "invalid_client" {
+		t.Fatalf("expect wrong secret to be rejected, got %v %+v", code, out)
+	}
+	creds := url.Values{"client_id": {"backup"}, "client_secret": {secret}, "audience": {"mail.changkun.de"}}
+	if code, out := request(creds); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect unknown audience to be rejected, got %v %+v", code, out)
+	}
+
+	// The single audience of the client is the default.
+	creds.Del("audience")
+	code, out := request(creds)
+	if code != http.StatusOK || out.AccessToken == "" || out.RefreshToken != "" {
+		t.Fatalf("failed to get service token: %v %+v", code, out)
+	}
+	claims, err := parseToken(out.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "backup" || claims.ClientID != "backup" || claims.Audience != "storage.changkun.de" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	// Service tokens are only accepted by their audience, and are no
+	// user sessions.
+	if code, body := verify(out.AccessToken, "storage.changkun.de"); code != http.StatusOK ||
+		!strings.Contains(body, `"client_id":"backup"`) || !strings.Contains(body, `"sub":"backup"`) ||
+		!strings.Contains(body, `"username":""`) {
+		t.Fatalf("failed to verify service token: %v %s", code, body)
+	}
+	if code, _ := verify(out.AccessToken, "mail.changkun.de"); code != http.StatusBadRequest {
+		t.Fatalf("expect service token to be rejected by other audience, got %v", code)
+	}
+	if code, _ := verify(out.AccessToken, ""); code != http.StatusBadRequest {
+		t.Fatalf("expect service token to be rejected without audience, got %v", code)
+	}
+	if checkSession(claims) {
+		t.Fatalf("expect service token to be no user session")
+	}
+
+	// Tokens of removed clients are rejected.
+	if err := removeClient("backup"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify(out.AccessToken, "storage.changkun.de"); code != http.StatusBadRequest {
+		t.Fatalf("expect token of removed client to be rejected, got %v", code)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Devices without a browser, such as SSH sessions, log in with the
+// device authorization grant of RFC 8628: the device gets a device
+// code and a short user code from /device/code, the user enters the
+// user code at /device in a logged in browser, and the device polls
+// /token with the device code until the login was approved.
+
+const (
+	// deviceCodeLifetime is how long a device code waits for approval.
+	deviceCodeLifetime = 10 * time.Minute
+	// devicePollInterval is the minimum interval between two polls of
+	// a device, which grows by the same amount if the device polls too
+	// fast.
+	devicePollInterval = 5 * time.Second
+	// deviceGrantType is the grant type of polls at /token.
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// userCodeAlphabet are the characters of user codes, without
+	// vowels to avoid words and without easily confused characters.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// The errors of the device flow at the token endpoint, whose error
+// code is their value.
+const (
+	errAuthorizationPending oauthError = "authorization_pending"
+	errSlowDown             oauthError = "slow_down"
+	errExpiredToken         oauthError = "expired_token"
+	errAccessDenied         oauthError = "access_denied"
+)
+
+// oauthError is an error of the token endpoint with its own error
+// code, see RFC 6749, Section 5.2.
+type oauthError string
+
+func (e oauthError) Error() string { return string(e) }
+
+// deviceCodes are the pending device codes, keyed by device code.
+var deviceCodes = struct {
+	sync.Mutex
+	m map[string]*deviceCode
+}{m: map[string]*deviceCode{}}
+
+// deviceCode is a pending device login. It is approved or denied by
+// the user who enters its user code.
+type deviceCode struct {
+	clientID string
+	userCode string
+	expires  time.Time
+	interval time.Duration
+	lastPoll time.Time
+
+	user   string // set once approved
+	amr    []string
+	denied bool
+}
+
+// newUserCode returns a random user code of eight characters, which
+// has about 34 bits of entropy.
+func newUserCode() (string, error) {
+	code := make([]byte, 0, 8)
+	b := make([]byte, 16)
+	for len(code) < cap(code) {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			// Skip bytes that would bias the modulo.
+			if int(c) < 256-256%len(userCodeAlphabet) && len(code) < cap(code) {
+				code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// formatUserCode formats a user code as XXXX-XXXX for display.
+func formatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// normalizeUserCode undoes formatUserCode and the typing habits of
+// users.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// newDeviceCode creates a pending device login of the given client,
+// which may be empty, and returns its device and user code.
+func newDeviceCode(clientID string) (device, user string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	device = b64url.EncodeToString(b)
+
+	deviceCodes.Lock()
+	defer deviceCodes.Unlock()
+	now := time.Now()
+	for k, c := range deviceCodes.m {
+		if now.After(c.expires) {
+			delete(deviceCodes.m, k)
+		}
+	}
+	// User codes are short, so avoid collisions with pending ones.
+	for user == "" || lookupUserCode(user) != nil {
+		user, err = newUserCode()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	deviceCodes.m[device] = &deviceCode{
+		clientID: clientID,
+		userCode: user,
+		expires:  now.Add(deviceCodeLifetime),
+		interval: devicePollInterval,
+	}
+	return device, user, nil
+}
+
+// lookupUserCode returns the pending device login of the given user
+// code. The caller must hold the lock of deviceCodes.
+func lookupUserCode(user string) *deviceCode {
+	now := time.Now()
+	for _, c := range deviceCodes.m {
+		if c.userCode == user && now.Before(c.expires) && c.user == "" && !c.denied {
+			return c
+		}
+	}
+	return nil
+}
+
+// deviceCodeClient returns the client of the pending device login of
+// the given user code, which is empty for devices that did not name a
+// client.
+func deviceCodeClient(userCode string) (clientID string, err error) {
+	deviceCodes.Lock()
+	defer deviceCodes.Unlock()
+	c := lookupUserCode(normalizeUserCode(userCode))
+	if c == nil {
+		return "", errInvalidCode
+	}
+	return c.clientID, nil
+}
+
+// decideDeviceCode approves the pending device login of the given
+// user code for the user who authenticated with the given methods, or
+// denies it.
+func decideDeviceCode(userCode, user string, amr []string, approve bool) (clientID string, err error) {
+	deviceCodes.Lock()
+	defer deviceCodes.Unlock()
+	c := lookupUserCode(normalizeUserCode(userCode))
+	if c == nil {
+		return "", errInvalidCode
+	}
+	if approve {
+		c.user, c.amr = user, amr
+	} else {
+		c.denied = true
+	}
+	return c.clientID, nil
+}
+
+// pollDeviceCode returns the user who approved the given device code,
+// and removes the code once it is approved, denied or expired.
+func pollDeviceCode(device, clientID string) (user string, amr []string, err error) {
+	deviceCodes.Lock()
+	defer deviceCodes.Unlock()
+	c, ok := deviceCodes.m[device]
+	if !ok || c.clientID != clientID {
+		return "", nil, fmt.Errorf("%w: unknown device code", errUnauthorized)
+	}
+	now := time.Now()
+	switch {
+	case now.After(c.expires):
+		delete(deviceCodes.m, device)
+		return "", nil, errExpiredToken
+	case c.denied:
+		delete(deviceCodes.m, device)
+		return "", nil, errAccessDenied
+	case c.user != "":
+		delete(deviceCodes.m, device)
+		return c.user, c.amr, nil
+	case now.Sub(c.lastPoll) < c.interval:
+		c.lastPoll = now
+		c.interval += devicePollInterval
+		return "", nil, errSlowDown
+	}
+	c.lastPoll = now
+	return "", nil, errAuthorizationPending
+}
+
+// devicecodefunc is the device authorization endpoint. It issues a
+// device code and a user code, optionally for the client given by
+// client_id, which authenticates if it is confidential.
+func devicecodefunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		code, status := "invalid_request", http.StatusBadRequest
+		if errors.Is(err, errInvalidClient) {
+			code, status = "invalid_client", http.StatusUnauthorized
+		}
+		b, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{code})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(b)
+		log.Println(err)
+	}()
+	if r.Method != http.MethodPost {
+		err = errors.New("unsupported method")
+		return
+	}
+
+	clientID := r.PostFormValue("client_id")
+	if _, _, ok := r.BasicAuth(); ok || clientID != "" {
+		var c *client
+		c, err = authenticateClient(r, &tokenRequest{ClientID: clientID, ClientSecret: r.PostFormValue("client_secret")})
+		if err != nil {
+			return
+		}
+		clientID = c.ID
+	}
+	device, user, err := newDeviceCode(clientID)
+	if err != nil {
+		err = fmt.Errorf("failed to create device code: %w", err)
+		return
+	}
+	verify := rp.Origin + "/device"
+	writeJSON(w, struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{
+		DeviceCode:              device,
+		UserCode:                formatUserCode(user),
+		VerificationURI:         verify,
+		VerificationURIComplete: verify + "?" + url.Values{"user_code": {formatUserCode(user)}}.Encode(),
+		ExpiresIn:               int(deviceCodeLifetime / time.Second),
+		Interval:                int(devicePollInterval / time.Second),
+	})
+}
+
+// devicefunc shows the page where logged in users enter the user code
+// of a device, and approves or denies the device login with a POST of
+// {"user_code", "action"}, where action is "approve" or "deny".
+func devicefunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method != http.MethodPost {
+		_, claims := browserLogin(w, r)
+		if claims == nil {
+			redirect := "/device"
+			if code := r.URL.Query().Get("user_code"); code != "" {
+				redirect += "?" + url.Values{"user_code": {code}}.Encode()
+			}
+			http.Redirect(w, r, "/?"+url.Values{"redirect": {redirect}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		deviceTmpl.Execute(w, struct {
+			Username string
+			UserCode string
+		}{claims.user(), r.URL.Query().Get("user_code")})
+		return
+	}
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		switch {
+		case errors.Is(err, errUnauthorized):
+			w.WriteHeader(http.StatusUnauthorized)
+		case errors.Is(err, errInvalidCode):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_code"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		log.Println(err)
+	}()
+	// Requiring JSON prevents cross-site form submissions.
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = errors.New("unsupported request")
+		return
+	}
+	claims, ok := session(r)
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	ip := readIP(r)
+	if blocked(ip) {
+		err = fmt.Errorf("%w: too much failure attempts", errUnauthorized)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		err = fmt.Errorf("failed to read request body: %w", err)
+		return
+	}
+	var req struct {
+		UserCode string `json:"user_code"`
+		Action   string `json:"action"`
+	}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		err = fmt.Errorf("failed to parse request body: %w", err)
+		return
+	}
+	if req.Action != "approve" && req.Action != "deny" {
+		err = fmt.Errorf("unsupported action: %q", req.Action)
+		return
+	}
+
+	u := claims.user()
+	if req.Action == "approve" {
+		// The access policies apply as to logins at /auth, and the
+		// device is denied if they deny the user.
+		err = checkDeviceAccess(r, req.UserCode, u, claims.AMR)
+		var perr *policyError
+		if errors.As(err, &perr) {
+			audit(r, "login_denied", u, perr.service+": "+perr.reason)
+			decideDeviceCode(req.UserCode, u, claims.AMR, false)
+			denyAccess(w, perr)
+			err = nil
+			return
+		}
+		if errors.Is(err, errInvalidCode) {
+			recordFailure(ip)
+		}
+		if err != nil {
+			return
+		}
+	}
+	clientID, err := decideDeviceCode(req.UserCode, u, claims.AMR, req.Action == "approve")
+	if err != nil {
+		recordFailure(ip)
+		return
+	}
+	if req.Action == "approve" {
+		audit(r, "device_authorized", u, clientID)
+	}
+	writeJSON(w, struct{}{})
+}
+
+// checkDeviceAccess checks the access policies of the login server and
+// of the client of the device login with the given user code for the
+// given user, see checkLoginAccess.
+func checkDeviceAccess(r *http.Request, userCode, user string, amr []string) error {
+	clientID, err := deviceCodeClient(userCode)
+	if err != nil {
+		return err
+	}
+	if err := checkLoginAccess(r, user, amr, ""); err != nil {
+		return err
+	}
+	acc, err := lookupUser(user)
+	if err != nil {
+		return fmt.Errorf("failed to load user %s: %w", user, err)
+	}
+	return checkAccess(readIP(r), clientID, user, amr, acc)
+}
+
+// deviceCodeGrant issues the tokens of a new login session to a device
+// whose device code was approved.
+func deviceCodeGrant(w http.ResponseWriter, r *http.Request, req *tokenRequest) error {
+	clientID := ""
+	if _, _, ok := r.BasicAuth(); ok || req.ClientID != "" {
+		c, err := authenticateClient(r, req)
+		if err != nil {
+			return err
+		}
+		clientID = c.ID
+	}
+	if req.DeviceCode == "" {
+		return fmt.Errorf("%w: missing device code", errUnauthorized)
+	}
+	user, amr, err := pollDeviceCode(req.DeviceCode, clientID)
+	if err != nil {
+		return err
+	}
+	access, refresh, err := newSession(r, user, amr)
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	writeJSON(w, struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}{access, "Bearer", int(accessTokenLifetime / time.Second), refresh})
+	return nil
+}
+
+var (
+	//go:embed device.html
+	deviceFile string
+	deviceTmpl = template.Must(template.New("device").Parse(deviceFile))
+)
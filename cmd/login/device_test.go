@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	token, _ := setupSession(t)
+
+	start := func() (device, user string) {
+		req := httptest.NewRequest("POST", "/device/code", nil)
+		rr := httptest.NewRecorder()
+		devicecodefunc(rr, req)
+		var out struct {
+			DeviceCode      string `json:"device_code"`
+			UserCode        string `json:"user_code"`
+			VerificationURI string `json:"verification_uri"`
+			Interval        int    `json:"interval"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusOK || out.DeviceCode == "" || len(out.UserCode) != 9 ||
+			out.VerificationURI != rp.Origin+"/device" || out.Interval != 5 {
+			t.Fatalf("unexpected device authorization: %v %s", rr.Code, rr.Body.String())
+		}
+		return out.DeviceCode, out.UserCode
+	}
+	type result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	poll := func(device string) (int, result) {
+		// Pretend the device waited for the interval.
+		deviceCodes.Lock()
+		if c, ok := deviceCodes.m[device]; ok {
+			c.lastPoll = time.Time{}
+		}
+		deviceCodes.Unlock()
+		body := url.Values{"grant_type": {deviceGrantType}, "device_code": {device}}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		tokenfunc(rr, req)
+		var out result
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+	decide := func(user, action string) int {
+		req := httptest.NewRequest("POST", "/device", strings.NewReader(`{"user_code":"`+user+`","action":"`+action+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "auth", Value: token})
+		rr := httptest.NewRecorder()
+		devicefunc(rr, req)
+		return rr.Code
+	}
+
+	device, user := start()
+	if code, out := poll(device); code != http.StatusBadRequest || out.Error != "authorization_pending" {
+		t.Fatalf("expect pending authorization, got %v %+v", code, out)
+	}
+
+	// Devices that poll too fast are asked to slow down.
+	body := url.Values{"grant_type": {deviceGrantType}, "device_code": {device}}
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	tokenfunc(rr, req)
+	if !strings.Contains(rr.Body.String(), "slow_down") {
+		t.Fatalf("expect slow_down, got %s", rr.Body.String())
+	}
+
+	// Users that are not logged in log in first.
+	rr = httptest.NewRecorder()
+	devicefunc(rr, httptest.NewRequest("GET", "/device?user_code="+user, nil))
+	if rr.Code != http.StatusSeeOther || !strings.HasPrefix(rr.Header().Get("Location"), "/?redirect=") {
+		t.Fatalf("expect redirect to login page, got %v", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/device?user_code="+user, nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: token})
+	rr = httptest.NewRecorder()
+	devicefunc(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), user) {
+		t.Fatalf("expect device page with the user code, got %v", rr.Code)
+	}
+
+	if code := decide("BCDF-GHJK", "approve"); code != http.StatusBadRequest {
+		t.Fatalf("expect unknown user code to be rejected, got %v", code)
+	}
+	// User codes are accepted as typed.
+	if code := decide(strings.ToLower(strings.ReplaceAll(user, "-", "")), "approve"); code != http.StatusOK {
+		t.Fatalf("failed to approve device, got %v", code)
+	}
+	code, out := poll(device)
+	if code != http.StatusOK || out.AccessToken == "" || out.RefreshToken == "" {
+		t.Fatalf("failed to get tokens: %v %+v", code, out)
+	}
+	claims, err := parseToken(out.AccessToken)
+	if err != nil || claims.Subject != "changkun" || !checkSession(claims) {
+		t.Fatalf("unexpected device token: %+v, %v", claims, err)
+	}
+	if code, out := poll(device); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect used device code to be rejected, got %v %+v", code, out)
+	}
+
+	// Denied and expired logins end the polling.
+	device, user = start()
+	if code := decide(user, "deny"); code != http.StatusOK {
+		t.Fatalf("failed to deny device, got %v", code)
+	}
+	if code, out := poll(device); code != http.StatusBadRequest || out.Error != "access_denied" {
+		t.Fatalf("expect access_denied, got %v %+v", code, out)
+	}
+
+	// Users that the access policy of the login server denies cannot
+	// approve devices.
+	if err := servicescmd([]string{"add", rp.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"users", rp.ID, "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	device, user = start()
+	if code := decide(user, "approve"); code != http.StatusForbidden {
+		t.Fatalf("expect policy to deny the approval, got %v", code)
+	}
+	if code, out := poll(device); code != http.StatusBadRequest || out.Error != "access_denied" {
+		t.Fatalf("expect access_denied, got %v %+v", code, out)
+	}
+	if err := servicescmd([]string{"remove", rp.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	device, _ = start()
+	deviceCodes.Lock()
+	deviceCodes.m[device].expires = time.Now().Add(-time.Second)
+	deviceCodes.Unlock()
+	if code, out := poll(device); code != http.StatusBadRequest || out.Error != "expired_token" {
+		t.Fatalf("expect expired_token, got %v %+v", code, out)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Reverse proxies protect applications that know nothing about the
+// login server by asking /forward-auth about every request, as Traefik
+// ForwardAuth, nginx auth_request and Caddy forward_auth do. The proxy
+// forwards the headers of the original request, and describes its URL
+// with X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri. The
+// host of the original URL is the service whose access policy applies.
+
+// forwardauthfunc authenticates a request of a reverse proxy. It
+// responds with 200 and the identity in the X-Auth-User, X-Auth-Groups
+// and X-Auth-Roles headers, or X-Auth-Client for service tokens, which
+// the proxy passes to the application. Expired sessions are renewed
+// with the refresh cookie, and the proxy passes the new cookies to the
+// browser. Proxies that cannot do so disable the renewal with the query
+// refresh=false, as the browser would reuse the rotated refresh token.
+// Browsers that are not logged in are redirected to the login page,
+// which brings them back with a code of the login that is exchanged
+// for the auth cookie, and other requests receive 401. As nginx only
+// accepts 401 and 403 responses, the query status=401 disables the
+// redirect.
+func forwardauthfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		var perr *policyError
+		if errors.As(err, &perr) {
+			denyAccess(w, perr)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		log.Println(err)
+	}()
+
+	orig, err := forwardedURL(r)
+	if err != nil {
+		return
+	}
+
+	// Coming back from the login page, the login is in the query. Other
+	// parameters of the same name belong to the application. nginx
+	// cannot redirect, but its hosts share the cookie of the login.
+	q := orig.Query()
+	if (q.Get("code") != "" || q.Get("token") != "") && r.URL.Query().Get("status") != "401" {
+		token := loginToken(q)
+		if claims, err := parseToken(token); err == nil && checkSession(claims) {
+			setForwardedCookie(w, orig, token)
+			u := *orig
+			u.RawQuery = stripLogin(q).Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		if c, cerr := r.Cookie("auth"); cerr == nil {
+			token = c.Value
+		}
+	}
+	// The client is named by X-Forwarded-For if the reverse proxy is
+	// trusted, see readIP.
+	ip := readIP(r)
+	var (
+		claims *tokenClaims
+		acc    *account
+		perr   *policyError
+	)
+	err = errors.New("missing token")
+	if token != "" {
+		claims, acc, err = verifyToken(token, orig.Hostname(), ip)
+	}
+	if err != nil && !errors.As(err, &perr) {
+		// Expired tokens of browsers are renewed with the refresh
+		// cookie, or else by the login page.
+		if access := forwardRefresh(w, r, orig); access != "" {
+			claims, acc, err = verifyToken(access, orig.Hostname(), ip)
+		}
+	}
+	if err != nil && !errors.As(err, &perr) {
+		if token != "" {
+			log.Printf("forward auth for %s: %v", orig.Host, err)
+		}
+		err = nil
+		forwardLogin(w, r, orig)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if claims.ClientID != "" {
+		w.Header().Set("X-Auth-Client", claims.ClientID)
+	} else {
+		w.Header().Set("X-Auth-User", claims.user())
+	}
+	if acc != nil {
+		w.Header().Set("X-Auth-Groups", strings.Join(acc.Groups, ","))
+		w.Header().Set("X-Auth-Roles", strings.Join(acc.Roles, ","))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// forwardedURL returns the URL of the original request of a reverse
+// proxy.
+func forwardedURL(r *http.Request) (*url.URL, error) {
+	host := firstValue(r.Header.Get("X-Forwarded-Host"))
+	if host == "" {
+		return nil, errors.New("missing X-Forwarded-Host")
+	}
+	scheme := firstValue(r.Header.Get("X-Forwarded-Proto"))
+	if scheme != "http" {
+		scheme = "https"
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	u, err := url.Parse(scheme + "://" + host + uri)
+	if err != nil || u.Host != host || u.User != nil {
+		return nil, fmt.Errorf("invalid forwarded url: %s%s", host, uri)
+	}
+	return u, nil
+}
+
+// stripLogin removes the code and token parameters from q and returns
+// it.
+func stripLogin(q url.Values) url.Values {
+	q.Del("code")
+	q.Del("token")
+	return q
+}
+
+// firstValue returns the first of the comma separated values of a
+// header, which proxies append to.
+func firstValue(h string) string {
+	return strings.TrimSpace(strings.Split(h, ",")[0])
+}
+
+// forwardLogin responds to a request of a reverse proxy that is not
+// authenticated.
+func forwardLogin(w http.ResponseWriter, r *http.Request, orig *url.URL) {
+	method := r.Header.Get("X-Forwarded-Method")
+	navigation := (method == "" || method == http.MethodGet || method == http.MethodHead) &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+	if !navigation || r.URL.Query().Get("status") == "401" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+rp.Origin+`"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, rp.Origin+"/?"+url.Values{"redirect": {orig.String()}}.Encode(), http.StatusFound)
+}
+
+// forwardRefresh renews the session of a browser with the refresh
+// cookie and sets the new cookies. Only hosts that share the cookies of
+// the login server receive the refresh cookie. It returns the new
+// token, or an empty string if the session was not renewed.
+func forwardRefresh(w http.ResponseWriter, r *http.Request, orig *url.URL) string {
+	if bearerToken(r) != "" || !sharedCookieHost(orig.Hostname()) || r.URL.Query().Get("refresh") == "false" {
+		return ""
+	}
+	c, err := r.Cookie("auth_refresh")
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	access, _, err := refresh(w, r, c.Value)
+	if err != nil {
+		log.Printf("forward auth for %s: failed to renew session: %v", orig.Host, err)
+		return ""
+	}
+	return access
+}
+
+// sharedCookieHost reports whether the given host shares the cookies
+// of the login server, which is the case for changkun.de and its
+// subdomains.
+func sharedCookieHost(host string) bool {
+	return host == "changkun.de" || strings.HasSuffix(host, ".changkun.de")
+}
+
+// setForwardedCookie sets the auth cookie for the host of the original
+// request. Subdomains of changkun.de share the cookie of the login
+// server, other hosts get their own.
+func setForwardedCookie(w http.ResponseWriter, orig *url.URL, token string) {
+	if sharedCookieHost(orig.Hostname()) {
+		setAuthCookie(w, token)
+		return
+	}
+	secure := ""
+	if orig.Scheme == "https" {
+		secure = " Secure;"
+	}
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth=%s; Path=/; Max-Age=%d;%s SameSite=Lax", token, int(accessTokenLifetime/time.Second), secure))
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestForwardAuth(t *testing.T) {
+	token, _ := setupSession(t)
+	if err := userscmd([]string{"groups", "changkun", "family", "friends"}); err != nil {
+		t.Fatal(err)
+	}
+
+	forward := func(host, uri string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/forward-auth", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", host)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rr := httptest.NewRecorder()
+		forwardauthfunc(rr, req)
+		return rr
+	}
+	browser := http.Header{"Accept": {"text/html"}}
+	withCookie := http.Header{"Cookie": {"auth=" + token}}
+
+	rr := forward("", "/", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expect missing host to be rejected, got %v", rr.Code)
+	}
+
+	// Browsers log in first, other requests are unauthorized.
+	rr = forward("app.example.com", "/page?x=1", browser)
+	want := rp.Origin + "/?" + url.Values{"redirect": {"https://app.example.com/page?x=1"}}.Encode()
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != want {
+		t.Fatalf("expect redirect to login page, got %v %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr := forward("app.example.com", "/api", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized API request, got %v", rr.Code)
+	}
+	req := httptest.NewRequest("GET", "/forward-auth?status=401", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	rr = httptest.NewRecorder()
+	forwardauthfunc(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 instead of redirect, got %v", rr.Code)
+	}
+
+	rr = forward("app.example.com", "/page", withCookie)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Auth-User") != "changkun" ||
+		rr.Header().Get("X-Auth-Groups") != "family,friends" {
+		t.Fatalf("unexpected response: %v %v", rr.Code, rr.Header())
+	}
+	rr = forward("app.example.com", "/page", http.Header{"Authorization": {"Bearer " + token}})
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Auth-User") != "changkun" {
+		t.Fatalf("expect bearer token to be accepted, got %v", rr.Code)
+	}
+	if rr := forward("app.example.com", "/page", http.Header{"Cookie": {"auth=bad"}, "Accept": {"text/html"}}); rr.Code != http.StatusFound {
+		t.Fatalf("expect invalid token to log in again, got %v", rr.Code)
+	}
+
+	// The code of a login redirect is exchanged for the cookie of the
+	// host, and removed from the URL.
+	code, err := newAuthCode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = forward("app.example.com", "/page?x=1&code="+code, browser)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://app.example.com/page?x=1" ||
+		!strings.HasPrefix(rr.Header().Get("Set-Cookie"), "auth="+token+"; Path=/;") {
+		t.Fatalf("unexpected code exchange: %v %v", rr.Code, rr.Header())
+	}
+	code, _ = newAuthCode(token)
+	rr = forward("wiki.changkun.de", "/?code="+code, browser)
+	if rr.Code != http.StatusFound || !strings.Contains(rr.Header().Get("Set-Cookie"), "Domain=changkun.de") {
+		t.Fatalf("expect the shared cookie, got %v %v", rr.Code, rr.Header())
+	}
+	// nginx cannot redirect, and relies on the shared cookie.
+	code, _ = newAuthCode(token)
+	req = httptest.NewRequest("GET", "/forward-auth?status=401", nil)
+	req.Header.Set("Cookie", "auth="+token)
+	req.Header.Set("X-Forwarded-Host", "wiki.changkun.de")
+	req.Header.Set("X-Forwarded-Uri", "/?code="+code)
+	rr = httptest.NewRecorder()
+	forwardauthfunc(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expect nginx request to be authenticated by the cookie, got %v", rr.Code)
+	}
+	// Codes that are not from the login server belong to the app.
+	rr = forward("app.example.com", "/callback?code=other", withCookie)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expect unknown code to be left alone, got %v", rr.Code)
+	}
+	// The token itself is only accepted in the legacy mode, as anyone
+	// could otherwise log a browser into their own account.
+	rr = forward("app.example.com", "/page?token="+token, browser)
+	if rr.Code != http.StatusFound || rr.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("expect token in the query to be ignored, got %v %v", rr.Code, rr.Header())
+	}
+	legacyTokenRedirect = true
+	t.Cleanup(func() { legacyTokenRedirect = false })
+	rr = forward("app.example.com", "/page?token="+token, browser)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://app.example.com/page" ||
+		!strings.HasPrefix(rr.Header().Get("Set-Cookie"), "auth="+token+"; Path=/;") {
+		t.Fatalf("expect token of legacy redirect to be accepted, got %v %v", rr.Code, rr.Header())
+	}
+	legacyTokenRedirect = false
+
+	// The access policy of the host applies.
+	if err := servicescmd([]string{"add", "app.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"users", "app.example.com", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	rr = forward("app.example.com", "/page", withCookie)
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "access_denied") {
+		t.Fatalf("expect policy to deny, got %v", rr.Code)
+	}
+
+	// Service tokens are accepted by the host they were issued for.
+	if err := addClient("backup", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := setClientAudiences("backup", []string{"storage.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := newServiceToken("backup", "storage.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = forward("storage.example.com", "/", http.Header{"Authorization": {"Bearer " + st}})
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Auth-Client") != "backup" || rr.Header().Get("X-Auth-User") != "" {
+		t.Fatalf("unexpected response to service token: %v %v", rr.Code, rr.Header())
+	}
+	if rr := forward("app.example.com", "/", http.Header{"Authorization": {"Bearer " + st}}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect service token for another host to be rejected, got %v", rr.Code)
+	}
+}
+
+func TestForwardAuthRefresh(t *testing.T) {
+	_, refresh := setupSession(t)
+
+	forward := func(target, host, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", host)
+		rr := httptest.NewRecorder()
+		forwardauthfunc(rr, req)
+		return rr
+	}
+	cookies := func(rr *httptest.ResponseRecorder) map[string]string {
+		m := map[string]string{}
+		for _, c := range rr.Result().Cookies() {
+			m[c.Name] = c.Value
+		}
+		return m
+	}
+
+	// Other hosts do not receive the refresh cookie, and log in again,
+	// as do proxies that cannot pass on the new cookies.
+	rr := forward("/forward-auth", "app.example.com", "auth=expired; auth_refresh="+refresh)
+	if rr.Code != http.StatusFound || len(cookies(rr)) != 0 {
+		t.Fatalf("expect other hosts to log in again, got %v %v", rr.Code, rr.Header())
+	}
+	rr = forward("/forward-auth?refresh=false", "wiki.changkun.de", "auth=expired; auth_refresh="+refresh)
+	if rr.Code != http.StatusFound || len(cookies(rr)) != 0 {
+		t.Fatalf("expect disabled renewal to log in again, got %v %v", rr.Code, rr.Header())
+	}
+
+	// An expired session is renewed with the refresh cookie.
+	rr = forward("/forward-auth", "wiki.changkun.de", "auth=expired; auth_refresh="+refresh)
+	got := cookies(rr)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Auth-User") != "changkun" || got["auth"] == "" || got["auth_refresh"] == "" {
+		t.Fatalf("expect session to be renewed, got %v %v", rr.Code, rr.Header())
+	}
+	claims, err := parseToken(got["auth"])
+	if err != nil || claims.user() != "changkun" || !checkSession(claims) {
+		t.Fatalf("expect renewed token to be valid, got %+v, %v", claims, err)
+	}
+	rr = forward("/forward-auth", "wiki.changkun.de", "auth_refresh="+got["auth_refresh"])
+	if rr.Code != http.StatusOK || cookies(rr)["auth"] == "" {
+		t.Fatalf("expect session without auth cookie to be renewed, got %v %v", rr.Code, rr.Header())
+	}
+
+	// Unknown refresh tokens lead to the login page.
+	rr = forward("/forward-auth", "wiki.changkun.de", "auth=expired; auth_refresh=bad")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expect invalid refresh token to log in again, got %v", rr.Code)
+	}
+}
@@ -12,18 +12,22 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"changkun.de/x/login/internal/uuid"
-	"github.com/golang-jwt/jwt"
 )
 
-var errUnauthorized = errors.New("request unauthorized")
+var (
+	errUnauthorized = errors.New("request unauthorized")
+
+	// errOTPRequired is returned if the credentials are valid, but the
+	// user has to provide a TOTP code as second factor. It does not
+	// count as failed attempt.
+	errOTPRequired = errors.New("otp required")
+)
 
 // blocklist holds the ip that should be blocked for further requests.
 //
@@ -54,22 +58,57 @@ type blockinfo struct {
 
 const maxFailureAttempts = 10
 
-// loginForm is a login credentials
-type loginForm struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Redirect string `json:"redirect"`
+// blocked reports whether the ip is blocked because of too much failed
+// attempts.
+func blocked(ip string) bool {
+	i, ok := blocklist.Load(ip)
+	if !ok {
+		return false
+	}
+	info := i.(*blockinfo)
+	count := atomic.LoadInt64(&info.failCount)
+	if count <= maxFailureAttempts {
+		return false
+	}
+
+	// if the ip is under block, then directly abort
+	last := info.lastFail.Load().(time.Time)
+	bloc := info.blockTime.Load().(time.Duration)
+	if time.Now().UTC().Sub(last.Add(bloc)) < 0 {
+		log.Printf("block ip %v, too much failure attempts. Block time: %v, release until: %v\n",
+			ip, bloc, last.Add(bloc))
+		return true
+	}
+
+	// clear the failcount, but increase the next block time
+	atomic.StoreInt64(&info.failCount, 0)
+	info.blockTime.Store(bloc * 2)
+	return false
 }
 
-var hmacSecret []byte
+// recordFailure counts a failed attempt of the ip.
+func recordFailure(ip string) {
+	if i, ok := blocklist.Load(ip); !ok {
+		info := &blockinfo{
+			failCount: 1,
+		}
+		info.lastFail.Store(time.Now().UTC())
+		info.blockTime.Store(time.Second * 10)
 
-func init() {
-	secret := os.Getenv("LOGIN_SECRET")
-	if secret == "" {
-		log.Fatal("LOGIN_SECRET is missing.")
+		blocklist.Store(ip, info)
+	} else {
+		info := i.(*blockinfo)
+		atomic.AddInt64(&info.failCount, 1)
+		info.lastFail.Store(time.Now().UTC())
 	}
+}
 
-	hmacSecret = []byte(secret)
+// loginForm is a login credentials
+type loginForm struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	OTP      string `json:"otp"`
+	Redirect string `json:"redirect"`
 }
 
 func authfunc(w http.ResponseWriter, r *http.Request) {
@@ -77,7 +116,7 @@ func authfunc(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "max-age=0")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, *")
 	if r.Method == http.MethodOptions {
 		return
 	}
@@ -88,9 +127,22 @@ func authfunc(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if errors.Is(err, errUnauthorized) {
+		var perr *policyError
+		switch {
+		case errors.As(err, &perr):
+			denyAccess(w, perr)
+		case errors.Is(err, errOTPRequired):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"otp_required"}`))
+			return
+		case errors.Is(err, errInvalidRedirect):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_redirect"}`))
+		case errors.Is(err, errUnauthorized):
 			w.WriteHeader(http.StatusUnauthorized)
-		} else {
+		default:
 			w.WriteHeader(http.StatusBadRequest)
 		}
 		log.Println(err)
@@ -116,44 +168,13 @@ func authfunc(w http.ResponseWriter, r *http.Request) {
 	// check if the IP failure attempts are too much
 	// if so, direct abort the request without checking credentials
 	ip := readIP(r)
-	if i, ok := blocklist.Load(ip); ok {
-		info := i.(*blockinfo)
-		count := atomic.LoadInt64(&info.failCount)
-		if count > maxFailureAttempts {
-			// if the ip is under block, then directly abort
-			last := info.lastFail.Load().(time.Time)
-			bloc := info.blockTime.Load().(time.Duration)
-
-			if time.Now().UTC().Sub(last.Add(bloc)) < 0 {
-				log.Printf("block ip %v, too much failure attempts. Block time: %v, release until: %v\n",
-					ip, bloc, last.Add(bloc))
-				err = fmt.Errorf("%w: too much failure attempts", errUnauthorized)
-				return
-			}
-
-			// clear the failcount, but increase the next block time
-			atomic.StoreInt64(&info.failCount, 0)
-			info.blockTime.Store(bloc * 2)
-		}
+	if blocked(ip) {
+		err = fmt.Errorf("%w: too much failure attempts", errUnauthorized)
+		return
 	}
-
 	defer func() {
-		if !errors.Is(err, errUnauthorized) {
-			return
-		}
-
-		if i, ok := blocklist.Load(ip); !ok {
-			info := &blockinfo{
-				failCount: 1,
-			}
-			info.lastFail.Store(time.Now().UTC())
-			info.blockTime.Store(time.Second * 10)
-
-			blocklist.Store(ip, info)
-		} else {
-			info := i.(*blockinfo)
-			atomic.AddInt64(&info.failCount, 1)
-			info.lastFail.Store(time.Now().UTC())
+		if errors.Is(err, errUnauthorized) {
+			recordFailure(ip)
 		}
 	}()
 
@@ -164,29 +185,60 @@ func authfunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare login jwt token.
-	now := time.Now().UTC()
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Id:        uuid.Must(uuid.NewShort()),
-		IssuedAt:  now.Unix(),
-		NotBefore: now.Unix(),
-		ExpiresAt: now.Add(60 * 24 * time.Hour).Unix(),
-		Audience:  lo.Username,
-		Issuer:    "login.changkun.de",
-		Subject:   "login",
-	}).SignedString(hmacSecret)
-	if err != nil {
-		err = fmt.Errorf("failed to create login token: %w", err)
+	// Checking the second factor if the user enabled it.
+	amr := []string{"pwd"}
+	acc, err := lookupUser(lo.Username)
+	if err != nil || acc == nil {
+		err = fmt.Errorf("%w: failed to load user: %v", errUnauthorized, err)
 		return
 	}
+	if acc.TOTP != "" {
+		if lo.OTP == "" {
+			err = errOTPRequired
+			return
+		}
+		// A recovery code replaces the TOTP code if the device is lost.
+		if !checkTOTP(lo.Username, lo.OTP) && !checkRecoveryCode(r, lo.Username, lo.OTP) {
+			err = fmt.Errorf("%w: invalid otp", errUnauthorized)
+			return
+		}
+		amr = append(amr, "otp")
+	}
+
+	err = issueLogin(w, r, lo.Username, amr, lo.Redirect)
+}
+
+// issueLogin creates a login token of the given user, who authenticated
+// with the given methods, and responds with the location to redirect
+// to. The redirect location must be allowed, see checkRedirect.
+func issueLogin(w http.ResponseWriter, r *http.Request, username string, amr []string, redirect string) error {
+	if redirect != "" {
+		if err := checkRedirect(redirect); err != nil {
+			return err
+		}
+	}
+	if err := checkLoginAccess(r, username, amr, redirect); err != nil {
+		var perr *policyError
+		if errors.As(err, &perr) {
+			audit(r, "login_denied", username, perr.service+": "+perr.reason)
+		}
+		return err
+	}
+
+	// Prepare login jwt token and the refresh token of the session,
+	// and set their cookies if possible.
+	token, refresh, err := startSession(w, r, username, amr)
+	if err != nil {
+		return fmt.Errorf("failed to create login token: %w", err)
+	}
 
 	// The credentials are valid, jwt token is also ready. Now let's
 	// determine where should we redirect the user to. We expect the
 	// request also provide the redirect location, otherwise we use
 	// https://changkun.de as default location.
 
-	u, err := url.Parse(lo.Redirect)
-	if err != nil || lo.Redirect == "" {
+	u, err := url.Parse(redirect)
+	if err != nil || redirect == "" {
 		log.Println("missing redirect, use changkun.de instead.")
 		u = &url.URL{
 			Scheme: "https",
@@ -194,25 +246,27 @@ func authfunc(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Set the cookie if possible.
-	w.Header().Set("Set-Cookie", fmt.Sprintf("auth=%s; Domain=changkun.de; Path=/; Max-Age=%d; SameSite=Lax", token, 60*60*24*60)) // 3 months
-
-	// And supply the token to the redirected location, so that we could
-	// handle CORS cases if the auth is from a different domain.
-	q := u.Query()
-	q.Set("token", token)
-	u.RawQuery = q.Encode()
-	log.Println("redirecting to:", u.String())
+	// And supply the login to the redirected location, so that we
+	// could handle CORS cases if the auth is from a different domain.
+	if err := loginRedirect(u, token); err != nil {
+		return err
+	}
+	log.Println("redirecting to:", u.Scheme+"://"+u.Host+u.Path)
 
-	b, _ = json.Marshal(struct {
-		Redirect string `json:"redirect"`
-		Token    string `json:"token"`
+	b, _ := json.Marshal(struct {
+		Redirect     string `json:"redirect"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
 	}{
-		Redirect: u.String(),
-		Token:    token,
+		Redirect:     u.String(),
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(accessTokenLifetime / time.Second),
 	})
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
+	return nil
 }
 
 func verifyfunc(w http.ResponseWriter, r *http.Request) {
@@ -220,72 +274,158 @@ func verifyfunc(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "max-age=0")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, *")
 	if r.Method == http.MethodOptions {
 		return
 	}
 
 	var err error
 	defer func() {
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if err == nil {
+			return
+		}
+		// Denials of an access policy carry their reason, for the
+		// service to show to the user.
+		var perr *policyError
+		if errors.As(err, &perr) {
+			denyAccess(w, perr)
+			log.Println(err)
 			return
 		}
+		w.WriteHeader(http.StatusBadRequest)
 	}()
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
 		err = errors.New("unsupported method")
 		return
 	}
 
-	// We assume verifying token is provided in the request body.
-	type body struct {
-		Token string `json:"token"`
+	// The verifying token is provided either as bearer token, or in
+	// the request body of a POST request. The calling service names
+	// itself as audience in the body or the query, which service
+	// tokens must have been issued for, and the address of its client
+	// as ip, to which the access policy applies. The service relies
+	// on the response, so it is trusted with the address, whereas the
+	// caller itself is the client without it.
+	token := bearerToken(r)
+	aud := r.URL.Query().Get("audience")
+	ip := r.URL.Query().Get("ip")
+	if r.Method == http.MethodPost {
+		type body struct {
+			Token    string `json:"token"`
+			Audience string `json:"audience"`
+			IP       string `json:"ip"`
+		}
+		var b []byte
+		b, err = io.ReadAll(r.Body)
+		if err != nil {
+			err = fmt.Errorf("failed to read request body: %w", err)
+			return
+		}
+		// The body is optional next to a bearer token.
+		data := &body{}
+		if perr := json.Unmarshal(b, data); perr != nil && token == "" {
+			err = fmt.Errorf("failed to parse request body: %w", perr)
+			return
+		}
+		if token == "" {
+			token = data.Token
+		}
+		if data.Audience != "" {
+			aud = data.Audience
+		}
+		if data.IP != "" {
+			ip = data.IP
+		}
 	}
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		err = fmt.Errorf("failed to read request body: %w", err)
+	if token == "" {
+		err = errors.New("missing token")
+		return
+	}
+	if ip == "" {
+		ip = readIP(r)
+	} else if net.ParseIP(ip) == nil {
+		err = fmt.Errorf("invalid ip: %q", ip)
 		return
 	}
-	data := &body{}
-	err = json.Unmarshal(b, data)
+
+	claims, acc, err := verifyToken(token, aud, ip)
 	if err != nil {
-		err = fmt.Errorf("failed to parse request body: %w", err)
 		return
 	}
+	var roles, groups []string
+	var ext map[string]string
+	if acc != nil {
+		roles, groups, ext = acc.Roles, acc.Groups, acc.Claims
+	}
 
-	// Parse the provided jwt token and see if it is valid for parse
-	t, err := jwt.ParseWithClaims(data.Token, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return hmacSecret, nil
+	// Everything is OK!
+	b, _ := json.Marshal(struct {
+		Username  string            `json:"username"`
+		Subject   string            `json:"sub"`
+		ClientID  string            `json:"client_id,omitempty"`
+		Audience  string            `json:"aud,omitempty"`
+		TokenID   string            `json:"jti,omitempty"`
+		IssuedAt  int64             `json:"iat,omitempty"`
+		ExpiresAt int64             `json:"exp,omitempty"`
+		AMR       []string          `json:"amr,omitempty"`
+		Roles     []string          `json:"roles,omitempty"`
+		Groups    []string          `json:"groups,omitempty"`
+		Ext       map[string]string `json:"ext,omitempty"`
+	}{
+		Username:  claims.user(),
+		Subject:   claims.subject(),
+		ClientID:  claims.ClientID,
+		Audience:  claims.audience(),
+		TokenID:   claims.Id,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		AMR:       claims.AMR,
+		Roles:     roles,
+		Groups:    groups,
+		Ext:       ext,
 	})
+	w.Write(b)
+}
+
+// verifyToken checks the given token for the calling service aud, and
+// returns its claims and the account of its user, which is nil for
+// service tokens or if it cannot be loaded. The account has the
+// current roles and groups, which may have changed since the token
+// was issued, and the access policy of the service is applied with
+// them for a client at the address ip.
+func verifyToken(token, aud, ip string) (*tokenClaims, *account, error) {
+	// Parse the provided jwt token and see if it is valid.
+	claims, err := parseToken(token)
 	if err != nil {
-		err = fmt.Errorf("parse token failed: %w", err)
-		return
+		return nil, nil, err
 	}
 
-	// Checking validity of the token.
-	claims, ok := t.Claims.(*jwt.StandardClaims)
-	if !ok {
-		err = fmt.Errorf("unsupported claims format")
-		return
+	// Tokens that were issued for a service are only accepted if the
+	// caller is that service.
+	if !claims.acceptedBy(aud) {
+		return nil, nil, fmt.Errorf("token for %q is not accepted by %q", claims.audience(), aud)
 	}
-	if !t.Valid {
-		err = fmt.Errorf("invalid claims: %w", claims.Valid())
-		return
+	if claims.ClientID != "" {
+		if !checkServiceToken(claims, aud) {
+			return nil, nil, fmt.Errorf("invalid service token of client %s for %q", claims.ClientID, aud)
+		}
+		return claims, nil, nil
 	}
-
-	if !checkUser(claims.Audience) {
-		err = fmt.Errorf("invalid username: %s", claims.Audience)
-		return
+	if !checkSession(claims) {
+		return nil, nil, fmt.Errorf("invalid session of user: %s", claims.user())
 	}
+	touchSession(claims.SID, claims.Id)
 
-	// Everything is OK!
-	b, _ = json.Marshal(struct {
-		Username string `json:"username"`
-	}{Username: claims.Audience})
-	w.Write(b)
+	u := claims.user()
+	acc, err := lookupUser(u)
+	if err != nil || acc == nil {
+		log.Printf("failed to load user %s: %v", u, err)
+		acc = nil
+	}
+	if err := checkAccess(ip, aud, u, claims.AMR, acc); err != nil {
+		return nil, nil, err
+	}
+	return claims, acc, nil
 }
 
 func homefunc(w http.ResponseWriter, r *http.Request) {
@@ -294,40 +434,75 @@ func homefunc(w http.ResponseWriter, r *http.Request) {
 		log.Println("missing redirect address, use changkun.de instead.")
 		redirAddr = "https://changkun.de"
 	}
+	// The token is appended to the redirect address, which therefore
+	// must be trusted, also if the login form is shown.
+	if err := checkRedirect(redirAddr); err != nil {
+		log.Println(err)
+		redirectError(w, redirAddr)
+		return
+	}
 
 	// Fast path:
 	// Check if cookie contains auth already. If so, check the validity
 	// of the auth cookie, if everything went OK, let's do the redirect
-	// directly without showing the login interface.
-	c, err := r.Cookie("auth")
-	if err == nil {
+	// directly without showing the login interface. Relying parties
+	// that ask the user to log in again skip it with prompt=login.
+	token := ""
+	if r.URL.Query().Get("prompt") != "login" {
+		token, _ = browserLogin(w, r)
+	}
+	if token != "" {
+		uu, err := url.Parse(redirAddr)
+		if err == nil {
+			err = loginRedirect(uu, token)
+		}
+		if err == nil {
+			http.Redirect(w, r, uu.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		log.Println(err)
+	}
+
+	loginTmpl.Execute(w, nil)
+}
+
+// showError shows the error page with the given status.
+func showError(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorTmpl.Execute(w, struct {
+		Title   string
+		Message string
+	}{title, message})
+}
+
+// browserLogin returns the login token of the browser and its claims.
+// The token is read from the auth cookie, or if that expired, renewed
+// with the refresh cookie. It returns an empty token if the browser is
+// not logged in.
+func browserLogin(w http.ResponseWriter, r *http.Request) (string, *tokenClaims) {
+	if c, err := r.Cookie("auth"); err == nil {
 		// We found previous authentication token, let's check if
 		// this is already logined credentials.
-		var t *jwt.Token
-		t, err = jwt.ParseWithClaims(c.Value, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return hmacSecret, nil
-		})
+		claims, err := parseToken(c.Value)
+		if err == nil && checkSession(claims) {
+			return c.Value, claims
+		}
+	}
+
+	// The access token expired, but the session may still be alive.
+	// Renew it with the refresh token.
+	if c, err := r.Cookie("auth_refresh"); err == nil {
+		token, _, err := refresh(w, r, c.Value)
 		if err == nil {
-			// Checking validity of the token.
-			claims, ok := t.Claims.(*jwt.StandardClaims)
-			if ok && t.Valid && checkUser(claims.Audience) {
-				uu, err := url.Parse(redirAddr)
-				if err == nil {
-					q := uu.Query()
-					q.Set("token", c.Value)
-					uu.RawQuery = q.Encode()
-					http.Redirect(w, r, uu.String(), http.StatusTemporaryRedirect)
-					return
-				}
+			if claims, err := parseToken(token); err == nil {
+				return token, claims
 			}
 		}
 	}
-
-	loginTmpl.Execute(w, nil)
+	return "", nil
 }
+
 func testfunc(w http.ResponseWriter, r *http.Request) { testTmpl.Execute(w, nil) }
 
 func sdkfunc(w http.ResponseWriter, r *http.Request) {
@@ -346,6 +521,10 @@ var (
 	testFile string
 	testTmpl = template.Must(template.New("test").Parse(testFile))
 
+	//go:embed error.html
+	errorFile string
+	errorTmpl = template.Must(template.New("error").Parse(errorFile))
+
 	//go:embed sdk.js
 	sdkFile string
 )
@@ -0,0 +1,224 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	setupData(t)
+	hmacSecret = []byte("secret")
+	if err := setPassword("changkun", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := signToken(testClaims("changkun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"body", httptest.NewRequest("POST", "/verify", strings.NewReader(`{"token":"`+token+`"}`)), http.StatusOK},
+		{"bearer get", httptest.NewRequest("GET", "/verify", nil), http.StatusOK},
+		{"bearer post", httptest.NewRequest("POST", "/verify", nil), http.StatusOK},
+		{"missing", httptest.NewRequest("GET", "/verify", nil), http.StatusBadRequest},
+		{"invalid", httptest.NewRequest("GET", "/verify", nil), http.StatusBadRequest},
+	}
+	tests[1].req.Header.Set("Authorization", "Bearer "+token)
+	tests[2].req.Header.Set("Authorization", "bearer "+token)
+	tests[4].req.Header.Set("Authorization", "Bearer "+token+"x")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			verifyfunc(rr, tt.req)
+			if rr.Code != tt.status {
+				t.Fatalf("unexpected status: got %v want %v", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var out struct {
+				Username string `json:"username"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &out)
+			if out.Username != "changkun" {
+				t.Fatalf("unexpected username: %v", out.Username)
+			}
+		})
+	}
+}
+
+func TestVerifyAudience(t *testing.T) {
+	setupData(t)
+	hmacSecret = []byte("secret")
+	if err := setPassword("changkun", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := signToken(testClaims("changkun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _, err := newSessionToken("changkun", "", nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restricted, _, err := newSessionToken("changkun", "blog.changkun.de", nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		audience string
+		status   int
+	}{
+		{"legacy", legacy, "", http.StatusOK},
+		{"legacy with audience", legacy, "blog.changkun.de", http.StatusOK},
+		{"shared", shared, "", http.StatusOK},
+		{"shared with audience", shared, "blog.changkun.de", http.StatusOK},
+		{"restricted", restricted, "blog.changkun.de", http.StatusOK},
+		{"restricted without audience", restricted, "", http.StatusBadRequest},
+		{"restricted for other service", restricted, "wiki.changkun.de", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/verify", strings.NewReader(`{"audience":"`+tt.audience+`"}`))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			verifyfunc(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("unexpected status: got %v want %v", rr.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var out struct {
+				Username string `json:"username"`
+				Subject  string `json:"sub"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &out)
+			if out.Username != "changkun" || out.Subject != "changkun" {
+				t.Fatalf("unexpected user: %s", rr.Body.String())
+			}
+		})
+	}
+
+	// Tokens of the first layout must say so.
+	claims := testClaims("changkun")
+	claims.Subject = "someone"
+	if token, _ := signToken(claims); token != "" {
+		if _, err := parseToken(token); err == nil {
+			t.Fatalf("expect unknown claim layout to be rejected")
+		}
+	}
+}
+
+func TestVerifyRoles(t *testing.T) {
+	setupUser(t)
+	if err := userscmd([]string{"roles", "changkun", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := userscmd([]string{"groups", "changkun", "family", "friends"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The login emits the roles and groups as claims.
+	rr := httptest.NewRecorder()
+	authfunc(rr, httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret"}`)))
+	var login struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &login)
+	claims, err := parseToken(login.Token)
+	if err != nil || len(claims.Roles) != 1 || claims.Roles[0] != "admin" || len(claims.Groups) != 2 {
+		t.Fatalf("unexpected claims: %+v, %v", claims, err)
+	}
+
+	verify := func() (roles, groups []string) {
+		req := httptest.NewRequest("GET", "/verify", nil)
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		var out struct {
+			Roles  []string `json:"roles"`
+			Groups []string `json:"groups"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to verify: %v", rr.Code)
+		}
+		return out.Roles, out.Groups
+	}
+	if roles, groups := verify(); len(roles) != 1 || len(groups) != 2 {
+		t.Fatalf("unexpected roles %v and groups %v", roles, groups)
+	}
+
+	// The verify endpoint returns the current roles.
+	if err := userscmd([]string{"roles", "changkun"}); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := verify(); len(roles) != 0 {
+		t.Fatalf("expect roles to be removed, got %v", roles)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	setupUser(t)
+	if err := userscmd([]string{"claims", "changkun", "name"}); err == nil {
+		t.Fatalf("expect claim without value to be rejected")
+	}
+	if err := userscmd([]string{"claims", "changkun", "name=Changkun Ou", "tenant="}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The login emits the custom claims as ext.
+	rr := httptest.NewRecorder()
+	authfunc(rr, httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret"}`)))
+	var login struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &login)
+	claims, err := parseToken(login.Token)
+	if err != nil || claims.Ext["name"] != "Changkun Ou" || len(claims.Ext) != 2 {
+		t.Fatalf("unexpected claims: %+v, %v", claims, err)
+	}
+
+	verify := func() map[string]string {
+		req := httptest.NewRequest("GET", "/verify", nil)
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		var out struct {
+			Ext map[string]string `json:"ext"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to verify: %v", rr.Code)
+		}
+		return out.Ext
+	}
+	if ext := verify(); ext["name"] != "Changkun Ou" {
+		t.Fatalf("unexpected custom claims %v", ext)
+	}
+
+	// The verify endpoint returns the current custom claims.
+	if err := userscmd([]string{"claims", "changkun"}); err != nil {
+		t.Fatal(err)
+	}
+	if ext := verify(); len(ext) != 0 {
+		t.Fatalf("expect custom claims to be removed, got %v", ext)
+	}
+}
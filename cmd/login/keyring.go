@@ -0,0 +1,356 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"changkun.de/x/login/internal/jwk"
+	"github.com/golang-jwt/jwt"
+)
+
+// tokenLifetime is the lifetime of issued tokens. Retired keys are
+// kept for verification for this long after their retirement.
+const tokenLifetime = 60 * 24 * time.Hour
+
+// keyRing holds the signing keys. Exactly one key is active and used
+// to sign new tokens; retired keys are only used for verification
+// until all tokens signed with them have expired.
+type keyRing struct {
+	Active string      `json:"active"`
+	Keys   []*keyEntry `json:"keys"`
+}
+
+// keyEntry is a signing key in the key ring.
+type keyEntry struct {
+	Kid     string    `json:"kid"`
+	Alg     string    `json:"alg"`
+	Key     string    `json:"key"` // PEM encoded PKCS #8 private key
+	Created time.Time `json:"created"`
+	Retired time.Time `json:"retired,omitempty"`
+
+	signer crypto.Signer // parsed Key, set lazily
+}
+
+// keys is the key ring of the server.
+var keys *jsonFile[keyRing]
+
+// openKeys opens the key ring in the data directory.
+func openKeys() { keys = newJSONFile[keyRing](dataPath("keys.json")) }
+
+// loadKeys loads the key ring from the data directory and the legacy
+// secret from the environment.
+//
+// LOGIN_SIGNING_KEY optionally names a PEM encoded Ed25519, ECDSA or
+// RSA private key. If the key ring has never seen the key before, the
+// key ring is rotated to it. LOGIN_KEY_ROTATION optionally sets
+// an interval after which the active key is rotated automatically.
+func loadKeys() error {
+	hmacSecret = []byte(os.Getenv("LOGIN_SECRET"))
+	openKeys()
+
+	if path := os.Getenv("LOGIN_SIGNING_KEY"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read signing key: %w", err)
+		}
+		key, err := parsePrivateKey(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse signing key: %w", err)
+		}
+		err = importKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to import signing key: %w", err)
+		}
+	}
+
+	if every := os.Getenv("LOGIN_KEY_ROTATION"); every != "" {
+		d, err := time.ParseDuration(every)
+		if err != nil {
+			return fmt.Errorf("invalid LOGIN_KEY_ROTATION: %w", err)
+		}
+		go rotateEvery(d)
+	}
+
+	var active bool
+	err := keys.view(func(ring *keyRing) error {
+		active = ring.Active != ""
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load key ring: %w", err)
+	}
+	if !active && len(hmacSecret) == 0 {
+		return errors.New("LOGIN_SECRET, LOGIN_SIGNING_KEY or a key ring is required")
+	}
+	if active && len(hmacSecret) != 0 && !acceptHMAC(time.Now()) {
+		log.Println("HS256 tokens have expired and are no longer accepted, LOGIN_SECRET can be removed")
+	}
+	return nil
+}
+
+// rotateEvery rotates the active key once it is older than d.
+func rotateEvery(d time.Duration) {
+	check := time.Hour
+	if d < check {
+		check = d
+	}
+	for ; ; time.Sleep(check) {
+		var (
+			created time.Time
+			alg     string
+		)
+		err := keys.view(func(ring *keyRing) error {
+			if e := ring.active(); e != nil {
+				created, alg = e.Created, e.Alg
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("failed to load key ring: %v", err)
+			continue
+		}
+		if alg == "" || time.Since(created) < d {
+			continue
+		}
+
+		key, err := generateKey(alg)
+		if err == nil {
+			err = rotateKey(key)
+		}
+		if err != nil {
+			log.Printf("failed to rotate signing key: %v", err)
+			continue
+		}
+		log.Printf("signing key rotated")
+	}
+}
+
+// importKey rotates the key ring to key unless the key ring already
+// contains it. Thus a key that was rotated away from with an admin
+// command is not reactivated because it is still configured.
+func importKey(key crypto.Signer) error {
+	kid, err := keyID(key)
+	if err != nil {
+		return err
+	}
+	var known bool
+	err = keys.view(func(ring *keyRing) error {
+		for _, e := range ring.Keys {
+			known = known || e.Kid == kid
+		}
+		return nil
+	})
+	if err != nil || known {
+		return err
+	}
+	return rotateKey(key)
+}
+
+// keyID returns the key ID of the given key, which is the JWK
+// thumbprint of its public key.
+func keyID(key crypto.Signer) (string, error) {
+	m, err := methodForKey(key)
+	if err != nil {
+		return "", err
+	}
+	pub, err := jwk.New("", m.Alg(), key.Public())
+	if err != nil {
+		return "", err
+	}
+	return jwk.Thumbprint(pub), nil
+}
+
+// rotateKey makes key the active key of the key ring. The previously
+// active key is retired, and keys that were retired long enough for
+// all their tokens to have expired are removed. Rotating to the key
+// that is already active does nothing.
+func rotateKey(key crypto.Signer) error {
+	m, err := methodForKey(key)
+	if err != nil {
+		return err
+	}
+	kid, err := keyID(key)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return keys.update(func(ring *keyRing) error {
+		if ring.Active == kid {
+			return nil
+		}
+
+		now := time.Now().UTC()
+		kept := ring.Keys[:0]
+		for _, e := range ring.Keys {
+			if e.Kid == kid {
+				continue
+			}
+			if e.Kid == ring.Active {
+				e.Retired = now
+			}
+			if e.expired(now) {
+				continue
+			}
+			kept = append(kept, e)
+		}
+		ring.Keys = append(kept, &keyEntry{
+			Kid:     kid,
+			Alg:     m.Alg(),
+			Key:     string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			Created: now,
+			signer:  key,
+		})
+		ring.Active = kid
+		return nil
+	})
+}
+
+// active returns the active key or nil if there is none.
+func (ring *keyRing) active() *keyEntry {
+	return ring.lookup(ring.Active)
+}
+
+// lookup returns the key with the given key ID or nil if there is no
+// such key or the key should no longer be used for verification.
+func (ring *keyRing) lookup(kid string) *keyEntry {
+	if kid == "" {
+		return nil
+	}
+	for _, e := range ring.Keys {
+		if e.Kid == kid && !e.expired(time.Now()) {
+			return e
+		}
+	}
+	return nil
+}
+
+// migrated returns when the first key was added to the key ring, or
+// the zero time if the key ring is empty.
+func (ring *keyRing) migrated() (t time.Time) {
+	for _, e := range ring.Keys {
+		if t.IsZero() || e.Created.Before(t) {
+			t = e.Created
+		}
+	}
+	return t
+}
+
+// acceptHMAC reports whether HS256 tokens of the legacy secret are
+// accepted at the given time, which is until all tokens issued before
+// the migration to the key ring have expired.
+func acceptHMAC(now time.Time) bool {
+	var migrated time.Time
+	err := keys.view(func(ring *keyRing) error {
+		migrated = ring.migrated()
+		return nil
+	})
+	return err == nil && (migrated.IsZero() || now.Sub(migrated) <= tokenLifetime)
+}
+
+// expired reports whether all tokens signed with the key have expired.
+func (e *keyEntry) expired(now time.Time) bool {
+	return !e.Retired.IsZero() && now.Sub(e.Retired) > tokenLifetime
+}
+
+// key returns the parsed private key.
+func (e *keyEntry) key() (crypto.Signer, error) {
+	if e.signer != nil {
+		return e.signer, nil
+	}
+	key, err := parsePrivateKey([]byte(e.Key))
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", e.Kid, err)
+	}
+	e.signer = key
+	return key, nil
+}
+
+// generateKey generates a new private key for the given algorithm.
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// parsePrivateKey parses a PEM encoded private key in PKCS #8, SEC 1
+// or PKCS #1 form.
+func parsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// methodForKey returns the JWT signing method for the given key.
+func methodForKey(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return jwt.SigningMethodES256, nil
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
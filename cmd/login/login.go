@@ -9,17 +9,69 @@ import (
 	"log"
 	"net/http"
 	"os"
+	_ "time/tzdata" // the image has no time zone database
 )
 
 func main() {
 	log.SetPrefix("login: ")
 	log.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := loadCredentials(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRedirectAllowlist(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadOrigin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTokenRedirect(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTimeZone(); err != nil {
+		log.Fatal(err)
+	}
+	openRefreshTokens()
+	openRevocations()
+	openSessions()
+	openClients()
+	openServices()
+
 	http.Handle("/", logging(http.HandlerFunc(homefunc)))
 	http.Handle("/auth", logging(http.HandlerFunc(authfunc)))
+	http.Handle("/auth/passkey", logging(http.HandlerFunc(passkeyloginfunc)))
+	http.Handle("/token", logging(http.HandlerFunc(tokenfunc)))
+	http.Handle("/exchange", logging(http.HandlerFunc(exchangefunc)))
+	http.Handle("/authorize", logging(http.HandlerFunc(authorizefunc)))
+	http.Handle("/userinfo", logging(http.HandlerFunc(userinfofunc)))
+	http.Handle("/device", logging(http.HandlerFunc(devicefunc)))
+	http.Handle("/device/code", logging(http.HandlerFunc(devicecodefunc)))
+	http.Handle("/logout", logging(http.HandlerFunc(logoutfunc)))
+	http.Handle("/revocations", logging(http.HandlerFunc(revocationsfunc)))
 	http.Handle("/verify", logging(http.HandlerFunc(verifyfunc)))
+	http.Handle("/forward-auth", logging(http.HandlerFunc(forwardauthfunc)))
+	http.Handle("/account", logging(http.HandlerFunc(accountfunc)))
+	http.Handle("/account/totp", logging(http.HandlerFunc(totpfunc)))
+	http.Handle("/account/passkey", logging(http.HandlerFunc(passkeyfunc)))
+	http.Handle("/account/sessions", logging(http.HandlerFunc(sessionsfunc)))
 	http.Handle("/test", logging(http.HandlerFunc(testfunc)))
 	http.Handle("/sdk.js", logging(http.HandlerFunc(sdkfunc)))
+	http.Handle("/.well-known/jwks.json", logging(http.HandlerFunc(jwksfunc)))
+	http.Handle("/.well-known/openid-configuration", logging(http.HandlerFunc(discoveryfunc)))
 
 	port := os.Getenv("LOGIN_PORT")
 	if port == "" {
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func testClaims(user string) jwt.StandardClaims {
+	now := time.Now().UTC()
+	return jwt.StandardClaims{
+		Id:        "test",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		Audience:  user,
+		Issuer:    issuer,
+		Subject:   "login",
+	}
+}
+
+// setupData points the data directory to a temporary directory and
+// opens the empty stores.
+func setupData(t *testing.T) {
+	t.Helper()
+	t.Setenv("LOGIN_DATA", t.TempDir())
+	openKeys()
+	openUsers()
+	openRefreshTokens()
+	openRevocations()
+	openSessions()
+	openClients()
+	openServices()
+	hmacSecret, bootstrap = nil, nil
+
+	// Keep password hashing cheap in tests.
+	params := hashParams
+	hashParams.time, hashParams.memory, hashParams.threads = 1, 64, 1
+	t.Cleanup(func() {
+		hmacSecret, bootstrap = nil, nil
+		hashParams = params
+		blocklist.Range(func(k, _ interface{}) bool {
+			blocklist.Delete(k)
+			return true
+		})
+	})
+}
+
+// setupUser is setupData with a signing key and the user changkun,
+// whose password is "secret".
+func setupUser(t *testing.T) {
+	t.Helper()
+	setupData(t)
+	if err := keyscmd([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPassword("changkun", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setupSession is setupUser with a password login of changkun, and
+// returns the access and refresh token of its session.
+func setupSession(t *testing.T) (access, refresh string) {
+	t.Helper()
+	setupUser(t)
+	access, refresh, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return access, refresh
+}
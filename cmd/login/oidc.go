@@ -0,0 +1,461 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// The login server is an OpenID Connect provider for applications that
+// are registered as clients, see clients.go. It implements the
+// authorization code flow with PKCE: /authorize redirects the browser
+// to the login page if needed and back to the client with a code, which
+// the client exchanges at /token for an access token and an ID token.
+
+// errInvalidClient is returned if a client failed to authenticate.
+var errInvalidClient = errors.New("invalid client")
+
+// oidcCodes are the pending authorization codes of OpenID Connect
+// clients. They are single use and expire after authCodeLifetime.
+var oidcCodes = struct {
+	sync.Mutex
+	m map[string]oidcCode
+}{m: map[string]oidcCode{}}
+
+// oidcCode is an authorization code of a client for the login session
+// of a user.
+type oidcCode struct {
+	clientID      string
+	redirectURI   string
+	scope         string
+	nonce         string
+	codeChallenge string
+
+	user     string
+	amr      []string
+	epoch    int
+	sid      string
+	authTime time.Time
+	expires  time.Time
+}
+
+// newOIDCCode stores the given code and returns its value.
+func newOIDCCode(c oidcCode) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := b64url.EncodeToString(b)
+
+	oidcCodes.Lock()
+	defer oidcCodes.Unlock()
+	now := time.Now()
+	for k, c := range oidcCodes.m {
+		if now.After(c.expires) {
+			delete(oidcCodes.m, k)
+		}
+	}
+	c.expires = now.Add(authCodeLifetime)
+	oidcCodes.m[code] = c
+	return code, nil
+}
+
+// redeemOIDCCode returns the given authorization code and removes it.
+func redeemOIDCCode(code string) (*oidcCode, error) {
+	oidcCodes.Lock()
+	defer oidcCodes.Unlock()
+	c, ok := oidcCodes.m[code]
+	delete(oidcCodes.m, code)
+	if !ok || time.Now().After(c.expires) {
+		return nil, fmt.Errorf("%w: unknown or expired code", errUnauthorized)
+	}
+	return &c, nil
+}
+
+// idTokenClaims are the claims of ID tokens. Unlike login tokens, they
+// are issued for a client, which is their audience.
+type idTokenClaims struct {
+	jwt.StandardClaims
+
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time"`
+	AMR               []string `json:"amr,omitempty"`
+	SID               string   `json:"sid,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+}
+
+// newIDToken returns the ID token for the given authorization code.
+func newIDToken(c *oidcCode) (string, error) {
+	// Relying parties verify ID tokens with the published keys, which
+	// does not work for the legacy secret.
+	if activeAlg() == "" {
+		return "", errors.New("ID tokens require a signing key, see login keys rotate")
+	}
+	now := time.Now().UTC()
+	claims := idTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    rp.Origin,
+			Subject:   c.user,
+			Audience:  c.clientID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenLifetime).Unix(),
+		},
+		Nonce:    c.nonce,
+		AuthTime: c.authTime.Unix(),
+		AMR:      c.amr,
+		SID:      c.sid,
+	}
+	if hasWord(c.scope, "profile") {
+		claims.PreferredUsername = c.user
+	}
+	return signToken(claims)
+}
+
+// activeAlg returns the algorithm of the active signing key, or an
+// empty string if tokens are signed with the legacy secret.
+func activeAlg() string {
+	alg := ""
+	err := keys.view(func(ring *keyRing) error {
+		if e := ring.active(); e != nil {
+			alg = e.Alg
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to load signing keys: %v", err)
+	}
+	return alg
+}
+
+// hasWord reports whether the space separated list s, such as a scope,
+// contains w.
+func hasWord(s, w string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == w {
+			return true
+		}
+	}
+	return false
+}
+
+// authTime returns when the user of the given token logged in.
+func authTime(claims *tokenClaims) time.Time {
+	s, err := lookupSession(claims.SID)
+	if err == nil && s != nil {
+		return s.Created
+	}
+	return time.Unix(claims.IssuedAt, 0)
+}
+
+// discoveryfunc serves the OpenID Connect discovery document.
+func discoveryfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	algs := []string{}
+	if alg := activeAlg(); alg != "" {
+		algs = append(algs, alg)
+	}
+	writeJSON(w, struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		DeviceEndpoint        string   `json:"device_authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+		JWKSURI               string   `json:"jwks_uri"`
+		ResponseTypes         []string `json:"response_types_supported"`
+		GrantTypes            []string `json:"grant_types_supported"`
+		SubjectTypes          []string `json:"subject_types_supported"`
+		SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+		Scopes                []string `json:"scopes_supported"`
+		TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+		Claims                []string `json:"claims_supported"`
+		PromptValues          []string `json:"prompt_values_supported"`
+		RequestParameter      bool     `json:"request_parameter_supported"`
+		RequestURIParameter   bool     `json:"request_uri_parameter_supported"`
+		ClaimsParameter       bool     `json:"claims_parameter_supported"`
+		IssParameter          bool     `json:"authorization_response_iss_parameter_supported"`
+	}{
+		Issuer:                rp.Origin,
+		AuthorizationEndpoint: rp.Origin + "/authorize",
+		DeviceEndpoint:        rp.Origin + "/device/code",
+		TokenEndpoint:         rp.Origin + "/token",
+		UserinfoEndpoint:      rp.Origin + "/userinfo",
+		JWKSURI:               rp.Origin + "/.well-known/jwks.json",
+		ResponseTypes:         []string{"code"},
+		GrantTypes:            []string{"authorization_code", "client_credentials", deviceGrantType},
+		SubjectTypes:          []string{"public"},
+		SigningAlgs:           algs,
+		Scopes:                []string{"openid", "profile"},
+		TokenAuthMethods:      []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethods:  []string{"S256"},
+		Claims:                []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr", "sid", "preferred_username", "roles", "groups"},
+		PromptValues:          []string{"none", "login"},
+		IssParameter:          true,
+	})
+}
+
+// authorizefunc handles authorization requests of clients. Logged in
+// users are redirected back to the client with an authorization code,
+// others log in on the login page first, which brings them back here.
+func authorizefunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		showError(w, http.StatusBadRequest, "Invalid request", "The authorization request is malformed.")
+		return
+	}
+	q := r.Form
+
+	// Without a valid client and redirect URI, errors cannot be sent
+	// back to the client, and are shown to the user instead.
+	c, err := lookupClient(q.Get("client_id"))
+	if err != nil {
+		log.Printf("failed to load clients: %v", err)
+	}
+	if c == nil || !c.hasRedirectURI(q.Get("redirect_uri")) {
+		log.Printf("unknown client %q or redirect uri %q", q.Get("client_id"), q.Get("redirect_uri"))
+		showError(w, http.StatusBadRequest, "Unknown application",
+			"The application that sent you here is not registered with the login server, or not with this redirect address.")
+		return
+	}
+	respond := func(params url.Values) {
+		u, _ := url.Parse(q.Get("redirect_uri"))
+		v := u.Query()
+		for k := range params {
+			v.Set(k, params.Get(k))
+		}
+		if state := q.Get("state"); state != "" {
+			v.Set("state", state)
+		}
+		v.Set("iss", rp.Origin)
+		u.RawQuery = v.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	fail := func(code, description string) {
+		log.Printf("authorization request of %s failed: %s: %s", c.ID, code, description)
+		respond(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	switch {
+	case q.Get("response_type") != "code":
+		fail("unsupported_response_type", "only the authorization code flow is supported")
+		return
+	case !hasWord(q.Get("scope"), "openid"):
+		fail("invalid_scope", "the openid scope is required")
+		return
+	case q.Get("request") != "":
+		fail("request_not_supported", "request objects are not supported")
+		return
+	case q.Get("request_uri") != "":
+		fail("request_uri_not_supported", "request objects are not supported")
+		return
+	case q.Get("code_challenge") == "" && c.public():
+		fail("invalid_request", "public clients must use PKCE")
+		return
+	case q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "the code challenge method must be S256")
+		return
+	}
+
+	// Check the session of the browser. Users log in again if the
+	// client asks for it, or if their login is older than it accepts.
+	prompt := q.Get("prompt")
+	reauth := hasWord(prompt, "login")
+	var claims *tokenClaims
+	if !reauth {
+		_, claims = browserLogin(w, r)
+	}
+	if claims != nil && q.Get("max_age") != "" {
+		maxAge, err := strconv.Atoi(q.Get("max_age"))
+		if err == nil && time.Since(authTime(claims)) > time.Duration(maxAge)*time.Second {
+			claims, reauth = nil, true
+		}
+	}
+	if claims == nil {
+		if hasWord(prompt, "none") {
+			fail("login_required", "the user is not logged in")
+			return
+		}
+		// Come back after the login, without asking again.
+		q.Del("prompt")
+		q.Del("max_age")
+		login := url.Values{"redirect": {"/authorize?" + q.Encode()}}
+		if reauth {
+			login.Set("prompt", "login")
+		}
+		http.Redirect(w, r, "/?"+login.Encode(), http.StatusFound)
+		return
+	}
+
+	// The access policies of the login server, of the client and of
+	// the host it redirects to apply as to other logins.
+	err = checkLoginAccess(r, claims.user(), claims.AMR, q.Get("redirect_uri"))
+	if err == nil {
+		var acc *account
+		acc, err = lookupUser(claims.user())
+		if err == nil {
+			err = checkAccess(readIP(r), c.ID, claims.user(), claims.AMR, acc)
+		}
+	}
+	var perr *policyError
+	if errors.As(err, &perr) {
+		audit(r, "login_denied", claims.user(), perr.service+": "+perr.reason)
+		fail("access_denied", perr.reason)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to check access of %s: %v", claims.user(), err)
+		fail("server_error", "failed to check access")
+		return
+	}
+
+	code, err := newOIDCCode(oidcCode{
+		clientID:      c.ID,
+		redirectURI:   q.Get("redirect_uri"),
+		scope:         q.Get("scope"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		user:          claims.user(),
+		amr:           claims.AMR,
+		epoch:         claims.Epoch,
+		sid:           claims.SID,
+		authTime:      authTime(claims),
+	})
+	if err != nil {
+		fail("server_error", "failed to create authorization code")
+		return
+	}
+	audit(r, "client_authorized", claims.user(), c.ID)
+	respond(url.Values{"code": {code}})
+}
+
+// authenticateClient returns the client of the given token request.
+// Confidential clients authenticate with their secret, either with
+// HTTP basic authentication or in the request body, public clients
+// only send their ID. Failed attempts count towards the blocklist.
+func authenticateClient(r *http.Request, req *tokenRequest) (*client, error) {
+	id, secret := req.ClientID, req.ClientSecret
+	if u, p, ok := r.BasicAuth(); ok {
+		// Both are form encoded, see RFC 6749, Section 2.3.1.
+		id, _ = url.QueryUnescape(u)
+		secret, _ = url.QueryUnescape(p)
+	}
+
+	ip := readIP(r)
+	if blocked(ip) {
+		return nil, fmt.Errorf("%w: too much failure attempts", errInvalidClient)
+	}
+	c, err := lookupClient(id)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil || c.public() && secret != "" || !c.public() && !c.checkSecret(secret) {
+		recordFailure(ip)
+		return nil, fmt.Errorf("%w: %q", errInvalidClient, id)
+	}
+	return c, nil
+}
+
+// verifyPKCE reports whether the code verifier matches the S256 code
+// challenge of an authorization request, see RFC 7636.
+func verifyPKCE(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	h := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(b64url.EncodeToString(h[:])), []byte(challenge)) == 1
+}
+
+// authorizationCodeGrant exchanges the authorization code of a client
+// for an access token and an ID token.
+func authorizationCodeGrant(w http.ResponseWriter, r *http.Request, req *tokenRequest) error {
+	c, err := authenticateClient(r, req)
+	if err != nil {
+		return err
+	}
+	code, err := redeemOIDCCode(req.Code)
+	if err != nil {
+		return err
+	}
+	if code.clientID != c.ID || code.redirectURI != req.RedirectURI {
+		return fmt.Errorf("%w: code of %s was not issued for %s", errUnauthorized, code.clientID, c.ID)
+	}
+	if !verifyPKCE(code.codeChallenge, req.CodeVerifier) {
+		return fmt.Errorf("%w: invalid code verifier", errUnauthorized)
+	}
+
+	// The session may have ended since the code was issued.
+	claims := &tokenClaims{Version: tokenVersion, AMR: code.amr, Epoch: code.epoch, SID: code.sid}
+	claims.Subject = code.user
+	if !checkSession(claims) {
+		return fmt.Errorf("%w: invalid session of %s", errUnauthorized, code.user)
+	}
+	access, jti, err := newSessionToken(code.user, c.ID, code.amr, code.epoch, code.sid)
+	if err != nil {
+		return err
+	}
+	addSessionToken(code.sid, jti)
+	idToken, err := newIDToken(code)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+	}{access, "Bearer", int(accessTokenLifetime / time.Second), idToken, code.scope})
+	return nil
+}
+
+// userinfofunc returns the claims about the user of an access token.
+func userinfofunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	claims, err := parseToken(bearerToken(r))
+	if err != nil || !checkSession(claims) {
+		log.Printf("invalid userinfo request: %v", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	acc, err := lookupUser(claims.user())
+	if err != nil || acc == nil {
+		log.Printf("failed to load user %s: %v", claims.user(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Subject           string   `json:"sub"`
+		PreferredUsername string   `json:"preferred_username"`
+		Roles             []string `json:"roles,omitempty"`
+		Groups            []string `json:"groups,omitempty"`
+	}{acc.Username, acc.Username, acc.Roles, acc.Groups})
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestOIDC(t *testing.T) {
+	token, _ := setupSession(t)
+	const redirectURI = "https://grafana.example.com/login/generic_oauth"
+	if err := addClient("grafana", []string{redirectURI}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := newClientSecret("grafana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addClient("cli", []string{"http://127.0.0.1:8000/callback"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The discovery document points to the endpoints.
+	rr := httptest.NewRecorder()
+	discoveryfunc(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	var conf struct {
+		Issuer        string   `json:"issuer"`
+		TokenEndpoint string   `json:"token_endpoint"`
+		SigningAlgs   []string `json:"id_token_signing_alg_values_supported"`
+		GrantTypes    []string `json:"grant_types_supported"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &conf)
+	if conf.Issuer != rp.Origin || conf.TokenEndpoint != rp.Origin+"/token" || len(conf.SigningAlgs) != 1 ||
+		contains(conf.GrantTypes, "refresh_token") {
+		t.Fatalf("unexpected discovery document: %s", rr.Body.String())
+	}
+
+	verifier := strings.Repeat("v", 43)
+	h := sha256.Sum256([]byte(verifier))
+	challenge := b64url.EncodeToString(h[:])
+	authorize := func(params url.Values, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "auth", Value: cookie})
+		}
+		rr := httptest.NewRecorder()
+		authorizefunc(rr, req)
+		return rr
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"grafana"},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	location := func(rr *httptest.ResponseRecorder) url.Values {
+		u, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query()
+	}
+
+	// Unknown clients and redirect URIs are shown an error.
+	bad := url.Values{}
+	for k, v := range params {
+		bad[k] = v
+	}
+	bad.Set("redirect_uri", "https://evil.com/")
+	if rr := authorize(bad, token); rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+		t.Fatalf("expect unknown redirect uri to be rejected, got %v", rr.Code)
+	}
+
+	// Users that are not logged in go to the login page, unless the
+	// client asks not to.
+	rr = authorize(params, "")
+	if rr.Code != http.StatusFound || !strings.HasPrefix(location(rr).Get("redirect"), "/authorize?") {
+		t.Fatalf("expect redirect to login page, got %v %v", rr.Code, rr.Header().Get("Location"))
+	}
+	params.Set("prompt", "none")
+	if q := location(authorize(params, "")); q.Get("error") != "login_required" || q.Get("state") != "xyz" {
+		t.Fatalf("expect login_required, got %v", q)
+	}
+	params.Del("prompt")
+
+	// Public clients must use PKCE.
+	cli := url.Values{"response_type": {"code"}, "client_id": {"cli"}, "redirect_uri": {"http://127.0.0.1:8000/callback"}, "scope": {"openid"}}
+	if q := location(authorize(cli, token)); q.Get("error") != "invalid_request" {
+		t.Fatalf("expect PKCE to be required, got %v", q)
+	}
+
+	type tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	exchange := func(code, id, secret, verifier string) (int, tokens) {
+		body := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI}, "code_verifier": {verifier}}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(id, secret)
+		rr := httptest.NewRecorder()
+		tokenfunc(rr, req)
+		var out tokens
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+
+	// Logged in users are sent back with a code.
+	q := location(authorize(params, token))
+	if q.Get("code") == "" || q.Get("state") != "xyz" || q.Get("iss") != rp.Origin {
+		t.Fatalf("expect code, got %v", q)
+	}
+	if code, out := exchange(q.Get("code"), "grafana", "wrong", verifier); code != http.StatusUnauthorized || out.Error != "invalid_client" {
+		t.Fatalf("expect wrong secret to be rejected, got %v %+v", code, out)
+	}
+	if code, out := exchange(q.Get("code"), "grafana", secret, verifier); code != http.StatusOK || out.IDToken == "" {
+		t.Fatalf("failed to exchange code: %v %+v", code, out)
+	} else {
+		// The ID token is signed with the published keys, but is no
+		// login token.
+		claims := &idTokenClaims{}
+		_, err := jwt.ParseWithClaims(out.IDToken, claims, func(t *jwt.Token) (interface{}, error) {
+			var pub interface{}
+			err := keys.view(func(ring *keyRing) error {
+				key, err := ring.lookup(t.Header["kid"].(string)).key()
+				pub = key.Public()
+				return err
+			})
+			return pub, err
+		})
+		if err != nil {
+			t.Fatalf("invalid id token: %v", err)
+		}
+		if _, err := parseToken(out.IDToken); err == nil {
+			t.Fatalf("expect id token to be rejected as login token")
+		}
+		if claims.Issuer != rp.Origin || claims.Subject != "changkun" || claims.Audience != "grafana" ||
+			claims.Nonce != "n-0S6" || claims.AuthTime == 0 || claims.PreferredUsername != "changkun" {
+			t.Fatalf("unexpected id token claims: %+v", claims)
+		}
+
+		req := httptest.NewRequest("GET", "/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+out.AccessToken)
+		rr := httptest.NewRecorder()
+		userinfofunc(rr, req)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"sub":"changkun"`) {
+			t.Fatalf("unexpected userinfo: %v %s", rr.Code, rr.Body.String())
+		}
+	}
+	if code, out := exchange(q.Get("code"), "grafana", secret, verifier); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect used code to be rejected, got %v %+v", code, out)
+	}
+
+	// The code verifier must match the challenge.
+	q = location(authorize(params, token))
+	if code, out := exchange(q.Get("code"), "grafana", secret, strings.Repeat("x", 43)); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect wrong verifier to be rejected, got %v %+v", code, out)
+	}
+
+	// The access policy of the client applies.
+	if err := servicescmd([]string{"add", "grafana"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"users", "grafana", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if q := location(authorize(params, token)); q.Get("error") != "access_denied" || q.Get("code") != "" {
+		t.Fatalf("expect policy of the client to deny, got %v", q)
+	}
+	if err := servicescmd([]string{"remove", "grafana"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"add", "grafana.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"users", "grafana.example.com", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if q := location(authorize(params, token)); q.Get("error") != "access_denied" {
+		t.Fatalf("expect policy of the redirect host to deny, got %v", q)
+	}
+	if err := servicescmd([]string{"remove", "grafana.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users log in again if the client asks for it.
+	params.Set("prompt", "login")
+	rr = authorize(params, token)
+	if q := location(rr); rr.Code != http.StatusFound || q.Get("prompt") != "login" || strings.Contains(q.Get("redirect"), "prompt") {
+		t.Fatalf("expect login page, got %v %v", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = httptest.NewRecorder()
+	userinfofunc(rr, httptest.NewRequest("GET", "/userinfo", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect userinfo without token to be rejected, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,479 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"changkun.de/x/login/internal/webauthn"
+)
+
+// passkey is a WebAuthn credential of an account.
+type passkey struct {
+	ID        string    `json:"id"` // base64url credential ID
+	PublicKey []byte    `json:"public_key"`
+	SignCount uint32    `json:"sign_count"`
+	Name      string    `json:"name,omitempty"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+}
+
+// rp is the WebAuthn relying party, configured by LOGIN_ORIGIN.
+var rp = &webauthn.RelyingParty{
+	ID:     "login.changkun.de",
+	Name:   "Changkun Ou",
+	Origin: "https://login.changkun.de",
+}
+
+// loadOrigin configures the relying party from the public origin of
+// the login server, which is https://login.changkun.de by default.
+func loadOrigin() error {
+	origin := os.Getenv("LOGIN_ORIGIN")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid LOGIN_ORIGIN: %q", origin)
+	}
+	rp.ID = u.Hostname()
+	rp.Origin = u.Scheme + "://" + u.Host
+	return nil
+}
+
+var b64url = base64.RawURLEncoding
+
+// ceremonies are the pending WebAuthn ceremonies by challenge. They
+// are single use and expire after ceremonyTimeout.
+var ceremonies = struct {
+	sync.Mutex
+	m map[string]ceremony
+}{m: map[string]ceremony{}}
+
+const ceremonyTimeout = 5 * time.Minute
+
+type ceremony struct {
+	user     string // the user to register or log in, empty for any
+	register bool
+	expires  time.Time
+}
+
+// beginCeremony returns a new challenge for a ceremony of the user.
+func beginCeremony(user string, register bool) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	ceremonies.Lock()
+	defer ceremonies.Unlock()
+	now := time.Now()
+	for k, c := range ceremonies.m {
+		if now.After(c.expires) {
+			delete(ceremonies.m, k)
+		}
+	}
+	ceremonies.m[string(challenge)] = ceremony{user, register, now.Add(ceremonyTimeout)}
+	return challenge, nil
+}
+
+// finishCeremony looks up and removes the pending ceremony that the
+// given client data responds to.
+func finishCeremony(clientDataJSON []byte, register bool) ([]byte, *ceremony, error) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	ceremonies.Lock()
+	defer ceremonies.Unlock()
+	c, ok := ceremonies.m[string(challenge)]
+	delete(ceremonies.m, string(challenge))
+	if !ok || c.register != register || time.Now().After(c.expires) {
+		return nil, nil, errors.New("unknown or expired challenge")
+	}
+	return challenge, &c, nil
+}
+
+// passkeyRequest is the request body of the passkey endpoints. Binary
+// values are base64url encoded.
+type passkeyRequest struct {
+	Action            string `json:"action"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	Code              string `json:"code"`
+	Name              string `json:"name"`
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+	Redirect          string `json:"redirect"`
+}
+
+func readPasskeyRequest(r *http.Request) (*passkeyRequest, error) {
+	// Requiring JSON prevents cross-site form submissions.
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return nil, errors.New("unsupported request")
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	req := &passkeyRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse request body: %w", err)
+	}
+	return req, nil
+}
+
+// decodeFields decodes base64url values, with or without padding.
+func decodeFields(fields ...string) ([][]byte, error) {
+	out := make([][]byte, len(fields))
+	for i, f := range fields {
+		b, err := b64url.DecodeString(strings.TrimRight(f, "="))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode field: %w", err)
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+// writeJSON responds with v in JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// passkeyfunc manages the passkeys of the logged in user. The action
+// of the request is one of
+//
+//   - "begin": returns the options for navigator.credentials.create
+//     if the user confirms the password, and the TOTP code if the
+//     second factor is enabled;
+//   - "finish": registers the created credential under the given name;
+//   - "remove": removes the passkey with the given ID.
+//
+// As a passkey logs in with both factors, the session alone does not
+// suffice to register one.
+func passkeyfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		log.Println(err)
+	}()
+	req, err := readPasskeyRequest(r)
+	if err != nil {
+		return
+	}
+	claims, ok := session(r)
+	if !ok {
+		err = errUnauthorized
+		return
+	}
+	u := claims.user()
+
+	switch req.Action {
+	case "begin":
+		err = reauthenticate(r, u, req.Password, req.Code)
+		if err != nil {
+			return
+		}
+		handle, exclude := "", []map[string]string{}
+		err = updateUser(u, func(acc *account) error {
+			if acc.UserHandle == "" {
+				b := make([]byte, 16)
+				if _, err := rand.Read(b); err != nil {
+					return err
+				}
+				acc.UserHandle = b64url.EncodeToString(b)
+			}
+			handle = acc.UserHandle
+			for _, p := range acc.Passkeys {
+				exclude = append(exclude, map[string]string{"type": "public-key", "id": p.ID})
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		var challenge []byte
+		challenge, err = beginCeremony(u, true)
+		if err != nil {
+			return
+		}
+		var params []map[string]interface{}
+		for _, alg := range webauthn.Algorithms {
+			params = append(params, map[string]interface{}{"type": "public-key", "alg": alg})
+		}
+		writeJSON(w, map[string]interface{}{
+			"challenge":          b64url.EncodeToString(challenge),
+			"rp":                 map[string]string{"id": rp.ID, "name": rp.Name},
+			"user":               map[string]string{"id": handle, "name": u, "displayName": u},
+			"pubKeyCredParams":   params,
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "required",
+			},
+			"attestation": "none",
+			"timeout":     ceremonyTimeout.Milliseconds(),
+		})
+	case "finish":
+		var b [][]byte
+		b, err = decodeFields(req.ClientDataJSON, req.AttestationObject)
+		if err != nil {
+			return
+		}
+		var (
+			challenge []byte
+			c         *ceremony
+		)
+		challenge, c, err = finishCeremony(b[0], true)
+		if err != nil {
+			return
+		}
+		if c.user != u {
+			err = fmt.Errorf("%w: ceremony of another user", errUnauthorized)
+			return
+		}
+		var cred *webauthn.Credential
+		cred, err = rp.Register(challenge, b[0], b[1])
+		if err != nil {
+			return
+		}
+		id := b64url.EncodeToString(cred.ID)
+		if owner, _ := lookupPasskey(id); owner != nil {
+			err = errors.New("passkey is already registered")
+			return
+		}
+		err = updateUser(u, func(acc *account) error {
+			acc.Passkeys = append(acc.Passkeys, &passkey{
+				ID:        id,
+				PublicKey: cred.PublicKey,
+				SignCount: cred.SignCount,
+				Name:      req.Name,
+				Created:   time.Now().UTC(),
+			})
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		audit(r, "passkey_registered", u, id)
+		writeJSON(w, struct{}{})
+	case "remove":
+		err = updateUser(u, func(acc *account) error {
+			for i, p := range acc.Passkeys {
+				if p.ID == req.ID {
+					acc.Passkeys = append(acc.Passkeys[:i], acc.Passkeys[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("passkey %s does not exist", req.ID)
+		})
+		if err != nil {
+			return
+		}
+		audit(r, "passkey_removed", u, req.ID)
+		writeJSON(w, struct{}{})
+	default:
+		err = fmt.Errorf("unsupported action: %q", req.Action)
+	}
+}
+
+// reauthenticate checks the password of the given user, and the TOTP
+// code if the user enabled the second factor, before sensitive changes
+// to the account. Failures count like failed logins, so that a stolen
+// session cannot guess them.
+func reauthenticate(r *http.Request, u, password, code string) error {
+	ip := readIP(r)
+	if blocked(ip) {
+		return fmt.Errorf("%w: too much failure attempts", errUnauthorized)
+	}
+	acc, err := lookupUser(u)
+	if err != nil {
+		return err
+	}
+	if acc == nil || !check(u, password) || acc.TOTP != "" && !checkTOTP(u, code) {
+		recordFailure(ip)
+		audit(r, "reauth_failed", u, "")
+		return fmt.Errorf("%w: reauthentication of %s failed", errUnauthorized, u)
+	}
+	return nil
+}
+
+// lookupPasskey returns a copy of the account that owns the passkey
+// with the given ID, or nil if there is no such passkey.
+func lookupPasskey(id string) (*account, error) {
+	var acc *account
+	err := users.view(func(db *userDB) error {
+		for _, a := range db.Users {
+			for _, p := range a.Passkeys {
+				if p.ID == id {
+					cp := *a
+					acc = &cp
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return acc, err
+}
+
+// passkeyloginfunc logs in with a passkey. The action of the request is
+// one of
+//
+//   - "begin": returns the options for navigator.credentials.get. If a
+//     username is given, only its passkeys are allowed, otherwise the
+//     authenticator offers its discoverable credentials;
+//   - "finish": verifies the assertion and issues a login token like
+//     authfunc.
+func passkeyloginfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		var perr *policyError
+		switch {
+		case errors.As(err, &perr):
+			denyAccess(w, perr)
+		case errors.Is(err, errInvalidRedirect):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_redirect"}`))
+		case errors.Is(err, errUnauthorized) || errors.Is(err, webauthn.ErrInvalid):
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		log.Println(err)
+	}()
+	req, err := readPasskeyRequest(r)
+	if err != nil {
+		return
+	}
+
+	switch req.Action {
+	case "begin":
+		// Unknown users get an empty list, which does not reveal
+		// whether they exist.
+		allow := []map[string]string{}
+		if req.Username != "" {
+			var acc *account
+			acc, err = lookupUser(req.Username)
+			if err != nil {
+				return
+			}
+			if acc != nil {
+				for _, p := range acc.Passkeys {
+					allow = append(allow, map[string]string{"type": "public-key", "id": p.ID})
+				}
+			}
+		}
+		var challenge []byte
+		challenge, err = beginCeremony(req.Username, false)
+		if err != nil {
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"challenge":        b64url.EncodeToString(challenge),
+			"rpId":             rp.ID,
+			"allowCredentials": allow,
+			"userVerification": "required",
+			"timeout":          ceremonyTimeout.Milliseconds(),
+		})
+	case "finish":
+		var b [][]byte
+		b, err = decodeFields(req.ClientDataJSON, req.AuthenticatorData, req.Signature, req.UserHandle)
+		if err != nil {
+			return
+		}
+		var (
+			challenge []byte
+			c         *ceremony
+		)
+		challenge, c, err = finishCeremony(b[0], false)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", errUnauthorized, err)
+			return
+		}
+		id := strings.TrimRight(req.ID, "=")
+		var acc *account
+		acc, err = lookupPasskey(id)
+		if err != nil {
+			return
+		}
+		switch {
+		case acc == nil:
+			err = fmt.Errorf("%w: unknown passkey %s", errUnauthorized, id)
+		case c.user != "" && c.user != acc.Username:
+			err = fmt.Errorf("%w: passkey of another user", errUnauthorized)
+		case len(b[3]) > 0 && b64url.EncodeToString(b[3]) != acc.UserHandle:
+			err = fmt.Errorf("%w: user handle mismatch", errUnauthorized)
+		case acc.Disabled:
+			err = fmt.Errorf("%w: user %s is disabled", errUnauthorized, acc.Username)
+		}
+		if err != nil {
+			return
+		}
+
+		// Verify and update the signature counter atomically, so that
+		// a cloned authenticator cannot race the original.
+		err = updateUser(acc.Username, func(acc *account) error {
+			for _, p := range acc.Passkeys {
+				if p.ID != id {
+					continue
+				}
+				as, err := rp.Login(&webauthn.Credential{
+					PublicKey: p.PublicKey,
+					SignCount: p.SignCount,
+				}, challenge, b[0], b[1], b[2])
+				if err != nil {
+					return err
+				}
+				if !as.UserVerified {
+					return fmt.Errorf("%w: user not verified", webauthn.ErrInvalid)
+				}
+				p.SignCount, p.LastUsed = as.SignCount, time.Now().UTC()
+				return nil
+			}
+			return fmt.Errorf("%w: unknown passkey %s", errUnauthorized, id)
+		})
+		if err != nil {
+			return
+		}
+		err = issueLogin(w, r, acc.Username, []string{"hwk", "mfa"}, req.Redirect)
+	default:
+		err = fmt.Errorf("unsupported action: %q", req.Action)
+	}
+}
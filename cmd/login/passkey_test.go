@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"changkun.de/x/login/internal/webauthn"
+	"changkun.de/x/login/internal/webauthn/webauthntest"
+)
+
+func TestPasskey(t *testing.T) {
+	setupUser(t)
+	token, err := newToken("changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(h http.HandlerFunc, token string, body interface{}, out interface{}) int {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		if out != nil {
+			json.Unmarshal(rr.Body.Bytes(), out)
+		}
+		return rr.Code
+	}
+
+	// Register a passkey on the account page.
+	var opts struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	begin := map[string]string{"action": "begin", "password": "secret"}
+	if code := call(passkeyfunc, "", begin, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect registration to require a session, got %v", code)
+	}
+	if code := call(passkeyfunc, token, map[string]string{"action": "begin"}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect registration with only a session to be rejected, got %v", code)
+	}
+	if code := call(passkeyfunc, token, map[string]string{"action": "begin", "password": "wrong"}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect registration with a wrong password to be rejected, got %v", code)
+	}
+	if code := call(passkeyfunc, token, begin, &opts); code != http.StatusOK {
+		t.Fatalf("failed to begin registration: %v", code)
+	}
+	a := webauthntest.New(rp.ID, rp.Origin, webauthn.AlgES256)
+	challenge, _ := b64url.DecodeString(opts.Challenge)
+	handle, _ := b64url.DecodeString(opts.User.ID)
+	clientData, attestation := a.Create(challenge, handle)
+	code := call(passkeyfunc, token, map[string]string{
+		"action":            "finish",
+		"name":              "test",
+		"clientDataJSON":    b64url.EncodeToString(clientData),
+		"attestationObject": b64url.EncodeToString(attestation),
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("failed to register passkey: %v", code)
+	}
+
+	login := func(username string) (int, string) {
+		var opts struct {
+			Challenge string `json:"challenge"`
+		}
+		call(passkeyloginfunc, "", map[string]string{"action": "begin", "username": username}, &opts)
+		challenge, _ := b64url.DecodeString(opts.Challenge)
+		clientData, authData, sig := a.Get(challenge)
+		var out struct {
+			Token string `json:"token"`
+		}
+		code := call(passkeyloginfunc, "", map[string]string{
+			"action":            "finish",
+			"id":                b64url.EncodeToString(a.ID()),
+			"clientDataJSON":    b64url.EncodeToString(clientData),
+			"authenticatorData": b64url.EncodeToString(authData),
+			"signature":         b64url.EncodeToString(sig),
+			"userHandle":        b64url.EncodeToString(a.UserHandle()),
+		}, &out)
+		return code, out.Token
+	}
+
+	// Log in without password, with and without username.
+	for _, username := range []string{"changkun", ""} {
+		code, token := login(username)
+		if code != http.StatusOK {
+			t.Fatalf("%q: failed to log in with passkey: %v", username, code)
+		}
+		claims, err := parseToken(token)
+		if err != nil || claims.Subject != "changkun" || !claims.hasAMR("hwk") {
+			t.Fatalf("%q: unexpected token: %+v, %v", username, claims, err)
+		}
+	}
+	if code, _ := login("someone"); code != http.StatusUnauthorized {
+		t.Fatalf("expect passkey of another user to be rejected, got %v", code)
+	}
+
+	// A clone of the authenticator with an outdated counter is rejected.
+	a.SignCount = 1
+	if code, _ := login("changkun"); code != http.StatusUnauthorized {
+		t.Fatalf("expect outdated sign count to be rejected, got %v", code)
+	}
+	a.SignCount = 100
+
+	// Passkey logins count as second factor.
+	err = updateUser("changkun", func(acc *account) error {
+		acc.TOTP = "JBSWY3DPEHPK3PXP"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, token = login("")
+	if claims, err := parseToken(token); code != http.StatusOK || err != nil || !checkSession(claims) {
+		t.Fatalf("expect passkey login to satisfy 2FA, got %v, %v", code, err)
+	}
+
+	// With the second factor enabled, registration also requires a
+	// TOTP code.
+	if code := call(passkeyfunc, token, begin, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect registration without TOTP code to be rejected, got %v", code)
+	}
+	key, _ := b32.DecodeString("JBSWY3DPEHPK3PXP")
+	begin["code"] = totpCode(key, time.Now().Unix()/totpPeriod)
+	if code := call(passkeyfunc, token, begin, nil); code != http.StatusOK {
+		t.Fatalf("expect registration with TOTP code to begin, got %v", code)
+	}
+
+	// The account page lists the passkey, which can be removed.
+	req := httptest.NewRequest("GET", "/account", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	accountfunc(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "test, added") {
+		t.Fatalf("expect account page to list passkeys, got %v", rr.Code)
+	}
+	remove := map[string]string{"action": "remove", "id": b64url.EncodeToString(a.ID())}
+	if code := call(passkeyfunc, token, remove, nil); code != http.StatusOK {
+		t.Fatalf("failed to remove passkey: %v", code)
+	}
+	if code, _ := login(""); code != http.StatusUnauthorized {
+		t.Fatalf("expect removed passkey to be rejected, got %v", code)
+	}
+
+	// Guessing the password blocks the client, also for the right one.
+	wrong := map[string]string{"action": "begin", "password": "wrong", "code": begin["code"]}
+	for i := 0; i <= maxFailureAttempts; i++ {
+		call(passkeyfunc, token, wrong, nil)
+	}
+	begin["code"] = totpCode(key, time.Now().Unix()/totpPeriod+1)
+	if code := call(passkeyfunc, token, begin, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect blocked client to be rejected, got %v", code)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"changkun.de/x/login"
+	"changkun.de/x/login/internal/policy"
+)
+
+// The proxy mode protects services that cannot be modified and do not
+// sit behind a reverse proxy with forward authentication. It runs as
+// a separate process in front of the service, and authenticates the
+// requests with the Go SDK at the login server, whose /verify applies
+// the access policy of the service to the client, whose address the
+// SDK names. The paths of the service may have their own policies on
+// top.
+
+// identityHeaders are the headers that carry the identity of the user
+// to the upstream. Clients cannot set them.
+var identityHeaders = []string{"X-Auth-User", "X-Auth-Groups", "X-Auth-Roles", "X-Auth-Client"}
+
+// proxyRoute is the access policy of the paths under prefix.
+type proxyRoute struct {
+	prefix string
+	expr   *policy.Expr
+}
+
+// match reports whether the route applies to the given path. A prefix
+// matches itself and the paths below it.
+func (rt *proxyRoute) match(path string) bool {
+	return path == rt.prefix || strings.HasPrefix(path, strings.TrimSuffix(rt.prefix, "/")+"/")
+}
+
+// proxyRoutes are the -route flags of the proxy command.
+type proxyRoutes []*proxyRoute
+
+func (rs *proxyRoutes) String() string { return "" }
+
+func (rs *proxyRoutes) Set(v string) error {
+	prefix, src, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid route %q, want <path>=<expression>", v)
+	}
+	e, err := policy.Compile(src)
+	if err != nil {
+		return fmt.Errorf("invalid expression of %s: %w", prefix, err)
+	}
+	*rs = append(*rs, &proxyRoute{prefix, e})
+	return nil
+}
+
+// proxy is an authenticating reverse proxy.
+type proxy struct {
+	client  *login.Client
+	service string
+	routes  proxyRoutes // longest prefix first
+	rp      *httputil.ReverseProxy
+}
+
+// newProxy returns a reverse proxy to the given upstream, which
+// authenticates requests with the given client. The service is the ID
+// of the upstream at the login server, and the routes are the access
+// policies of its paths.
+func newProxy(upstream string, client *login.Client, service string, routes proxyRoutes) (http.Handler, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream: %q", upstream)
+	}
+	p := &proxy{
+		client:  client,
+		service: service,
+		routes:  append(proxyRoutes(nil), routes...),
+		rp:      httputil.NewSingleHostReverseProxy(u),
+	}
+	sort.SliceStable(p.routes, func(i, j int) bool { return len(p.routes[i].prefix) > len(p.routes[j].prefix) })
+	director := p.rp.Director
+	p.rp.Director = func(r *http.Request) {
+		director(r)
+		stripCredentials(r)
+		id, ok := login.IdentityFromContext(r.Context())
+		if !ok {
+			return
+		}
+		if id.ClientID != "" {
+			r.Header.Set("X-Auth-Client", id.ClientID)
+		} else {
+			r.Header.Set("X-Auth-User", id.Username)
+		}
+		r.Header.Set("X-Auth-Groups", strings.Join(id.Groups, ","))
+		r.Header.Set("X-Auth-Roles", strings.Join(id.Roles, ","))
+	}
+	return client.RequireAuth(p), nil
+}
+
+// ServeHTTP applies the policy of the route of an authenticated
+// request and forwards it to the upstream.
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, _ := login.IdentityFromContext(r.Context())
+	for _, rt := range p.routes {
+		if !rt.match(r.URL.Path) {
+			continue
+		}
+		in := &policy.Input{
+			User:    id.Username,
+			Roles:   id.Roles,
+			Groups:  id.Groups,
+			AMR:     id.AMR,
+			IP:      remoteIP(r),
+			Service: p.service,
+			Time:    time.Now().In(policyLocation),
+		}
+		if in.Service == "" {
+			in.Service = r.Host
+		}
+		if !rt.expr.Eval(in) {
+			log.Printf("access to %s denied for %s by the policy of %s", r.URL.Path, id.Subject, rt.prefix)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		break
+	}
+	p.rp.ServeHTTP(w, r)
+}
+
+// stripCredentials removes the login of the user and the identity
+// headers sent by the client from a request to the upstream, which
+// must not see the token.
+func stripCredentials(r *http.Request) {
+	q := r.URL.Query()
+	if q.Has("code") || q.Has("token") {
+		r.URL.RawQuery = stripLogin(q).Encode()
+	}
+	if bearerToken(r) != "" {
+		r.Header.Del("Authorization")
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != "auth" && c.Name != "auth_refresh" {
+			r.AddCookie(c)
+		}
+	}
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+}
+
+// remoteIP returns the address of the client. The proxy faces the
+// clients itself, so unlike readIP it ignores the forwarding headers,
+// which clients could forge.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// proxycmd runs the authenticating reverse proxy in front of the
+// upstream given by args.
+func proxycmd(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := fs.String("listen", ":8081", "address to listen on")
+	base := fs.String("login", "", "base URL of the login server, defaults to LOGIN_ORIGIN")
+	service := fs.String("service", "", "ID of the upstream at the login server, whose access policy applies")
+	domain := fs.String("cookie-domain", "", "domain of the auth cookie, empty for the host of the request")
+	var routes proxyRoutes
+	fs.Var(&routes, "route", "access policy of a path as <path>=<expression>, repeatable")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return flag.ErrHelp
+	}
+	if err := loadTimeZone(); err != nil {
+		return err
+	}
+	if *base == "" {
+		if err := loadOrigin(); err != nil {
+			return err
+		}
+		*base = rp.Origin
+	}
+
+	client := login.NewClient(
+		login.WithBaseURL(*base),
+		login.WithAudience(*service),
+		login.WithCookieDomain(*domain),
+		login.WithUserAgent("changkun.de/x/login proxy"),
+	)
+	h, err := newProxy(fs.Arg(0), client, *service, routes)
+	if err != nil {
+		return err
+	}
+	log.Printf("proxying %s to %s...", *listen, fs.Arg(0))
+	return http.ListenAndServe(*listen, logging(h))
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"changkun.de/x/login"
+)
+
+func TestProxy(t *testing.T) {
+	token, _ := setupSession(t)
+	if err := userscmd([]string{"groups", "changkun", "family"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/verify", verifyfunc)
+	mux.HandleFunc("/exchange", exchangefunc)
+	mux.HandleFunc("/token", tokenfunc)
+	loginServer := httptest.NewServer(mux)
+	t.Cleanup(loginServer.Close)
+
+	// The upstream echoes what it sees, and echoes the bytes of
+	// upgraded connections.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			buf.Flush()
+			line, _ := buf.ReadString('\n')
+			conn.Write([]byte(line))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"user":   r.Header.Get("X-Auth-User"),
+			"groups": r.Header.Get("X-Auth-Groups"),
+			"query":  r.URL.RawQuery,
+			"cookie": r.Header.Get("Cookie"),
+			"auth":   r.Header.Get("Authorization"),
+		})
+	}))
+	t.Cleanup(upstream.Close)
+
+	var routes proxyRoutes
+	if err := routes.Set(`/admin="admin" in roles`); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.Set(`/admin/`); err == nil {
+		t.Fatal("expect route without expression to be rejected")
+	}
+	client := login.NewClient(login.WithBaseURL(loginServer.URL), login.WithCookieDomain(""))
+	h, err := newProxy(upstream.URL, client, "", routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := httptest.NewServer(h)
+	t.Cleanup(ps.Close)
+
+	hc := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path string, header http.Header) (*http.Response, map[string]string) {
+		req, _ := http.NewRequest(method, ps.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+
+	// Unauthenticated browsers log in, other requests are rejected.
+	resp, _ := do("GET", "/page", http.Header{"Accept": {"text/html"}})
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), loginServer.URL+"/?redirect=") {
+		t.Fatalf("expect redirect to login, got %v %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ := do("GET", "/page", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect unauthorized, got %v", resp.StatusCode)
+	}
+
+	// The upstream sees the identity but not the credentials, and
+	// clients cannot forge the identity.
+	resp, out := do("GET", "/page", http.Header{
+		"Cookie":      {"auth=" + token + "; theme=dark"},
+		"X-Auth-User": {"alice"},
+	})
+	if resp.StatusCode != http.StatusOK || out["user"] != "changkun" || out["groups"] != "family" ||
+		out["cookie"] != "theme=dark" {
+		t.Fatalf("unexpected upstream request: %v %v", resp.StatusCode, out)
+	}
+	resp, out = do("POST", "/form?x=1&token="+token, nil)
+	if resp.StatusCode != http.StatusOK || out["query"] != "x=1" || out["user"] != "changkun" {
+		t.Fatalf("expect token to be stripped, got %v %v", resp.StatusCode, out)
+	}
+	resp, out = do("GET", "/api", http.Header{"Authorization": {"Bearer " + token}})
+	if resp.StatusCode != http.StatusOK || out["auth"] != "" {
+		t.Fatalf("expect bearer token to be stripped, got %v %v", resp.StatusCode, out)
+	}
+
+	// Routes have their own policies.
+	cookie := http.Header{"Cookie": {"auth=" + token}}
+	if resp, _ := do("GET", "/admin/users", cookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expect admin route to be forbidden, got %v", resp.StatusCode)
+	}
+	if resp, _ := do("GET", "/administrator", cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect other paths to be unaffected, got %v", resp.StatusCode)
+	}
+	if err := userscmd([]string{"roles", "changkun", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := do("GET", "/admin/users", cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect admin to be allowed, got %v", resp.StatusCode)
+	}
+
+	// WebSocket connections pass through, also with the token in the
+	// query.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ps.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws?token=%s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n",
+		token, strings.TrimPrefix(ps.URL, "http://"))
+	br := bufio.NewReader(conn)
+	wsResp, err := http.ReadResponse(br, nil)
+	if err != nil || wsResp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expect switching protocols, got %v, %v", wsResp, err)
+	}
+	fmt.Fprint(conn, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF || line != "ping\n" {
+		t.Fatalf("expect echo through the proxy, got %q, %v", line, err)
+	}
+}
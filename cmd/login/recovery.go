@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// numRecoveryCodes is the number of recovery codes of an account.
+const numRecoveryCodes = 10
+
+// newRecoveryCodes returns new recovery codes and their hashes. The
+// codes have 80 bits of entropy, e.g. "abcd-efgh-ijkl-mnop", which is
+// too much to guess their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < numRecoveryCodes; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(b))
+		code := s[:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of the given recovery code, ignoring
+// case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// checkRecoveryCode checks the code against the recovery codes of the
+// given user and consumes it.
+func checkRecoveryCode(r *http.Request, u, code string) bool {
+	h := hashRecoveryCode(code)
+	remaining := 0
+	err := updateUser(u, func(acc *account) error {
+		for i, c := range acc.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(c), []byte(h)) == 1 {
+				acc.RecoveryCodes = append(acc.RecoveryCodes[:i], acc.RecoveryCodes[i+1:]...)
+				remaining = len(acc.RecoveryCodes)
+				return nil
+			}
+		}
+		return errUnauthorized
+	})
+	if err != nil {
+		return false
+	}
+	audit(r, "recovery_code_used", u, fmt.Sprintf("%d remaining", remaining))
+	return true
+}
+
+// resetRecoveryCodes replaces the recovery codes of the given user and
+// returns the new codes.
+func resetRecoveryCodes(r *http.Request, u string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = updateUser(u, func(acc *account) error {
+		acc.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	audit(r, "recovery_codes_generated", u, "")
+	return codes, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	setupUser(t)
+	token, err := newToken("changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(token, body string, out interface{}) int {
+		req := httptest.NewRequest("POST", "/account/totp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		totpfunc(rr, req)
+		json.Unmarshal(rr.Body.Bytes(), out)
+		return rr.Code
+	}
+	login := func(otp string) int {
+		body := `{"username":"changkun","password":"secret","otp":"` + otp + `"}`
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.2:1234"
+		rr := httptest.NewRecorder()
+		authfunc(rr, req)
+		return rr.Code
+	}
+
+	// Recovery codes are issued when the second factor is enabled.
+	var enroll struct {
+		Secret string `json:"secret"`
+	}
+	call(token, `{"action":"enroll"}`, &enroll)
+	key, _ := b32.DecodeString(enroll.Secret)
+	var confirm struct {
+		Token         string   `json:"token"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	code := call(token, `{"action":"confirm","code":"`+totpCode(key, time.Now().Unix()/totpPeriod)+`"}`, &confirm)
+	if code != http.StatusOK || len(confirm.RecoveryCodes) != numRecoveryCodes {
+		t.Fatalf("expect recovery codes on confirmation, got %v: %v", code, confirm.RecoveryCodes)
+	}
+	acc, _ := lookupUser("changkun")
+	for _, h := range acc.RecoveryCodes {
+		for _, c := range confirm.RecoveryCodes {
+			if strings.Contains(h, strings.ReplaceAll(c, "-", "")) {
+				t.Fatalf("expect recovery codes to be stored hashed")
+			}
+		}
+	}
+
+	// Each code replaces the TOTP code once.
+	first := confirm.RecoveryCodes[0]
+	if code := login(strings.ToUpper(first)); code != http.StatusOK {
+		t.Fatalf("expect login with recovery code to succeed, got %v", code)
+	}
+	if code := login(first); code != http.StatusUnauthorized {
+		t.Fatalf("expect used recovery code to be rejected, got %v", code)
+	}
+	b, err := os.ReadFile(dataPath("audit.log"))
+	if err != nil || !strings.Contains(string(b), `"event":"recovery_code_used","user":"changkun"`) ||
+		!strings.Contains(string(b), `9 remaining`) {
+		t.Fatalf("expect the used recovery code in the audit trail, got %s, %v", b, err)
+	}
+
+	// New codes replace the old ones.
+	var regen struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if code := call(confirm.Token, `{"action":"recovery"}`, &regen); code != http.StatusBadRequest || len(regen.RecoveryCodes) != 0 {
+		t.Fatalf("expect new recovery codes to require a TOTP code, got %v", code)
+	}
+	next := totpCode(key, time.Now().Unix()/totpPeriod+1)
+	if code := call(confirm.Token, `{"action":"recovery","code":"`+next+`"}`, &regen); code != http.StatusOK || len(regen.RecoveryCodes) != numRecoveryCodes {
+		t.Fatalf("failed to generate new recovery codes: %v", code)
+	}
+	if code := login(confirm.RecoveryCodes[1]); code != http.StatusUnauthorized {
+		t.Fatalf("expect replaced recovery code to be rejected, got %v", code)
+	}
+	if code := login(regen.RecoveryCodes[1]); code != http.StatusOK {
+		t.Fatalf("expect new recovery code to be accepted, got %v", code)
+	}
+
+	// Guessing TOTP codes blocks the client.
+	for i := 0; i <= maxFailureAttempts; i++ {
+		call(confirm.Token, `{"action":"recovery","code":"x00000"}`, nil)
+	}
+	if code := call(confirm.Token, `{"action":"recovery","code":"`+next+`"}`, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expect blocked client to be rejected, got %v", code)
+	}
+}
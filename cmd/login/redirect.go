@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// errInvalidRedirect is returned for redirect addresses that are not
+// allowed, as they would receive the token of the user.
+var errInvalidRedirect = errors.New("redirect not allowed")
+
+// redirectAllowlist are the patterns of the allowed redirect addresses,
+// see matchRedirect. Only changkun.de and its subdomains are allowed by
+// default.
+var redirectAllowlist = []string{"changkun.de", "*.changkun.de"}
+
+// loadRedirectAllowlist loads the allowlist of redirect addresses from
+// LOGIN_REDIRECT_ALLOWLIST, a comma separated list of patterns.
+func loadRedirectAllowlist() error {
+	s := os.Getenv("LOGIN_REDIRECT_ALLOWLIST")
+	if s == "" {
+		return nil
+	}
+	var list []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		host := p
+		if i := strings.Index(p, "://"); i >= 0 {
+			host = p[i+3:]
+		}
+		if host == "" || strings.ContainsAny(host, "/?#@") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("invalid LOGIN_REDIRECT_ALLOWLIST pattern: %q", p)
+		}
+		list = append(list, p)
+	}
+	redirectAllowlist = list
+	return nil
+}
+
+// checkRedirect returns an error unless the given redirect address is
+// allowed. Allowed are paths on the login server, addresses that match
+// the allowlist, and the redirect URIs of registered clients.
+func checkRedirect(redirect string) error {
+	u, err := url.Parse(redirect)
+	if err != nil || u.User != nil || strings.Contains(redirect, `\`) {
+		return fmt.Errorf("%w: %q", errInvalidRedirect, redirect)
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(redirect, "//") {
+		return nil
+	}
+	if u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("%w: %q", errInvalidRedirect, redirect)
+	}
+	for _, p := range redirectAllowlist {
+		if matchRedirect(p, u) {
+			return nil
+		}
+	}
+
+	list, err := listClients()
+	if err != nil {
+		log.Printf("failed to load clients: %v", err)
+	}
+	for _, c := range list {
+		if c.matchRedirectURI(u) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", errInvalidRedirect, redirect)
+}
+
+// matchRedirect reports whether the pattern matches u. A pattern is a
+// host such as "changkun.de", which matches https addresses of exactly
+// that host, or "*.changkun.de", which matches its subdomains. Patterns
+// with a scheme such as "http://localhost:8080" match that scheme and
+// host, and the port if the pattern has one.
+func matchRedirect(pattern string, u *url.URL) bool {
+	scheme, host := "https", pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		scheme, host = pattern[:i], pattern[i+3:]
+	}
+	if u.Scheme != scheme {
+		return false
+	}
+	got := u.Hostname()
+	if strings.Contains(host, ":") {
+		got = u.Host
+	}
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(got, host[1:]) && len(got) > len(host)-1
+	}
+	return got == host
+}
+
+// redirectError shows the error page for a redirect address that is
+// not allowed.
+func redirectError(w http.ResponseWriter, redirect string) {
+	showError(w, http.StatusBadRequest, "Invalid redirect",
+		fmt.Sprintf("The login page was opened with a redirect to %s, which is not allowed. If you followed a link, it may try to steal your login.", redirect))
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckRedirect(t *testing.T) {
+	setupData(t)
+	t.Setenv("LOGIN_REDIRECT_ALLOWLIST", "changkun.de, *.changkun.de, http://localhost:8080")
+	list := redirectAllowlist
+	t.Cleanup(func() { redirectAllowlist = list })
+	if err := loadRedirectAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientscmd([]string{"add", "blog", "https://blog.example.com/callback"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for redirect, allowed := range map[string]bool{
+		"/account":                                  true,
+		"https://changkun.de":                       true,
+		"https://changkun.de/x?a=b":                 true,
+		"https://www.changkun.de/":                  true,
+		"https://a.b.changkun.de/":                  true,
+		"http://localhost:8080/":                    true,
+		"https://blog.example.com/callback?state=1": true,
+		"http://changkun.de":                        false,
+		"https://evilchangkun.de":                   false,
+		"https://changkun.de.evil.com":              false,
+		"https://changkun.de@evil.com":              false,
+		"https://user@changkun.de":                  false,
+		"http://localhost:9090/":                    false,
+		"https://blog.example.com/other":            false,
+		"//evil.com":                                false,
+		`/\evil.com`:                                false,
+		"javascript:alert(1)":                       false,
+		"account":                                   false,
+	} {
+		if err := checkRedirect(redirect); (err == nil) != allowed {
+			t.Errorf("checkRedirect(%q) = %v, want allowed %v", redirect, err, allowed)
+		}
+	}
+
+	t.Setenv("LOGIN_REDIRECT_ALLOWLIST", "https://changkun.de/path")
+	if err := loadRedirectAllowlist(); err == nil {
+		t.Errorf("expect invalid pattern to be rejected")
+	}
+}
+
+func TestRedirectRejected(t *testing.T) {
+	token, _ := setupSession(t)
+
+	// The fast path does not hand out the token to unknown sites.
+	req := httptest.NewRequest("GET", "/?redirect="+url.QueryEscape("https://evil.com/"), nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: token})
+	rr := httptest.NewRecorder()
+	homefunc(rr, req)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" || !strings.Contains(rr.Body.String(), "not allowed") {
+		t.Fatalf("expect error page, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// Neither does the login.
+	req = httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret","redirect":"https://evil.com/"}`))
+	rr = httptest.NewRecorder()
+	authfunc(rr, req)
+	if rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), "token") || !strings.Contains(rr.Body.String(), "invalid_redirect") {
+		t.Fatalf("expect invalid redirect, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if list, _ := listSessions("changkun"); len(list) != 1 {
+		t.Fatalf("expect no session for rejected login, got %d", len(list))
+	}
+}
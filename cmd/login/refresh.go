@@ -0,0 +1,405 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"changkun.de/x/login/internal/uuid"
+)
+
+const (
+	// accessTokenLifetime is the lifetime of the JWTs issued at login.
+	// They are renewed with refresh tokens, which live as long as the
+	// login session.
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 60 * 24 * time.Hour
+
+	// refreshGrace is how long a rotated refresh token can still be
+	// used, for concurrent requests that refresh at the same time.
+	// Such late uses only get a new access token.
+	refreshGrace = 30 * time.Second
+)
+
+// refreshToken is a stored refresh token. Every use rotates it to a
+// new token of the same family, and using a rotated token again means
+// that it was stolen, which revokes the whole family. The family is the
+// ID of the login session.
+type refreshToken struct {
+	User    string    `json:"user"`
+	Family  string    `json:"family"`
+	AMR     []string  `json:"amr,omitempty"`
+	Epoch   int       `json:"epoch,omitempty"`
+	Expires time.Time `json:"expires"` // end of the login session
+	Rotated time.Time `json:"rotated,omitempty"`
+}
+
+// refreshDB is the refresh token store, keyed by token hash.
+type refreshDB struct {
+	Tokens map[string]*refreshToken `json:"tokens"`
+}
+
+// refreshTokens is the refresh token store of the server.
+var refreshTokens *jsonFile[refreshDB]
+
+// openRefreshTokens opens the refresh token store in the data directory.
+func openRefreshTokens() { refreshTokens = newJSONFile[refreshDB](dataPath("refresh.json")) }
+
+func hashRefreshToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// add stores the given refresh token and returns its value.
+func (db *refreshDB) add(rt refreshToken) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := b64url.EncodeToString(b)
+	if db.Tokens == nil {
+		db.Tokens = map[string]*refreshToken{}
+	}
+	db.Tokens[hashRefreshToken(token)] = &rt
+	return token, nil
+}
+
+// prune removes the tokens of expired sessions.
+func (db *refreshDB) prune(now time.Time) {
+	for h, rt := range db.Tokens {
+		if now.After(rt.Expires) {
+			delete(db.Tokens, h)
+		}
+	}
+}
+
+// startSession starts a new login session of the user, who
+// authenticated with the given methods in request r, see newSession,
+// and sets the cookies of its tokens.
+func startSession(w http.ResponseWriter, r *http.Request, u string, amr []string) (access, refresh string, err error) {
+	access, refresh, err = newSession(r, u, amr)
+	if err != nil {
+		return "", "", err
+	}
+	setAuthCookie(w, access)
+	setRefreshCookie(w, refresh)
+	return access, refresh, nil
+}
+
+// newSession starts a new login session of the user from request r.
+// It issues an access token and the refresh token of a new token
+// family, which is identified by the session ID.
+func newSession(r *http.Request, u string, amr []string) (access, refresh string, err error) {
+	epoch, err := userEpoch(u)
+	if err != nil {
+		return "", "", err
+	}
+	sid := uuid.Must(uuid.NewShort())
+	access, jti, err := newSessionToken(u, "", amr, epoch, sid)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now().UTC()
+	err = refreshTokens.update(func(db *refreshDB) error {
+		db.prune(now)
+		refresh, err = db.add(refreshToken{
+			User:    u,
+			Family:  sid,
+			AMR:     amr,
+			Epoch:   epoch,
+			Expires: now.Add(refreshTokenLifetime),
+		})
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	err = createSession(&loginSession{
+		ID:        sid,
+		User:      u,
+		TokenID:   jti,
+		Tokens:    map[string]int64{jti: now.Add(accessTokenLifetime).Unix()},
+		IP:        readIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(refreshTokenLifetime),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// rotateRefreshToken consumes the given refresh token and returns its
+// session and the next refresh token. The next token is empty if a
+// concurrent request already rotated the token.
+func rotateRefreshToken(r *http.Request, token string) (rt *refreshToken, next string, err error) {
+	h := hashRefreshToken(token)
+	var reused *refreshToken
+	err = refreshTokens.update(func(db *refreshDB) error {
+		now := time.Now().UTC()
+		db.prune(now)
+		cur, ok := db.Tokens[h]
+		switch {
+		case !ok:
+			return fmt.Errorf("%w: unknown refresh token", errUnauthorized)
+		case !cur.Rotated.IsZero() && now.Sub(cur.Rotated) <= refreshGrace:
+			rt = cur
+			return nil
+		case !cur.Rotated.IsZero():
+			reused = cur
+			return nil
+		}
+		cur.Rotated = now
+		rt = cur
+		var err error
+		next, err = db.add(refreshToken{
+			User:    cur.User,
+			Family:  cur.Family,
+			AMR:     cur.AMR,
+			Epoch:   cur.Epoch,
+			Expires: cur.Expires,
+		})
+		return err
+	})
+	if reused != nil {
+		if err := endSession(reused.Family); err != nil {
+			log.Printf("failed to end session %s: %v", reused.Family, err)
+		}
+		audit(r, "refresh_token_reuse", reused.User, "session "+reused.Family+" ended")
+		return nil, "", fmt.Errorf("%w: refresh token reused", errUnauthorized)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Sessions of disabled users, of an earlier epoch and sessions that
+	// lack a second factor that was enabled since do not get new tokens.
+	claims := &tokenClaims{Version: tokenVersion, AMR: rt.AMR, Epoch: rt.Epoch, SID: rt.Family}
+	claims.Subject = rt.User
+	if !checkSession(claims) {
+		return nil, "", fmt.Errorf("%w: invalid session of %s", errUnauthorized, rt.User)
+	}
+	return rt, next, nil
+}
+
+// revokeRefreshToken ends the session of the given refresh token.
+func revokeRefreshToken(token string) error {
+	var sid string
+	err := refreshTokens.view(func(db *refreshDB) error {
+		if cur, ok := db.Tokens[hashRefreshToken(token)]; ok {
+			sid = cur.Family
+		}
+		return nil
+	})
+	if err != nil || sid == "" {
+		return err
+	}
+	return endSession(sid)
+}
+
+// revokeFamily removes all refresh tokens of the given family.
+func (db *refreshDB) revokeFamily(family string) {
+	for h, t := range db.Tokens {
+		if t.Family == family {
+			delete(db.Tokens, h)
+		}
+	}
+}
+
+// refresh renews the session of the given refresh token, sets the
+// cookies and returns the new tokens.
+func refresh(w http.ResponseWriter, r *http.Request, token string) (access, next string, err error) {
+	rt, next, err := rotateRefreshToken(r, token)
+	if err != nil {
+		return "", "", err
+	}
+	access, jti, err := newSessionToken(rt.User, "", rt.AMR, rt.Epoch, rt.Family)
+	if err != nil {
+		return "", "", err
+	}
+	addSessionToken(rt.Family, jti)
+	setAuthCookie(w, access)
+	if next != "" {
+		setRefreshCookie(w, next)
+	}
+	return access, next, nil
+}
+
+// setRefreshCookie sets the refresh token cookie that is shared across
+// changkun.de. Scripts cannot read it.
+func setRefreshCookie(w http.ResponseWriter, token string) {
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth_refresh=%s; Domain=changkun.de; Path=/; Max-Age=%d; HttpOnly; Secure; SameSite=Lax",
+		token, int(refreshTokenLifetime/time.Second)))
+}
+
+// allowedOrigin reports whether scripts of the given origin may call
+// the login server with credentials, which is the case for the sites
+// of changkun.de.
+func allowedOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := u.Hostname()
+	return host == "changkun.de" || strings.HasSuffix(host, ".changkun.de")
+}
+
+// allowCORS allows scripts of the sites of changkun.de to POST to the
+// login server with credentials, and reports whether the request came
+// from such a site.
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !allowedOrigin(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Vary", "Origin")
+	return true
+}
+
+// tokenRequest is a request to the token endpoint, which is sent as
+// form or as JSON body.
+type tokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	RefreshToken string `json:"refresh_token"`
+
+	// The authorization code grant of OpenID Connect clients.
+	Code         string `json:"code"`
+	RedirectURI  string `json:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+
+	// The client credentials grant of machine clients.
+	Audience string `json:"audience"`
+
+	// The device authorization grant, see device.go.
+	DeviceCode string `json:"device_code"`
+}
+
+// tokenfunc is the token endpoint. It renews an access token with a
+// refresh token, which is rotated. The refresh token is read from the
+// refresh_token parameter of the form or JSON body with
+// grant_type=refresh_token, or from the refresh cookie. Clients
+// exchange authorization codes with grant_type=authorization_code,
+// machine clients get service tokens with
+// grant_type=client_credentials, and devices poll for their login
+// with the device code grant.
+func tokenfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if allowCORS(w, r) && r.Method == http.MethodOptions {
+		return
+	}
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		code, status := "invalid_request", http.StatusBadRequest
+		var oerr oauthError
+		switch {
+		case errors.As(err, &oerr):
+			code = string(oerr)
+		case errors.Is(err, errInvalidClient):
+			code, status = "invalid_client", http.StatusUnauthorized
+			w.Header().Set("WWW-Authenticate", `Basic realm="login"`)
+		case errors.Is(err, errUnauthorized):
+			code = "invalid_grant"
+		}
+		b, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{code})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(b)
+		log.Println(err)
+	}()
+	if r.Method != http.MethodPost {
+		err = errors.New("unsupported method")
+		return
+	}
+
+	var req tokenRequest
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		var b []byte
+		b, err = io.ReadAll(r.Body)
+		if err != nil {
+			err = fmt.Errorf("failed to read request body: %w", err)
+			return
+		}
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			err = fmt.Errorf("failed to parse request body: %w", err)
+			return
+		}
+	} else {
+		req = tokenRequest{
+			GrantType:    r.PostFormValue("grant_type"),
+			RefreshToken: r.PostFormValue("refresh_token"),
+			Code:         r.PostFormValue("code"),
+			RedirectURI:  r.PostFormValue("redirect_uri"),
+			CodeVerifier: r.PostFormValue("code_verifier"),
+			ClientID:     r.PostFormValue("client_id"),
+			ClientSecret: r.PostFormValue("client_secret"),
+			Audience:     r.PostFormValue("audience"),
+			DeviceCode:   r.PostFormValue("device_code"),
+		}
+	}
+	if req.GrantType == "" && req.RefreshToken == "" {
+		req.GrantType = "refresh_token" // from the cookie
+		if c, err := r.Cookie("auth_refresh"); err == nil {
+			req.RefreshToken = c.Value
+		}
+	}
+
+	switch req.GrantType {
+	case "refresh_token":
+		err = refreshTokenGrant(w, r, &req)
+	case "authorization_code":
+		err = authorizationCodeGrant(w, r, &req)
+	case "client_credentials":
+		err = clientCredentialsGrant(w, r, &req)
+	case deviceGrantType:
+		err = deviceCodeGrant(w, r, &req)
+	default:
+		err = fmt.Errorf("unsupported grant type: %q", req.GrantType)
+	}
+}
+
+// refreshTokenGrant renews the access token of a refresh token.
+func refreshTokenGrant(w http.ResponseWriter, r *http.Request, req *tokenRequest) error {
+	if req.RefreshToken == "" {
+		return fmt.Errorf("%w: missing refresh token", errUnauthorized)
+	}
+	access, next, err := refresh(w, r, req.RefreshToken)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}{access, "Bearer", int(accessTokenLifetime / time.Second), next})
+	return nil
+}
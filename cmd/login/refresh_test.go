@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshToken(t *testing.T) {
+	setupUser(t)
+
+	req := httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret"}`))
+	rr := httptest.NewRecorder()
+	authfunc(rr, req)
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &login)
+	if rr.Code != http.StatusOK || login.RefreshToken == "" {
+		t.Fatalf("expect a refresh token at login, got %v", rr.Code)
+	}
+	if claims, err := parseToken(login.Token); err != nil || claims.ExpiresAt > time.Now().Add(accessTokenLifetime).Unix() {
+		t.Fatalf("expect a short-lived access token, got %+v, %v", claims, err)
+	}
+
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	call := func(body string, cookie string) (int, tokens) {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "auth_refresh", Value: cookie})
+		}
+		rr := httptest.NewRecorder()
+		tokenfunc(rr, req)
+		var out tokens
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+	grant := func(token string) string {
+		return url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}.Encode()
+	}
+
+	// Each use rotates the refresh token.
+	code, first := call(grant(login.RefreshToken), "")
+	if code != http.StatusOK || first.RefreshToken == "" || first.RefreshToken == login.RefreshToken {
+		t.Fatalf("failed to refresh: %v, %+v", code, first)
+	}
+	if claims, err := parseToken(first.AccessToken); err != nil || claims.Subject != "changkun" || !claims.hasAMR("pwd") {
+		t.Fatalf("unexpected access token: %+v, %v", claims, err)
+	}
+
+	// Concurrent uses of the old token get access tokens only.
+	code, late := call(grant(login.RefreshToken), "")
+	if code != http.StatusOK || late.AccessToken == "" || late.RefreshToken != "" {
+		t.Fatalf("expect grace period for rotated token, got %v, %+v", code, late)
+	}
+
+	// The refresh cookie works as well.
+	code, second := call("", first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" {
+		t.Fatalf("failed to refresh with cookie: %v, %+v", code, second)
+	}
+
+	// Reuse of a rotated token after the grace period revokes the family.
+	err := refreshTokens.update(func(db *refreshDB) error {
+		db.Tokens[hashRefreshToken(login.RefreshToken)].Rotated = time.Now().Add(-time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, out := call(grant(login.RefreshToken), ""); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect reused token to be rejected, got %v, %+v", code, out)
+	}
+	if code, _ := call(grant(second.RefreshToken), ""); code != http.StatusBadRequest {
+		t.Fatalf("expect token family to be revoked, got %v", code)
+	}
+	b, err := os.ReadFile(dataPath("audit.log"))
+	if err != nil || !strings.Contains(string(b), `"event":"refresh_token_reuse","user":"changkun"`) {
+		t.Fatalf("expect the reuse in the audit trail, got %s, %v", b, err)
+	}
+	if code, out := call(grant("unknown"), ""); code != http.StatusBadRequest || out.Error != "invalid_grant" {
+		t.Fatalf("expect unknown token to be rejected, got %v, %+v", code, out)
+	}
+	if code, out := call("grant_type=password", ""); code != http.StatusBadRequest || out.Error != "invalid_request" {
+		t.Fatalf("expect unsupported grant to be rejected, got %v, %+v", code, out)
+	}
+}
+
+func TestHomeRefresh(t *testing.T) {
+	_, refresh := setupSession(t)
+
+	// An expired access token is renewed with the refresh cookie.
+	req := httptest.NewRequest("GET", "/?redirect=https://example.changkun.de/", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: "expired"})
+	req.AddCookie(&http.Cookie{Name: "auth_refresh", Value: refresh})
+	rr := httptest.NewRecorder()
+	homefunc(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expect redirect with renewed session, got %v", rr.Code)
+	}
+	u, _ := url.Parse(rr.Header().Get("Location"))
+	token, err := redeemAuthCode(u.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("expect code in redirect: %v", err)
+	}
+	if _, err := parseToken(token); err != nil {
+		t.Fatalf("expect renewed token for code: %v", err)
+	}
+	if !strings.Contains(strings.Join(rr.Header().Values("Set-Cookie"), "\n"), "auth_refresh=") {
+		t.Fatalf("expect rotated refresh cookie")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// revocationDB is the list of revoked tokens, which maps their IDs to
+// their expiration time. Tokens are listed until they expire anyway.
+type revocationDB struct {
+	Tokens map[string]int64 `json:"tokens"`
+}
+
+// revocations is the token revocation list of the server.
+var revocations *jsonFile[revocationDB]
+
+// openRevocations opens the revocation list in the data directory.
+func openRevocations() { revocations = newJSONFile[revocationDB](dataPath("revoked.json")) }
+
+// prune removes the tokens that have expired.
+func (db *revocationDB) prune(now time.Time) {
+	for jti, exp := range db.Tokens {
+		if now.Unix() > exp {
+			delete(db.Tokens, jti)
+		}
+	}
+}
+
+// revokeToken adds the token of the given claims to the revocation list.
+func revokeToken(claims *tokenClaims) error {
+	if claims.Id == "" {
+		return nil
+	}
+	return revokeTokens(map[string]int64{claims.Id: claims.ExpiresAt})
+}
+
+// revokeTokens adds the tokens with the given IDs and expiration times
+// to the revocation list.
+func revokeTokens(tokens map[string]int64) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return revocations.update(func(db *revocationDB) error {
+		db.prune(time.Now())
+		if db.Tokens == nil {
+			db.Tokens = map[string]int64{}
+		}
+		for jti, exp := range tokens {
+			db.Tokens[jti] = exp
+		}
+		return nil
+	})
+}
+
+// isRevoked reports whether the token with the given ID was revoked.
+// Tokens are considered revoked if the list cannot be read.
+func isRevoked(jti string) bool {
+	revoked := true
+	err := revocations.view(func(db *revocationDB) error {
+		_, revoked = db.Tokens[jti]
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to load revocations: %v", err)
+		return true
+	}
+	return revoked
+}
+
+// revocationsfunc publishes the IDs of the revoked tokens that have
+// not expired yet, for services that verify tokens offline.
+func revocationsfunc(w http.ResponseWriter, r *http.Request) {
+	revoked := map[string]int64{}
+	err := revocations.view(func(db *revocationDB) error {
+		now := time.Now().Unix()
+		for jti, exp := range db.Tokens {
+			if exp >= now {
+				revoked[jti] = exp
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to load revocations: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Revoked map[string]int64 `json:"revoked"`
+	}{revoked})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(b)
+}
+
+// logoutfunc ends the session of the request. The token of the request
+// is revoked, the refresh tokens of its session are removed and the
+// cookies are cleared. With everywhere=true all sessions of the user
+// are ended.
+func logoutfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if allowCORS(w, r) && r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.PostFormValue("everywhere") == "true" {
+		claims, ok := session(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := logoutEverywhere(r, claims.user(), ""); err != nil {
+			log.Printf("failed to log out %s everywhere: %v", claims.user(), err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Logging out never fails for the user, tokens that cannot be
+	// revoked are cleared from the browser nonetheless.
+	token := bearerToken(r)
+	if token == "" {
+		if c, err := r.Cookie("auth"); err == nil {
+			token = c.Value
+		}
+	}
+	if claims, err := parseToken(token); err == nil {
+		if err := revokeToken(claims); err != nil {
+			log.Printf("failed to revoke token %s: %v", claims.Id, err)
+		} else {
+			audit(r, "logout", claims.user(), claims.SID)
+		}
+		if claims.SID != "" {
+			if err := endSession(claims.SID); err != nil {
+				log.Printf("failed to end session %s: %v", claims.SID, err)
+			}
+		}
+	}
+	rt := r.PostFormValue("refresh_token")
+	if c, err := r.Cookie("auth_refresh"); err == nil && rt == "" {
+		rt = c.Value
+	}
+	if rt != "" {
+		if err := revokeRefreshToken(rt); err != nil {
+			log.Printf("failed to revoke refresh token: %v", err)
+		}
+	}
+
+	clearCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logoutEverywhere ends all sessions of the given user by increasing
+// the epoch of the user. r is the request that caused it, or nil for
+// admin commands.
+func logoutEverywhere(r *http.Request, u, detail string) error {
+	err := updateUser(u, func(acc *account) error {
+		acc.Epoch++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = endUserSessions(u)
+	if err != nil {
+		// The sessions are of the old epoch and cannot be used anymore,
+		// they are only listed until they expire.
+		log.Printf("failed to end sessions of %s: %v", u, err)
+	}
+	audit(r, "logout_everywhere", u, detail)
+	return nil
+}
+
+// clearCookies removes the auth and refresh cookies, both the ones of
+// changkun.de and host-only ones.
+func clearCookies(w http.ResponseWriter) {
+	for _, domain := range []string{"; Domain=changkun.de", ""} {
+		w.Header().Add("Set-Cookie", "auth=; Path=/; Max-Age=0; SameSite=Lax"+domain)
+		w.Header().Add("Set-Cookie", "auth_refresh=; Path=/; Max-Age=0; HttpOnly; Secure; SameSite=Lax"+domain)
+	}
+}
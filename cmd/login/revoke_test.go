@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogout(t *testing.T) {
+	access, refresh := setupSession(t)
+	claims, _ := parseToken(access)
+
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: access})
+	req.AddCookie(&http.Cookie{Name: "auth_refresh", Value: refresh})
+	rr := httptest.NewRecorder()
+	logoutfunc(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("failed to log out: %v", rr.Code)
+	}
+	cleared := 0
+	for _, c := range rr.Result().Cookies() {
+		if c.MaxAge < 0 && c.Value == "" {
+			cleared++
+		}
+	}
+	if cleared != 4 {
+		t.Fatalf("expect auth and refresh cookies to be cleared, got %v", rr.Header().Values("Set-Cookie"))
+	}
+
+	// The token is revoked everywhere.
+	req = httptest.NewRequest("GET", "/verify", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	rr = httptest.NewRecorder()
+	verifyfunc(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expect revoked token to be rejected, got %v", rr.Code)
+	}
+	req = httptest.NewRequest("GET", "/?redirect=https://changkun.de", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: access})
+	rr = httptest.NewRecorder()
+	homefunc(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expect login page for revoked token, got %v", rr.Code)
+	}
+	if _, _, err := rotateRefreshToken(req, refresh); err == nil {
+		t.Fatalf("expect refresh token to be revoked")
+	}
+
+	// The revocation list is published for offline verification.
+	rr = httptest.NewRecorder()
+	revocationsfunc(rr, httptest.NewRequest("GET", "/revocations", nil))
+	var list struct {
+		Revoked map[string]int64 `json:"revoked"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if list.Revoked[claims.Id] != claims.ExpiresAt {
+		t.Fatalf("expect revoked token to be published, got %s", rr.Body.String())
+	}
+
+	// Expired tokens are pruned from the list.
+	expired := &tokenClaims{}
+	expired.Id, expired.ExpiresAt = "expired", time.Now().Add(-time.Minute).Unix()
+	revocations.update(func(db *revocationDB) error {
+		db.Tokens[expired.Id] = expired.ExpiresAt
+		return nil
+	})
+	if err := revokeToken(&tokenClaims{}); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newToken("changkun", []string{"pwd"})
+	otherClaims, _ := parseToken(other)
+	if err := revokeToken(otherClaims); err != nil {
+		t.Fatal(err)
+	}
+	revocations.view(func(db *revocationDB) error {
+		if _, ok := db.Tokens[expired.Id]; ok || len(db.Tokens) != 2 {
+			t.Fatalf("expect expired revocations to be pruned, got %v", db.Tokens)
+		}
+		return nil
+	})
+
+	// Logging out without a session still clears the cookies.
+	rr = httptest.NewRecorder()
+	logoutfunc(rr, httptest.NewRequest("POST", "/logout", strings.NewReader("")))
+	if rr.Code != http.StatusNoContent || len(rr.Header().Values("Set-Cookie")) != 4 {
+		t.Fatalf("unexpected logout response: %v", rr.Code)
+	}
+}
+
+func TestLogoutEverywhere(t *testing.T) {
+	setupUser(t)
+	valid := func(token string) bool {
+		claims, err := parseToken(token)
+		return err == nil && checkSession(claims)
+	}
+
+	// A password change ends all sessions.
+	access, rt, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setPassword("changkun", "changed", false); err != nil {
+		t.Fatal(err)
+	}
+	if valid(access) {
+		t.Fatalf("expect token to be invalid after password change")
+	}
+	req := httptest.NewRequest("POST", "/token", nil)
+	if _, _, err := refresh(httptest.NewRecorder(), req, rt); err == nil {
+		t.Fatalf("expect refresh token to be invalid after password change")
+	}
+
+	// So does logging out everywhere, from any session.
+	laptop, _, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, phoneRefresh, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid(laptop) || !valid(phone) {
+		t.Fatalf("expect new sessions to be valid")
+	}
+	req = httptest.NewRequest("POST", "/logout", strings.NewReader("everywhere=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "auth", Value: laptop})
+	rr := httptest.NewRecorder()
+	logoutfunc(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("failed to log out everywhere: %v", rr.Code)
+	}
+	if valid(laptop) || valid(phone) {
+		t.Fatalf("expect all sessions to end")
+	}
+	if _, _, err := refresh(httptest.NewRecorder(), req, phoneRefresh); err == nil {
+		t.Fatalf("expect refresh tokens of all sessions to be invalid")
+	}
+
+	// Without a session nothing happens.
+	req = httptest.NewRequest("POST", "/logout", strings.NewReader("everywhere=true"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	logoutfunc(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect logout everywhere to require a session, got %v", rr.Code)
+	}
+
+	// Admins can end the sessions as well.
+	access, _, err = startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userscmd([]string{"logout", "changkun"}); err != nil {
+		t.Fatal(err)
+	}
+	if valid(access) {
+		t.Fatalf("expect admin to end all sessions")
+	}
+}
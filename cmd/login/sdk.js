@@ -7,14 +7,17 @@
 //
 // API:
 //   changkunLogin.check()          - Returns Promise<{ok, username}>
+//   changkunLogin.refresh()        - Renews the session, returns Promise<token|null>
 //   changkunLogin.login([redirect]) - Redirects to login page
-//   changkunLogin.logout([redirect]) - Clears auth cookie and redirects
+//   changkunLogin.logout([redirect]) - Ends the session and redirects
 //   changkunLogin.getToken()       - Returns the auth token or null
 
 (function(global) {
     'use strict';
 
     var VERIFY_URL = 'https://login.changkun.de/verify';
+    var TOKEN_URL  = 'https://login.changkun.de/token';
+    var LOGOUT_URL = 'https://login.changkun.de/logout';
     var LOGIN_URL  = 'https://login.changkun.de/';
 
     function getToken() {
@@ -26,16 +29,33 @@
         return match ? match[1] : null;
     }
 
-    function check() {
-        var token = getToken();
+    // refresh renews the session with the refresh cookie, which
+    // scripts cannot read, and resolves to the new token. The login
+    // server sets the new cookies.
+    function refresh() {
+        return fetch(TOKEN_URL, {
+            method: 'POST',
+            credentials: 'include',
+        })
+        .then(function(resp) {
+            if (!resp.ok) return null;
+            return resp.json().then(function(data) {
+                return data.access_token || null;
+            });
+        })
+        .catch(function() {
+            return null;
+        });
+    }
+
+    function verify(token) {
         if (!token) {
             return Promise.resolve({ ok: false, username: '' });
         }
 
         return fetch(VERIFY_URL, {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ token: token }),
+            method: 'GET',
+            headers: { 'Authorization': 'Bearer ' + token },
         })
         .then(function(resp) {
             if (!resp.ok) return { ok: false, username: '' };
@@ -48,20 +68,37 @@
         });
     }
 
+    function check() {
+        return verify(getToken()).then(function(result) {
+            if (result.ok) return result;
+            // The token may just have expired, renew it and try again.
+            return refresh().then(verify);
+        });
+    }
+
     function login(redirect) {
         var r = redirect || window.location.href;
         window.location.href = LOGIN_URL + '?redirect=' + encodeURIComponent(r);
     }
 
+    // logout revokes the session on the login server, which also
+    // clears the cookies that scripts cannot access.
     function logout(redirect) {
-        document.cookie = 'auth=; Domain=changkun.de; Path=/; Max-Age=0';
-        document.cookie = 'auth=; Path=/; Max-Age=0';
         var r = redirect || window.location.origin + window.location.pathname;
-        window.location.replace(r);
+        var done = function() {
+            document.cookie = 'auth=; Domain=changkun.de; Path=/; Max-Age=0';
+            document.cookie = 'auth=; Path=/; Max-Age=0';
+            window.location.replace(r);
+        };
+        return fetch(LOGOUT_URL, {
+            method: 'POST',
+            credentials: 'include',
+        }).then(done, done);
     }
 
     global.changkunLogin = {
         check: check,
+        refresh: refresh,
         login: login,
         logout: logout,
         getToken: getToken,
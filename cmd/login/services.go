@@ -0,0 +1,294 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"changkun.de/x/login/internal/policy"
+)
+
+// Services that verify tokens at /verify name themselves with the
+// audience parameter. A service that is registered with the login
+// server has an access policy, which decides which users may use it,
+// whereas services that are not registered accept every user. Logins
+// are subject to the policy of the service that is named like the host
+// of the login server, and of the service they redirect to.
+
+// service is a relying service that is registered with the login
+// server. Its ID is the audience it names itself with.
+type service struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Policy  access    `json:"policy"`
+}
+
+// access is the access policy of a service. A user is allowed if the
+// user is one of Users, a member of one of Groups, or if Expr is true.
+// A policy without any rules allows every user.
+type access struct {
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Expr is an expression of the policy language, see package
+	// policy.
+	Expr string `json:"expr,omitempty"`
+}
+
+// policyError is the denial of a request by the access policy of a
+// service.
+type policyError struct {
+	service string
+	reason  string
+}
+
+func (e *policyError) Error() string {
+	return fmt.Sprintf("access to %s denied: %s", e.service, e.reason)
+}
+
+// serviceDB is the service registry persisted in the data directory.
+type serviceDB struct {
+	Services map[string]*service `json:"services"`
+}
+
+// services is the service registry of the server.
+var services *jsonFile[serviceDB]
+
+// openServices opens the service registry in the data directory.
+func openServices() { services = newJSONFile[serviceDB](dataPath("services.json")) }
+
+// lookupService returns a copy of the service with the given ID, or
+// nil if there is no such service.
+func lookupService(id string) (*service, error) {
+	var s *service
+	err := services.view(func(db *serviceDB) error {
+		if sv, ok := db.Services[id]; ok {
+			cp := *sv
+			s = &cp
+		}
+		return nil
+	})
+	return s, err
+}
+
+// listServices returns all services sorted by ID.
+func listServices() ([]*service, error) {
+	var list []*service
+	err := services.view(func(db *serviceDB) error {
+		for _, s := range db.Services {
+			cp := *s
+			list = append(list, &cp)
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, err
+}
+
+// addService registers a new service with a policy that allows every
+// user.
+func addService(id string) error {
+	if id == "" {
+		return fmt.Errorf("service id must not be empty")
+	}
+	return services.update(func(db *serviceDB) error {
+		if _, ok := db.Services[id]; ok {
+			return fmt.Errorf("service %s already exists", id)
+		}
+		if db.Services == nil {
+			db.Services = map[string]*service{}
+		}
+		db.Services[id] = &service{ID: id, Created: time.Now().UTC()}
+		return nil
+	})
+}
+
+// removeService removes the service with the given ID, which then
+// accepts every user again.
+func removeService(id string) error {
+	return services.update(func(db *serviceDB) error {
+		if _, ok := db.Services[id]; !ok {
+			return fmt.Errorf("service %s does not exist", id)
+		}
+		delete(db.Services, id)
+		return nil
+	})
+}
+
+// updatePolicy applies fn to the policy of the service with the given
+// ID.
+func updatePolicy(id string, fn func(p *access)) error {
+	return services.update(func(db *serviceDB) error {
+		s, ok := db.Services[id]
+		if !ok {
+			return fmt.Errorf("service %s does not exist", id)
+		}
+		fn(&s.Policy)
+		return nil
+	})
+}
+
+// policyLocation is the time zone of weekday and hour in access
+// policies.
+var policyLocation = time.UTC
+
+// loadTimeZone loads the time zone of access policies from
+// LOGIN_TIME_ZONE, such as Europe/Berlin, which defaults to UTC.
+func loadTimeZone() error {
+	policyLocation = time.UTC
+	s := os.Getenv("LOGIN_TIME_ZONE")
+	if s == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return fmt.Errorf("invalid LOGIN_TIME_ZONE: %q", s)
+	}
+	policyLocation = loc
+	return nil
+}
+
+// checkAccess returns a *policyError if the access policy of the
+// service with the given ID denies the given user, who authenticated
+// with the given methods, whose account is acc, and whose address is
+// ip. Users of services that are not registered are allowed.
+func checkAccess(ip, id, user string, amr []string, acc *account) error {
+	if id == "" {
+		return nil
+	}
+	s, err := lookupService(id)
+	if err != nil {
+		return fmt.Errorf("failed to load service %s: %w", id, err)
+	}
+	if s == nil {
+		return nil
+	}
+	in := &policy.Input{
+		User:    user,
+		AMR:     amr,
+		IP:      ip,
+		Service: id,
+		Time:    time.Now().In(policyLocation),
+	}
+	if acc != nil {
+		in.Roles, in.Groups = acc.Roles, acc.Groups
+	}
+	if reason := s.Policy.deny(in); reason != "" {
+		return &policyError{service: id, reason: reason}
+	}
+	return nil
+}
+
+// checkLoginAccess checks the access policies of the login server and
+// of the service a login redirects to for the client of r, see
+// checkAccess.
+func checkLoginAccess(r *http.Request, user string, amr []string, redirect string) error {
+	acc, err := lookupUser(user)
+	if err != nil {
+		return fmt.Errorf("failed to load user %s: %w", user, err)
+	}
+	ip := readIP(r)
+	if err := checkAccess(ip, rp.ID, user, amr, acc); err != nil {
+		return err
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || redirect == "" || u.Hostname() == rp.ID {
+		return nil
+	}
+	return checkAccess(ip, u.Hostname(), user, amr, acc)
+}
+
+// deny returns why the policy denies the given input, or an empty
+// string if the user is allowed. Invalid expressions deny everyone.
+func (p *access) deny(in *policy.Input) string {
+	if len(p.Users) == 0 && len(p.Groups) == 0 && p.Expr == "" {
+		return ""
+	}
+	if contains(p.Users, in.User) {
+		return ""
+	}
+	for _, g := range in.Groups {
+		if contains(p.Groups, g) {
+			return ""
+		}
+	}
+	if p.Expr != "" {
+		e, err := compilePolicy(p.Expr)
+		if err != nil {
+			log.Printf("invalid policy of %s: %v", in.Service, err)
+			return "invalid policy"
+		}
+		if e.Eval(in) {
+			return ""
+		}
+		return fmt.Sprintf("user %s is not allowed by the policy", in.User)
+	}
+	return fmt.Sprintf("user %s is not allowed", in.User)
+}
+
+// policies caches compiled policy expressions by their source, as the
+// registry is reloaded whenever it changes and every request applies a
+// policy. It is cleared when it is full, which only happens if the
+// policies keep changing.
+var policies = struct {
+	sync.Mutex
+	m map[string]*compiledPolicy
+}{m: map[string]*compiledPolicy{}}
+
+// maxPolicies is the number of expressions policies holds.
+const maxPolicies = 256
+
+// compiledPolicy is the result of compiling a policy expression.
+type compiledPolicy struct {
+	expr *policy.Expr
+	err  error
+}
+
+// compilePolicy compiles the given policy expression, or returns it
+// from the cache.
+func compilePolicy(src string) (*policy.Expr, error) {
+	policies.Lock()
+	defer policies.Unlock()
+	c, ok := policies.m[src]
+	if !ok {
+		if len(policies.m) >= maxPolicies {
+			policies.m = map[string]*compiledPolicy{}
+		}
+		c = &compiledPolicy{}
+		c.expr, c.err = policy.Compile(src)
+		policies.m[src] = c
+	}
+	return c.expr, c.err
+}
+
+// denyAccess responds to a request that an access policy denied, with
+// the reason for the service or page to show to the user.
+func denyAccess(w http.ResponseWriter, err *policyError) {
+	b, _ := json.Marshal(struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}{"access_denied", err.reason})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(b)
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
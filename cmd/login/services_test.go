@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServicePolicy(t *testing.T) {
+	token, _ := setupSession(t)
+
+	verify := func(aud string) (int, string) {
+		req := httptest.NewRequest("GET", "/verify?audience="+aud, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		var out struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out.Reason
+	}
+
+	// Services that are not registered accept every user, and so do
+	// registered services without a policy.
+	if code, _ := verify("blog"); code != http.StatusOK {
+		t.Fatalf("expect unregistered service to accept the user, got %v", code)
+	}
+	if err := servicescmd([]string{"add", "blog"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify("blog"); code != http.StatusOK {
+		t.Fatalf("expect open policy to accept the user, got %v", code)
+	}
+
+	if err := servicescmd([]string{"users", "blog", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := verify("blog"); code != http.StatusForbidden || reason != "user changkun is not allowed" {
+		t.Fatalf("expect denial with reason, got %v %q", code, reason)
+	}
+	if code, _ := verify("wiki"); code != http.StatusOK {
+		t.Fatalf("expect other services to be unaffected, got %v", code)
+	}
+
+	// Members of an allowed group are allowed, with immediate effect.
+	if err := servicescmd([]string{"groups", "blog", "family"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify("blog"); code != http.StatusForbidden {
+		t.Fatalf("expect non-member to be denied, got %v", code)
+	}
+	if err := userscmd([]string{"groups", "changkun", "family"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify("blog"); code != http.StatusOK {
+		t.Fatalf("expect group member to be allowed, got %v", code)
+	}
+
+	if err := servicescmd([]string{"remove", "blog"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"remove", "blog"}); err == nil {
+		t.Fatal("expect removing a missing service to fail")
+	}
+}
+
+func TestServicePolicyExpr(t *testing.T) {
+	token, _ := setupSession(t)
+	if err := servicescmd([]string{"add", "blog"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"expr", "blog", `inNetwork(ip,`}); err == nil {
+		t.Fatal("expect invalid expression to be rejected")
+	}
+	if err := servicescmd([]string{"expr", "blog", `"admin" in roles ||`, `inNetwork(ip, "10.1.0.0/16")`}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The service names the address of its client.
+	verify := func(ip string) (int, string) {
+		req := httptest.NewRequest("POST", "/verify", strings.NewReader(`{"audience":"blog","ip":"`+ip+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		var out struct {
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out.Reason
+	}
+	if code, _ := verify("10.1.2.3"); code != http.StatusOK {
+		t.Fatalf("expect office network to be allowed, got %v", code)
+	}
+	if code, reason := verify("10.2.0.1"); code != http.StatusForbidden || reason != "user changkun is not allowed by the policy" {
+		t.Fatalf("expect other networks to be denied, got %v %q", code, reason)
+	}
+	if code, _ := verify("10.1.2"); code != http.StatusBadRequest {
+		t.Fatalf("expect invalid address to be rejected, got %v", code)
+	}
+
+	// Without it, the caller is the client, whose forwarding headers
+	// are ignored unless it is a trusted proxy.
+	forwarded := func(peer string) int {
+		req := httptest.NewRequest("GET", "/verify?audience=blog", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		req.RemoteAddr = peer + ":1234"
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		return rr.Code
+	}
+	if code := forwarded("192.0.2.1"); code != http.StatusForbidden {
+		t.Fatalf("expect spoofed X-Forwarded-For to be ignored, got %v", code)
+	}
+	t.Setenv("LOGIN_TRUSTED_PROXIES", "192.0.2.0/24")
+	if err := loadTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+	if code := forwarded("192.0.2.1"); code != http.StatusOK {
+		t.Fatalf("expect X-Forwarded-For of trusted proxy to be used, got %v", code)
+	}
+	if code := forwarded("198.51.100.1"); code != http.StatusForbidden {
+		t.Fatalf("expect X-Forwarded-For of other peers to be ignored, got %v", code)
+	}
+	if err := userscmd([]string{"roles", "changkun", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify("10.2.0.1"); code != http.StatusOK {
+		t.Fatalf("expect admin to be allowed anywhere, got %v", code)
+	}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	// Expressions are compiled once, including invalid ones.
+	e1, err := compilePolicy(`"admin" in roles`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e2, _ := compilePolicy(`"admin" in roles`); e2 != e1 {
+		t.Fatalf("expect expression to be cached")
+	}
+	if _, err := compilePolicy(`"admin" in`); err == nil {
+		t.Fatalf("expect invalid expression to be rejected")
+	}
+	if _, err := compilePolicy(`"admin" in`); err == nil {
+		t.Fatalf("expect cached invalid expression to be rejected")
+	}
+}
+
+func TestLoginPolicy(t *testing.T) {
+	setupUser(t)
+	login := func(redirect string) (int, string) {
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(
+			`{"username":"changkun","password":"secret","redirect":"`+redirect+`"}`))
+		rr := httptest.NewRecorder()
+		authfunc(rr, req)
+		var out struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out.Error
+	}
+
+	// The policy of the service a login redirects to applies.
+	if err := servicescmd([]string{"add", "wiki.changkun.de"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"users", "wiki.changkun.de", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, e := login("https://wiki.changkun.de/page"); code != http.StatusForbidden || e != "access_denied" {
+		t.Fatalf("expect login for the wiki to be denied, got %v %q", code, e)
+	}
+	if code, _ := login("https://blog.changkun.de/"); code != http.StatusOK {
+		t.Fatalf("expect login for the blog to be allowed, got %v", code)
+	}
+
+	// The policy of the login server applies to all logins.
+	if err := servicescmd([]string{"add", rp.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"expr", rp.ID, `"otp" in amr`}); err != nil {
+		t.Fatal(err)
+	}
+	if code, e := login(""); code != http.StatusForbidden || e != "access_denied" {
+		t.Fatalf("expect login without second factor to be denied, got %v %q", code, e)
+	}
+}
+
+func TestPolicyCommand(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"test", `"admin" in roles && hour < 12`, "roles=admin,ops", "time=2021-06-07T10:00:00Z"}, true},
+		{[]string{"test", `"admin" in roles`, "role=admin"}, false},
+		{[]string{"test", `"admin" in roles`, "time=today"}, false},
+		{[]string{"test", `roles`}, false},
+		{[]string{"test"}, false},
+	} {
+		if err := policycmd(tt.args); (err == nil) != tt.ok {
+			t.Errorf("policy %v: unexpected error %v", tt.args, err)
+		}
+	}
+}
+
+func TestPolicyTimeZone(t *testing.T) {
+	setupData(t)
+	t.Cleanup(func() { policyLocation = time.UTC })
+	t.Setenv("LOGIN_TIME_ZONE", "Mars/Olympus")
+	if err := loadTimeZone(); err == nil {
+		t.Fatal("expect unknown time zone to be rejected")
+	}
+	t.Setenv("LOGIN_TIME_ZONE", "Etc/GMT-14")
+	if err := loadTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hour in UTC is 14 hours behind.
+	hour := time.Now().In(policyLocation).Hour()
+	if err := servicescmd([]string{"add", "blog"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servicescmd([]string{"expr", "blog", fmt.Sprintf("hour == %d", hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAccess("10.1.2.3", "blog", "changkun", nil, nil); err != nil {
+		t.Fatalf("expect hour in the time zone to be allowed, got %v", err)
+	}
+	policyLocation = time.UTC
+	if err := checkAccess("10.1.2.3", "blog", "changkun", nil, nil); err == nil {
+		t.Fatal("expect hour in UTC to be denied")
+	}
+}
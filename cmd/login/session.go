@@ -0,0 +1,300 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastSeenInterval limits how often the last seen time of a session is
+// written, as it is updated by every verification of its tokens.
+const lastSeenInterval = time.Minute
+
+// loginSession is a login session, which starts at login and lasts as
+// long as its refresh tokens. All tokens of a session carry its ID in
+// the sid claim, and are rejected once the session ends.
+type loginSession struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	TokenID   string    `json:"jti"` // the latest token of the session
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+
+	// Tokens are the IDs of the access tokens issued for the session
+	// with their expiration time, until they expire.
+	Tokens map[string]int64 `json:"tokens,omitempty"`
+}
+
+// sessionDB is the session registry, keyed by session ID.
+type sessionDB struct {
+	Sessions map[string]*loginSession `json:"sessions"`
+}
+
+// sessions is the session registry of the server.
+var sessions *jsonFile[sessionDB]
+
+// openSessions opens the session registry in the data directory.
+func openSessions() { sessions = newJSONFile[sessionDB](dataPath("sessions.json")) }
+
+// prune removes the sessions that have expired.
+func (db *sessionDB) prune(now time.Time) {
+	for id, s := range db.Sessions {
+		if now.After(s.Expires) {
+			delete(db.Sessions, id)
+		}
+	}
+}
+
+// createSession adds the given session to the registry.
+func createSession(s *loginSession) error {
+	return sessions.update(func(db *sessionDB) error {
+		db.prune(time.Now())
+		if db.Sessions == nil {
+			db.Sessions = map[string]*loginSession{}
+		}
+		db.Sessions[s.ID] = s
+		return nil
+	})
+}
+
+// sessionActive reports whether the session with the given ID exists.
+func sessionActive(sid string) bool {
+	active := false
+	err := sessions.view(func(db *sessionDB) error {
+		s, ok := db.Sessions[sid]
+		active = ok && time.Now().Before(s.Expires)
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to load sessions: %v", err)
+		return false
+	}
+	return active
+}
+
+// lookupSession returns a copy of the active session with the given ID,
+// or nil if there is no such session.
+func lookupSession(sid string) (*loginSession, error) {
+	var s *loginSession
+	err := sessions.view(func(db *sessionDB) error {
+		if cur, ok := db.Sessions[sid]; ok && time.Now().Before(cur.Expires) {
+			cp := *cur
+			s = &cp
+		}
+		return nil
+	})
+	return s, err
+}
+
+// touchSession records that the token with the given ID of the given
+// session was just used.
+func touchSession(sid, jti string) {
+	if sid == "" {
+		return
+	}
+	now := time.Now().UTC()
+	stale := false
+	err := sessions.view(func(db *sessionDB) error {
+		if s, ok := db.Sessions[sid]; ok {
+			stale = s.TokenID != jti || now.Sub(s.LastSeen) >= lastSeenInterval
+		}
+		return nil
+	})
+	if err != nil || !stale {
+		return
+	}
+	err = sessions.update(func(db *sessionDB) error {
+		if s, ok := db.Sessions[sid]; ok {
+			s.TokenID, s.LastSeen = jti, now
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to update session %s: %v", sid, err)
+	}
+}
+
+// addSessionToken records that the token with the given ID was issued
+// for the given session, which counts as use of the session.
+func addSessionToken(sid, jti string) {
+	now := time.Now().UTC()
+	err := sessions.update(func(db *sessionDB) error {
+		s, ok := db.Sessions[sid]
+		if !ok {
+			return nil
+		}
+		for id, exp := range s.Tokens {
+			if now.Unix() > exp {
+				delete(s.Tokens, id)
+			}
+		}
+		if s.Tokens == nil {
+			s.Tokens = map[string]int64{}
+		}
+		s.Tokens[jti] = now.Add(accessTokenLifetime).Unix()
+		s.TokenID, s.LastSeen = jti, now
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to update session %s: %v", sid, err)
+	}
+}
+
+// listSessions returns the active sessions of the given user, or of
+// all users if u is empty, the most recently used first.
+func listSessions(u string) ([]*loginSession, error) {
+	var list []*loginSession
+	err := sessions.view(func(db *sessionDB) error {
+		now := time.Now()
+		for _, s := range db.Sessions {
+			if (u == "" || s.User == u) && now.Before(s.Expires) {
+				cp := *s
+				list = append(list, &cp)
+			}
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list, err
+}
+
+// endSession removes the session with the given ID and its refresh
+// tokens. The tokens issued for the session are revoked as well, for
+// services that verify tokens offline.
+func endSession(sid string) error {
+	var ended *loginSession
+	err := sessions.update(func(db *sessionDB) error {
+		ended = db.Sessions[sid]
+		delete(db.Sessions, sid)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = refreshTokens.update(func(db *refreshDB) error {
+		db.revokeFamily(sid)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ended == nil {
+		return nil
+	}
+	revoked := map[string]int64{}
+	for jti, exp := range ended.Tokens {
+		revoked[jti] = exp
+	}
+	if _, ok := revoked[ended.TokenID]; !ok && ended.TokenID != "" {
+		revoked[ended.TokenID] = ended.LastSeen.Add(accessTokenLifetime).Unix()
+	}
+	return revokeTokens(revoked)
+}
+
+// endUserSessions ends all sessions of the given user.
+func endUserSessions(u string) error {
+	list, err := listSessions(u)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		if err := endSession(s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionsfunc lists the sessions of the logged in user as JSON, or
+// ends one of them with {"action": "revoke", "id": "..."}.
+func sessionsfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var err error
+	defer func() {
+		if err == nil {
+			return
+		}
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		w.WriteHeader(status)
+		log.Println(err)
+	}()
+
+	claims, ok := session(r)
+	if !ok {
+		err = fmt.Errorf("%w: missing session", errUnauthorized)
+		return
+	}
+	u := claims.user()
+
+	switch r.Method {
+	case http.MethodGet:
+		var list []*loginSession
+		list, err = listSessions(u)
+		if err != nil {
+			return
+		}
+		type item struct {
+			*loginSession
+			Current bool `json:"current"`
+		}
+		items := []item{}
+		for _, s := range list {
+			items = append(items, item{s, s.ID == claims.SID})
+		}
+		writeJSON(w, items)
+	case http.MethodPost:
+		// Requiring JSON prevents cross-site form submissions.
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			err = errors.New("unsupported request")
+			return
+		}
+		var req struct {
+			Action string `json:"action"`
+			ID     string `json:"id"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			err = fmt.Errorf("failed to parse request body: %w", err)
+			return
+		}
+		if req.Action != "revoke" {
+			err = fmt.Errorf("unsupported action: %q", req.Action)
+			return
+		}
+		var list []*loginSession
+		list, err = listSessions(u)
+		if err != nil {
+			return
+		}
+		for _, s := range list {
+			if s.ID == req.ID {
+				err = endSession(s.ID)
+				if err != nil {
+					return
+				}
+				audit(r, "session_revoked", u, s.ID)
+				writeJSON(w, struct{}{})
+				return
+			}
+		}
+		err = fmt.Errorf("session %q of %s does not exist", req.ID, u)
+	default:
+		err = errors.New("unsupported method")
+	}
+}
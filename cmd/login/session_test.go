@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	setupUser(t)
+	login := func(ua string) (access, refresh string) {
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"changkun","password":"secret"}`))
+		req.Header.Set("User-Agent", ua)
+		rr := httptest.NewRecorder()
+		authfunc(rr, req)
+		var out struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("failed to log in: %v", rr.Code)
+		}
+		return out.Token, out.RefreshToken
+	}
+	type item struct {
+		ID        string    `json:"id"`
+		UserAgent string    `json:"user_agent"`
+		IP        string    `json:"ip"`
+		LastSeen  time.Time `json:"last_seen"`
+		Current   bool      `json:"current"`
+	}
+	list := func(token string) (int, []item) {
+		req := httptest.NewRequest("GET", "/account/sessions", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		sessionsfunc(rr, req)
+		var out []item
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr.Code, out
+	}
+	revoke := func(token, id string) int {
+		req := httptest.NewRequest("POST", "/account/sessions", strings.NewReader(`{"action":"revoke","id":"`+id+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		sessionsfunc(rr, req)
+		return rr.Code
+	}
+	verify := func(token string) int {
+		req := httptest.NewRequest("GET", "/verify", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		verifyfunc(rr, req)
+		return rr.Code
+	}
+
+	// Every login starts a session, which its tokens refer to.
+	laptop, _ := login("laptop")
+	phone, phoneRefresh := login("phone")
+	code, all := list(laptop)
+	if code != http.StatusOK || len(all) != 2 {
+		t.Fatalf("expect two sessions, got %v: %+v", code, all)
+	}
+	claims, _ := parseToken(laptop)
+	var phoneID string
+	for _, s := range all {
+		if s.IP == "" || s.Current != (s.ID == claims.SID) || s.Current != (s.UserAgent == "laptop") {
+			t.Fatalf("unexpected session: %+v", s)
+		}
+		if !s.Current {
+			phoneID = s.ID
+		}
+	}
+
+	// Verifications update the last seen time.
+	sessions.update(func(db *sessionDB) error {
+		db.Sessions[phoneID].LastSeen = time.Now().Add(-time.Hour)
+		return nil
+	})
+	if code := verify(phone); code != http.StatusOK {
+		t.Fatalf("failed to verify: %v", code)
+	}
+	_, after := list(laptop)
+	for _, s := range after {
+		if s.ID == phoneID && time.Since(s.LastSeen) > time.Minute {
+			t.Fatalf("expect last seen time to be updated, got %v", s.LastSeen)
+		}
+	}
+
+	// Revoking a session invalidates its tokens, including those
+	// issued before the last refresh.
+	if code := revoke(laptop, "unknown"); code != http.StatusBadRequest {
+		t.Fatalf("expect unknown session to be rejected, got %v", code)
+	}
+	renewed, phoneRefresh, err := refresh(httptest.NewRecorder(), httptest.NewRequest("POST", "/token", nil), phoneRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := revoke(laptop, phoneID); code != http.StatusOK {
+		t.Fatalf("failed to revoke session: %v", code)
+	}
+	for _, token := range []string{phone, renewed} {
+		if claims, _ := parseToken(token); !isRevoked(claims.Id) {
+			t.Fatalf("expect all tokens of the session to be revoked")
+		}
+	}
+	if code := verify(phone); code != http.StatusBadRequest {
+		t.Fatalf("expect token of revoked session to be rejected, got %v", code)
+	}
+	if _, _, err := refresh(httptest.NewRecorder(), httptest.NewRequest("POST", "/token", nil), phoneRefresh); err == nil {
+		t.Fatalf("expect refresh token of revoked session to be rejected")
+	}
+	if code := verify(laptop); code != http.StatusOK {
+		t.Fatalf("expect other sessions to stay, got %v", code)
+	}
+	if code, _ := list(phone); code != http.StatusUnauthorized {
+		t.Fatalf("expect revoked session to have no access, got %v", code)
+	}
+
+	// Sessions of other users cannot be revoked.
+	if err := setPassword("other", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "other", []string{"pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClaims, _ := parseToken(other)
+	if code := revoke(laptop, otherClaims.SID); code != http.StatusBadRequest {
+		t.Fatalf("expect session of other user to be rejected, got %v", code)
+	}
+
+	// Admins list and revoke sessions of all users.
+	if err := sessionscmd([]string{"revoke", otherClaims.SID}); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(other); code != http.StatusBadRequest {
+		t.Fatalf("expect session revoked by admin to end, got %v", code)
+	}
+}
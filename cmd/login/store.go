@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dataPath returns the path of the given file in the data directory,
+// which is LOGIN_DATA or "data" relative to the working directory.
+func dataPath(name string) string {
+	dir := os.Getenv("LOGIN_DATA")
+	if dir == "" {
+		dir = "data"
+	}
+	return filepath.Join(dir, name)
+}
+
+// jsonFile is a JSON document persisted in a file. The document is
+// reloaded whenever the file was modified by someone else, so that the
+// admin commands can change the data of a running server.
+type jsonFile[T any] struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	data    *T
+}
+
+func newJSONFile[T any](path string) *jsonFile[T] {
+	return &jsonFile[T]{path: path}
+}
+
+// reload reads the file if it has changed since it was read last
+// time. A missing file is an empty document. The caller must hold mu.
+func (f *jsonFile[T]) reload() error {
+	fi, err := os.Stat(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if f.data == nil || !f.modTime.IsZero() {
+			f.data = new(T)
+			f.modTime, f.size = time.Time{}, 0
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.data != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	data := new(T)
+	err = json.Unmarshal(b, data)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// view calls fn with the current document. fn must not modify it.
+func (f *jsonFile[T]) view(fn func(*T) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.reload()
+	if err != nil {
+		return err
+	}
+	return fn(f.data)
+}
+
+// update calls fn with the current document and writes it back to the
+// file if fn succeeds.
+func (f *jsonFile[T]) update(fn func(*T) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.reload()
+	if err != nil {
+		return err
+	}
+	err = fn(f.data)
+	if err != nil {
+		// The document may be modified partially, discard it.
+		f.data = nil
+		return err
+	}
+	return f.save()
+}
+
+// save writes the document atomically. The caller must hold mu.
+func (f *jsonFile[T]) save() error {
+	b, err := json.MarshalIndent(f.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(f.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), f.path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return nil
+}
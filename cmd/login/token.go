@@ -0,0 +1,284 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"changkun.de/x/login/internal/jwk"
+	"changkun.de/x/login/internal/uuid"
+	"github.com/golang-jwt/jwt"
+)
+
+// issuer is the issuer of all tokens minted by the login server.
+const issuer = "login.changkun.de"
+
+// tokenVersion is the version of the claim layout of new tokens.
+//
+// Tokens of the first layout, which have no version, carry the user in
+// aud and "login" in sub. Since version 2 the user is the subject, and
+// aud is the service the token was issued for, or absent if any
+// service may accept it. Tokens of the first layout are accepted until
+// they expire.
+const tokenVersion = 2
+
+// tokenClaims are the claims of the tokens minted by the login server.
+type tokenClaims struct {
+	jwt.StandardClaims
+
+	// Version is the version of the claim layout, see tokenVersion.
+	Version int `json:"ver,omitempty"`
+
+	// AMR lists the methods the user authenticated with, see RFC 8176:
+	// "pwd" for a password, "otp" for a TOTP code, and "hwk" and "mfa"
+	// for a passkey that verified the user.
+	AMR []string `json:"amr,omitempty"`
+
+	// Epoch is the epoch of the user when the token was issued.
+	Epoch int `json:"epoch,omitempty"`
+
+	// SID is the ID of the login session the token belongs to, see
+	// loginSession.
+	SID string `json:"sid,omitempty"`
+
+	// ClientID is set for service tokens, which are issued to a client
+	// rather than a user, see newServiceToken.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Roles and Groups are those of the user when the token was
+	// issued.
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Ext are the custom claims of the user when the token was issued,
+	// see account.Claims.
+	Ext map[string]string `json:"ext,omitempty"`
+}
+
+// user returns the user the token was issued to, which is empty for
+// service tokens.
+func (c *tokenClaims) user() string {
+	switch {
+	case c.ClientID != "":
+		return ""
+	case c.Version == 0:
+		return c.Audience
+	}
+	return c.Subject
+}
+
+// subject returns who the token was issued to: the client of service
+// tokens, and the user otherwise.
+func (c *tokenClaims) subject() string {
+	if c.ClientID != "" {
+		return c.ClientID
+	}
+	return c.user()
+}
+
+// audience returns the service the token was issued for, or an empty
+// string if any service may accept it.
+func (c *tokenClaims) audience() string {
+	if c.Version == 0 {
+		return ""
+	}
+	return c.Audience
+}
+
+// acceptedBy reports whether the given service, which may be unknown,
+// may accept the token.
+func (c *tokenClaims) acceptedBy(aud string) bool {
+	return c.audience() == "" || c.audience() == aud
+}
+
+// hasAMR reports whether the user authenticated with the given method.
+func (c *tokenClaims) hasAMR(method string) bool {
+	for _, m := range c.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// multiFactor reports whether the user authenticated with more than a
+// password.
+func (c *tokenClaims) multiFactor() bool {
+	return c.hasAMR("otp") || c.hasAMR("mfa")
+}
+
+// hmacSecret is the legacy HS256 secret. If the key ring has an active
+// key, the secret is only used to accept tokens that were issued
+// before the migration, until they expire: HS256 tokens are rejected
+// once the first key of the key ring is older than tokenLifetime.
+var hmacSecret []byte
+
+// signToken signs the given claims with the active key of the key ring.
+func signToken(claims jwt.Claims) (token string, err error) {
+	err = keys.view(func(ring *keyRing) error {
+		e := ring.active()
+		if e == nil {
+			if len(hmacSecret) == 0 {
+				return errors.New("no active signing key")
+			}
+			token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(hmacSecret)
+			return err
+		}
+
+		key, err := e.key()
+		if err != nil {
+			return err
+		}
+		t := jwt.NewWithClaims(jwt.GetSigningMethod(e.Alg), claims)
+		t.Header["kid"] = e.Kid
+		token, err = t.SignedString(key)
+		return err
+	})
+	return
+}
+
+// newToken returns a new login token of the given user, who
+// authenticated with the given methods.
+func newToken(u string, amr []string) (string, error) {
+	epoch, err := userEpoch(u)
+	if err != nil {
+		return "", err
+	}
+	token, _, err := newSessionToken(u, "", amr, epoch, "")
+	return token, err
+}
+
+// newSessionToken is like newToken but for the given epoch and session
+// of the user. The token is restricted to the given service, unless
+// aud is empty, and carries the current roles and groups of the user.
+// It also returns the ID of the token.
+func newSessionToken(u, aud string, amr []string, epoch int, sid string) (token, jti string, err error) {
+	acc, err := lookupUser(u)
+	if err != nil {
+		return "", "", err
+	}
+	if acc == nil {
+		return "", "", fmt.Errorf("user %s does not exist", u)
+	}
+	now := time.Now().UTC()
+	jti = uuid.Must(uuid.NewShort())
+	token, err = signToken(tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(accessTokenLifetime).Unix(),
+			Audience:  aud,
+			Issuer:    issuer,
+			Subject:   u,
+		},
+		Version: tokenVersion,
+		AMR:     amr,
+		Epoch:   epoch,
+		SID:     sid,
+		Roles:   acc.Roles,
+		Groups:  acc.Groups,
+		Ext:     acc.Claims,
+	})
+	return token, jti, err
+}
+
+// setAuthCookie sets the auth cookie that is shared across changkun.de.
+// It expires with the token, after which the refresh cookie renews it.
+func setAuthCookie(w http.ResponseWriter, token string) {
+	w.Header().Add("Set-Cookie", fmt.Sprintf("auth=%s; Domain=changkun.de; Path=/; Max-Age=%d; SameSite=Lax",
+		token, int(accessTokenLifetime/time.Second)))
+}
+
+// parseToken parses the given token and checks its signature and
+// validity.
+func parseToken(token string) (*tokenClaims, error) {
+	t, err := jwt.ParseWithClaims(token, &tokenClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			if len(hmacSecret) == 0 || !acceptHMAC(time.Now()) {
+				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+			}
+			return hmacSecret, nil
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		var pub interface{}
+		err := keys.view(func(ring *keyRing) error {
+			e := ring.lookup(kid)
+			if e == nil || e.Alg != t.Method.Alg() {
+				return fmt.Errorf("unknown signing key: %v", kid)
+			}
+			key, err := e.key()
+			if err != nil {
+				return err
+			}
+			pub = key.Public()
+			return nil
+		})
+		return pub, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse token failed: %w", err)
+	}
+
+	// Checking validity of the token.
+	claims, ok := t.Claims.(*tokenClaims)
+	if !ok {
+		return nil, fmt.Errorf("unsupported claims format")
+	}
+	if !t.Valid {
+		return nil, fmt.Errorf("invalid claims: %w", claims.Valid())
+	}
+	// ID tokens are signed with the same keys, but are no login tokens.
+	if claims.Issuer != issuer {
+		return nil, fmt.Errorf("unexpected issuer: %q", claims.Issuer)
+	}
+	if claims.Version > tokenVersion || claims.Version == 0 && claims.Subject != "login" ||
+		claims.Version > 0 && claims.Subject == "" {
+		return nil, fmt.Errorf("unsupported claim layout: %d", claims.Version)
+	}
+	return claims, nil
+}
+
+// jwksfunc publishes the public keys of the key ring, including the
+// retired ones that tokens may still be signed with, as a JSON Web
+// Key Set.
+func jwksfunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	set := jwk.Set{Keys: []jwk.Key{}}
+	err := keys.view(func(ring *keyRing) error {
+		for _, e := range ring.Keys {
+			if ring.lookup(e.Kid) == nil {
+				continue
+			}
+			key, err := e.key()
+			if err != nil {
+				return err
+			}
+			k, err := jwk.New(e.Kid, e.Alg, key.Public())
+			if err != nil {
+				return err
+			}
+			set.Keys = append(set.Keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to publish signing keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(set)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
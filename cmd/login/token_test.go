@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"changkun.de/x/login"
+	"github.com/golang-jwt/jwt"
+)
+
+func TestKeyRotation(t *testing.T) {
+	setupData(t)
+	hmacSecret = []byte("secret")
+
+	// A token issued before the migration to asymmetric keys.
+	legacy, err := signToken(testClaims("changkun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(jwksfunc))
+	defer ts.Close()
+
+	var tokens []string
+	for _, alg := range []string{"EdDSA", "ES256", "RS256"} {
+		key, err := generateKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rotateKey(key); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := signToken(testClaims("changkun"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+
+		// Tokens signed with retired keys stay valid, both on the
+		// server and for services that verify offline.
+		c := login.NewClient(login.WithJWKS(ts.URL))
+		for _, token := range append(tokens, legacy) {
+			if _, err := parseToken(token); err != nil {
+				t.Fatalf("%v: expect to be valid, but failed: %v", alg, err)
+			}
+			if token == legacy {
+				continue
+			}
+			u, err := c.Verify(context.Background(), token)
+			if err != nil || u != "changkun" {
+				t.Fatalf("%v: expect offline verification to succeed, got %v, %v", alg, u, err)
+			}
+		}
+	}
+
+	// Once the secret is removed, legacy tokens are rejected.
+	hmacSecret = nil
+	if _, err := parseToken(legacy); err == nil {
+		t.Fatalf("expect legacy token to be rejected without secret")
+	}
+
+	// Legacy tokens are also rejected once all tokens issued before
+	// the migration have expired.
+	hmacSecret = []byte("secret")
+	if !acceptHMAC(time.Now().Add(tokenLifetime - time.Hour)) {
+		t.Fatalf("expect legacy tokens to be accepted within the token lifetime")
+	}
+	err = keys.update(func(ring *keyRing) error {
+		ring.Keys[0].Created = time.Now().Add(-tokenLifetime - time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseToken(legacy); err == nil {
+		t.Fatalf("expect legacy token to be rejected after the migration period")
+	}
+	hmacSecret = nil
+
+	// Keys retired longer than the token lifetime are dropped.
+	err = keys.update(func(ring *keyRing) error {
+		ring.Keys[0].Retired = time.Now().Add(-tokenLifetime - time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseToken(tokens[0]); err == nil {
+		t.Fatalf("expect token of expired key to be rejected")
+	}
+	if _, err := parseToken(tokens[2]); err != nil {
+		t.Fatalf("expect token of active key to be valid, but failed: %v", err)
+	}
+}
+
+func TestKeyRotationByCommand(t *testing.T) {
+	setupData(t)
+	if err := keyscmd([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := signToken(testClaims("changkun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The admin command runs in another process and has its own view
+	// of the key ring.
+	server := keys
+	if err := keyscmd([]string{"rotate", "-alg", "ES256"}); err != nil {
+		t.Fatal(err)
+	}
+	keys = server
+
+	after, err := signToken(testClaims("changkun"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := jwtHeader(t, after); h["alg"] != "ES256" || h["kid"] == jwtHeader(t, before)["kid"] {
+		t.Fatalf("expect the server to sign with the rotated key, got header %v", h)
+	}
+	for _, token := range []string{before, after} {
+		if _, err := parseToken(token); err != nil {
+			t.Fatalf("expect to be valid, but failed: %v", err)
+		}
+	}
+}
+
+func jwtHeader(t *testing.T, token string) map[string]interface{} {
+	t.Helper()
+	tk, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tk.Header
+}
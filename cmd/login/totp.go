@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters as supported by all common authenticator apps, see
+// RFC 6238.
+const (
+	totpPeriod = 30 // seconds
+	totpDigits = 6
+	totpSkew   = 1 // accepted time steps before and after the current one
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a new random TOTP secret in base32.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth:// URI of the given secret, which
+// authenticator apps import by scanning its QR code.
+func totpURI(u, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + u,
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// totpCode returns the code of the given time step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+
+	// Dynamic truncation, RFC 4226, Section 5.3.
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// matchTOTP checks the code against the given secret at time now. It
+// returns the matched time step, which must be later than last so that
+// a code can only be used once.
+func matchTOTP(secret, code string, now time.Time, last int64) (int64, bool) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkTOTP checks the code against the enabled TOTP secret of the
+// given user and marks it as used.
+func checkTOTP(u, code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	err := updateUser(u, func(acc *account) error {
+		step, ok := matchTOTP(acc.TOTP, code, time.Now(), acc.TOTPStep)
+		if !ok {
+			return errUnauthorized
+		}
+		acc.TOTPStep = step
+		return nil
+	})
+	return err == nil
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, Appendix B, truncated to six digits.
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.time/totpPeriod); got != tt.code {
+			t.Errorf("totpCode at %d = %v, want %v", tt.time, got, tt.code)
+		}
+	}
+
+	secret := b32.EncodeToString(key)
+	now := time.Unix(1111111109, 0)
+	if _, ok := matchTOTP(secret, "081804", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Fatalf("expect code of the previous step to be accepted")
+	}
+	if _, ok := matchTOTP(secret, "081804", now.Add(2*totpPeriod*time.Second), 0); ok {
+		t.Fatalf("expect outdated code to be rejected")
+	}
+	if _, ok := matchTOTP(secret, "081804", now, now.Unix()/totpPeriod); ok {
+		t.Fatalf("expect used code to be rejected")
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	setupUser(t)
+	login := func(otp string) *httptest.ResponseRecorder {
+		body := `{"username":"changkun","password":"secret","otp":"` + otp + `"}`
+		req := httptest.NewRequest("POST", "/auth", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		authfunc(rr, req)
+		return rr
+	}
+	call := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/account/totp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		totpfunc(rr, req)
+		return rr
+	}
+	tokenOf := func(rr *httptest.ResponseRecorder) string {
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return out.Token
+	}
+
+	rr := login("")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expect login without 2FA to succeed, got %v", rr.Code)
+	}
+	pwdToken := tokenOf(rr)
+
+	// Enroll and confirm a secret.
+	rr = call(pwdToken, `{"action":"enroll"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to enroll: %v", rr.Code)
+	}
+	var enroll struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		QR     string `json:"qr"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &enroll)
+	if !strings.HasPrefix(enroll.URI, "otpauth://totp/") || !strings.HasPrefix(enroll.QR, "<svg") {
+		t.Fatalf("unexpected enrollment: %+v", enroll)
+	}
+	key, _ := b32.DecodeString(enroll.Secret)
+	step := time.Now().Unix() / totpPeriod
+	if rr := call(pwdToken, `{"action":"confirm","code":"000000x"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expect invalid code to be rejected, got %v", rr.Code)
+	}
+	rr = call(pwdToken, `{"action":"confirm","code":"`+totpCode(key, step)+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("failed to confirm: %v", rr.Code)
+	}
+
+	// Tokens without second factor are no longer accepted.
+	claims, err := parseToken(pwdToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkSession(claims) {
+		t.Fatalf("expect token without second factor to be rejected")
+	}
+	claims, err = parseToken(tokenOf(rr))
+	if err != nil || !checkSession(claims) || !claims.hasAMR("otp") {
+		t.Fatalf("expect confirmation to return a token with second factor, got %+v, %v", claims, err)
+	}
+
+	// Logins now require a code, which can only be used once.
+	rr = login("")
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "otp_required") {
+		t.Fatalf("expect login to require a code, got %v: %s", rr.Code, rr.Body)
+	}
+	if rr := login(totpCode(key, step)); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect code used for confirmation to be rejected, got %v", rr.Code)
+	}
+	code := totpCode(key, step+1)
+	rr = login(code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expect login with code to succeed, got %v", rr.Code)
+	}
+	claims, err = parseToken(tokenOf(rr))
+	if err != nil || len(claims.AMR) != 2 || claims.AMR[0] != "pwd" || claims.AMR[1] != "otp" {
+		t.Fatalf("unexpected amr claim: %+v, %v", claims, err)
+	}
+	if rr := login(code); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expect replayed code to be rejected, got %v", rr.Code)
+	}
+
+	// An admin resets the second factor of a user who lost it.
+	if err := userscmd([]string{"totp-reset", "changkun"}); err != nil {
+		t.Fatal(err)
+	}
+	if rr := login(""); rr.Code != http.StatusOK {
+		t.Fatalf("expect login without code after reset, got %v", rr.Code)
+	}
+}
+
+func TestTOTPDisableThrottle(t *testing.T) {
+	setupUser(t)
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = updateUser("changkun", func(acc *account) error {
+		acc.TOTP = secret
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := startSession(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth", nil), "changkun", []string{"pwd", "otp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disable := func(code string) int {
+		req := httptest.NewRequest("POST", "/account/totp", strings.NewReader(`{"action":"disable","code":"`+code+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		totpfunc(rr, req)
+		return rr.Code
+	}
+
+	// Guessing codes blocks the client, also for the right code.
+	for i := 0; i <= maxFailureAttempts; i++ {
+		if code := disable("x00000"); code != http.StatusBadRequest {
+			t.Fatalf("expect wrong code to be rejected, got %v", code)
+		}
+	}
+	key, _ := b32.DecodeString(secret)
+	if code := disable(totpCode(key, time.Now().Unix()/totpPeriod)); code != http.StatusUnauthorized {
+		t.Fatalf("expect blocked client to be rejected, got %v", code)
+	}
+	if acc, _ := lookupUser("changkun"); acc.TOTP == "" {
+		t.Fatalf("expect second factor to stay enabled")
+	}
+}
@@ -5,36 +5,143 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 )
 
-// readIP implements a best effort approach to return the real client IP.
-func readIP(r *http.Request) (ip string) {
-	ip = r.Header.Get("X-Forwarded-For")
-	ip = strings.TrimSpace(strings.Split(ip, ",")[0])
-	if ip == "" {
-		ip = strings.TrimSpace(r.Header.Get("X-Real-Ip"))
+// trustedProxies are the networks of the reverse proxies in front of
+// the login server, whose forwarding headers name the client. Other
+// peers could forge them.
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies loads the trusted proxies from
+// LOGIN_TRUSTED_PROXIES, a comma separated list of addresses and CIDR
+// blocks.
+func loadTrustedProxies() error {
+	trustedProxies = nil
+	warnForwarded = sync.Once{}
+	for _, s := range strings.Split(os.Getenv("LOGIN_TRUSTED_PROXIES"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid LOGIN_TRUSTED_PROXIES entry: %q", s)
+		}
+		trustedProxies = append(trustedProxies, n)
 	}
-	if ip != "" {
-		return ip
+	return nil
+}
+
+// trustedProxy reports whether ip is the address of a trusted proxy.
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
 	}
-	ip = r.Header.Get("X-Appengine-Remote-Addr")
-	if ip != "" {
-		return ip
+	for _, n := range trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
 	}
+	return false
+}
+
+// warnForwarded warns once about a reverse proxy that is not trusted,
+// as is the case if LOGIN_TRUSTED_PROXIES was forgotten.
+var warnForwarded sync.Once
+
+// readIP returns the address of the client of r. The forwarding
+// headers are only used if the peer is a trusted proxy, and the
+// client is the last address of X-Forwarded-For that is not a trusted
+// proxy itself, as the addresses before it could be forged.
+func readIP(r *http.Request) string {
 	ip, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
 	if err != nil {
 		return "unknown" // use unknown to guarantee non empty string
 	}
+	if !trustedProxy(ip) {
+		if len(trustedProxies) == 0 && r.Header.Get("X-Forwarded-For") != "" {
+			warnForwarded.Do(func() {
+				log.Printf("%s sends X-Forwarded-For, but LOGIN_TRUSTED_PROXIES is not set: "+
+					"all clients behind it share one address in rate limits and policies", ip)
+			})
+		}
+		return ip
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Real-Ip")); v != "" {
+		return v
+	}
 	return ip
 }
 
+// bearerToken returns the token of the Authorization header if it uses
+// the bearer scheme.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// secretParams are the query parameters that carry credentials, which
+// must not end up in the logs.
+var secretParams = map[string]bool{
+	"code":          true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token_hint": true,
+}
+
+// redactQuery returns the given raw query with the values of the
+// secretParams replaced by REDACTED.
+func redactQuery(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	parts := strings.Split(raw, "&")
+	for i, p := range parts {
+		k, _, ok := strings.Cut(p, "=")
+		if key, err := url.QueryUnescape(k); ok && (err != nil || secretParams[key]) {
+			parts[i] = k + "=REDACTED"
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
 func logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer log.Println(readIP(r), r.Method, r.URL.Path, r.URL.RawQuery)
+		defer log.Println(readIP(r), r.Method, r.URL.Path, redactQuery(r.URL.RawQuery))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadIP(t *testing.T) {
+	t.Setenv("LOGIN_TRUSTED_PROXIES", "10.0.0.1, 172.16.0.0/12")
+	if err := loadTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "192.0.2.1"},
+		{"192.0.2.1:1234", map[string]string{"X-Real-Ip": "203.0.113.7"}, "192.0.2.1"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", map[string]string{"X-Real-Ip": "203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		// Addresses before the last untrusted one could be forged.
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.7, 172.16.0.5"}, "203.0.113.7"},
+		{"10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "10.0.0.2"},
+		{"invalid", nil, "unknown"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.peer
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := readIP(req); got != tt.want {
+			t.Errorf("readIP from %s with %v = %q, want %q", tt.peer, tt.headers, got, tt.want)
+		}
+	}
+
+	t.Setenv("LOGIN_TRUSTED_PROXIES", "10.0.0.1/99")
+	if err := loadTrustedProxies(); err == nil {
+		t.Fatalf("expect invalid network to be rejected")
+	}
+
+	// A proxy that is not trusted is warned about once.
+	t.Setenv("LOGIN_TRUSTED_PROXIES", "")
+	if err := loadTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "172.18.0.2:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		if got := readIP(req); got != "172.18.0.2" {
+			t.Fatalf("expect the peer, got %q", got)
+		}
+	}
+	if n := strings.Count(buf.String(), "LOGIN_TRUSTED_PROXIES"); n != 1 {
+		t.Fatalf("expect one warning, got %q", buf.String())
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	tests := map[string]string{
+		"":                                   "",
+		"redirect=https%3A%2F%2Fchangkun.de": "redirect=https%3A%2F%2Fchangkun.de",
+		"x=1&code=abc&token=eyJ.x.y":         "x=1&code=REDACTED&token=REDACTED",
+		"refresh%5Ftoken=abc&state=s":        "refresh%5Ftoken=REDACTED&state=s",
+		"%zz=abc&token":                      "%zz=REDACTED&token",
+	}
+	for raw, want := range tests {
+		if got := redactQuery(raw); got != want {
+			t.Errorf("redactQuery(%q) = %q, want %q", raw, got, want)
+		}
+	}
+
+	// The access log of the server and the proxy leaves them out.
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	h := logging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page?code=secret-code&x=1", nil))
+	if strings.Contains(buf.String(), "secret-code") || !strings.Contains(buf.String(), "code=REDACTED&x=1") {
+		t.Fatalf("expect the code to be redacted, got %q", buf.String())
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// deviceGrantType is the grant type of the device flow, see RFC 8628.
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceLogin logs in with the device flow, for programs that run
+// without a browser, such as command line tools in an SSH session. It
+// prints the address of the login server and a code to w, which the
+// user opens and confirms in any logged in browser, and waits until
+// the user approved the login. The returned tokens are those of a new
+// login session, which can be renewed with Refresh.
+//
+// DeviceLogin returns ErrUnauthorized if the user denied the login or
+// did not approve it in time, which is ten minutes, and the error of
+// ctx if it is done first.
+func (c *Client) DeviceLogin(ctx context.Context, w io.Writer) (*Tokens, error) {
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	err := c.send(ctx, c.deviceCodeURL, "application/x-www-form-urlencoded", nil, "", &auth)
+	if err != nil {
+		return nil, err
+	}
+	if auth.DeviceCode == "" {
+		return nil, fmt.Errorf("%w: missing device code", ErrBadRequest)
+	}
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(w, "To log in, open %s\nand confirm the code %s.\n", auth.VerificationURIComplete, auth.UserCode)
+	} else {
+		fmt.Fprintf(w, "To log in, open %s\nand enter the code %s.\n", auth.VerificationURI, auth.UserCode)
+	}
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	body := []byte(url.Values{
+		"grant_type":  {deviceGrantType},
+		"device_code": {auth.DeviceCode},
+	}.Encode())
+	for {
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		var result struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		err := c.send(ctx, c.tokenURL, "application/x-www-form-urlencoded", body, "", &result)
+		var oerr *oauthError
+		switch {
+		case errors.As(err, &oerr) && oerr.code == "authorization_pending":
+			continue
+		case errors.As(err, &oerr) && oerr.code == "slow_down":
+			interval += 5 * time.Second
+			continue
+		case err != nil:
+			return nil, err
+		case result.AccessToken == "":
+			return nil, ErrUnauthorized
+		}
+		return &Tokens{
+			AccessToken:  result.AccessToken,
+			RefreshToken: result.RefreshToken,
+			ExpiresIn:    time.Duration(result.ExpiresIn) * time.Second,
+		}, nil
+	}
+}
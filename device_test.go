@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"changkun.de/x/login"
+)
+
+func TestDeviceLogin(t *testing.T) {
+	var polls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"device_code":"device","user_code":"BCDF-GHJK","verification_uri":"https://login.changkun.de/device",` +
+			`"verification_uri_complete":"https://login.changkun.de/device?user_code=BCDF-GHJK","expires_in":600,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		if r.PostFormValue("device_code") != "device" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"access_denied"}`))
+			return
+		}
+		if atomic.AddInt32(&polls, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"authorization_pending"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"good","token_type":"Bearer","expires_in":900,"refresh_token":"refresh"}`))
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	var out strings.Builder
+	tokens, err := c.DeviceLogin(context.Background(), &out)
+	if err != nil || tokens.AccessToken != "good" || tokens.RefreshToken != "refresh" {
+		t.Fatalf("unexpected tokens: %+v, %v", tokens, err)
+	}
+	if !strings.Contains(out.String(), "https://login.changkun.de/device?user_code=BCDF-GHJK") || atomic.LoadInt32(&polls) != 2 {
+		t.Fatalf("unexpected instructions or polls (%d): %q", polls, out.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.DeviceLogin(ctx, &out); !errors.Is(err, context.Canceled) && !errors.Is(err, login.ErrBadRequest) {
+		t.Fatalf("expect canceled login, got: %v", err)
+	}
+}
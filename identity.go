@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+// Identity describes a verified login token and the user it was
+// issued to. It has the same JSON form as the response of the verify
+// endpoint.
+type Identity struct {
+	Username  string `json:"username"`
+	TokenID   string `json:"jti,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+
+	// Subject is the user, or the client of a service token.
+	Subject string `json:"sub,omitempty"`
+
+	// AMR lists the methods the user authenticated with, see RFC 8176:
+	// "pwd" for a password and "otp" for a one-time code.
+	AMR []string `json:"amr,omitempty"`
+
+	// ClientID is set instead of Username if the token is a service
+	// token of a machine client, see ServiceTokenSource. Audience is
+	// the service the token was issued for, and empty if any service
+	// may accept it, see WithAudience.
+	ClientID string `json:"client_id,omitempty"`
+	Audience string `json:"aud,omitempty"`
+
+	// Roles and Groups are assigned to users on the login server, for
+	// instance the "admin" role. The verify endpoint returns the
+	// current ones, offline verification those at the time the token
+	// was issued.
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Extra are the custom claims of the user, which are returned like
+	// the roles and groups.
+	Extra map[string]string `json:"ext,omitempty"`
+}
+
+// HasAMR reports whether the user authenticated with the given method,
+// e.g. HasAMR("otp") for a second factor.
+func (id *Identity) HasAMR(method string) bool {
+	for _, m := range id.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the user has the given role.
+func (id *Identity) HasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasGroup reports whether the user is a member of the given group.
+func (id *Identity) HasGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package argon2 implements the Argon2id password hashing function as
+// specified in RFC 9106.
+package argon2
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	version     = 0x13
+	argon2id    = 2
+	syncPoints  = 4
+	blockLength = 128 // in uint64
+)
+
+type block [blockLength]uint64
+
+// IDKey derives a key of keyLen bytes from the password and salt with
+// Argon2id. time is the number of passes over the memory, memory the
+// memory size in KiB and threads the degree of parallelism.
+//
+// RFC 9106 recommends time=1 and memory=2*1024*1024 (2 GiB), or
+// time=3 and memory=64*1024 (64 MiB) if less memory is available.
+func IDKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	return deriveKey(password, salt, nil, nil, time, memory, threads, keyLen)
+}
+
+func deriveKey(password, salt, secret, data []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	if time < 1 {
+		panic("argon2: number of rounds too small")
+	}
+	if threads < 1 {
+		panic("argon2: parallelism degree too low")
+	}
+	h0 := initHash(password, salt, secret, data, time, memory, uint32(threads), keyLen)
+
+	memory = memory / (syncPoints * uint32(threads)) * (syncPoints * uint32(threads))
+	if memory < 2*syncPoints*uint32(threads) {
+		memory = 2 * syncPoints * uint32(threads)
+	}
+	B := initBlocks(h0, memory, uint32(threads))
+	processBlocks(B, time, memory, uint32(threads))
+	return extractKey(B, memory, uint32(threads), keyLen)
+}
+
+func le32(v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func initHash(password, salt, key, data []byte, time, memory, threads, keyLen uint32) []byte {
+	return blake2b(64,
+		le32(threads), le32(keyLen), le32(memory), le32(time), le32(version), le32(argon2id),
+		le32(uint32(len(password))), password,
+		le32(uint32(len(salt))), salt,
+		le32(uint32(len(key))), key,
+		le32(uint32(len(data))), data,
+	)
+}
+
+func initBlocks(h0 []byte, memory, threads uint32) []block {
+	B := make([]block, memory)
+	for lane := uint32(0); lane < threads; lane++ {
+		j := lane * (memory / threads)
+		for i := uint32(0); i < 2; i++ {
+			b := hashLong(1024, h0, le32(i), le32(lane))
+			for k := range B[j+i] {
+				B[j+i][k] = binary.LittleEndian.Uint64(b[k*8:])
+			}
+		}
+	}
+	return B
+}
+
+func processBlocks(B []block, time, memory, threads uint32) {
+	lanes := memory / threads
+	segments := lanes / syncPoints
+
+	processSegment := func(n, slice, lane uint32, wg *sync.WaitGroup) {
+		var addresses, in, zero block
+		// Argon2id uses data-independent addressing in the first half
+		// of the first pass, and data-dependent addressing afterwards.
+		independent := n == 0 && slice < syncPoints/2
+		if independent {
+			in[0] = uint64(n)
+			in[1] = uint64(lane)
+			in[2] = uint64(slice)
+			in[3] = uint64(memory)
+			in[4] = uint64(time)
+			in[5] = uint64(argon2id)
+		}
+
+		index := uint32(0)
+		if n == 0 && slice == 0 {
+			index = 2 // we have already generated the first two blocks
+			in[6]++
+			processBlock(&addresses, &in, &zero)
+			processBlock(&addresses, &addresses, &zero)
+		}
+
+		offset := lane*lanes + slice*segments + index
+		var random uint64
+		for index < segments {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += lanes // last block in lane
+			}
+			if independent {
+				if index%blockLength == 0 {
+					in[6]++
+					processBlock(&addresses, &in, &zero)
+					processBlock(&addresses, &addresses, &zero)
+				}
+				random = addresses[index%blockLength]
+			} else {
+				random = B[prev][0]
+			}
+			newOffset := indexAlpha(random, lanes, segments, threads, n, slice, lane, index)
+			processBlockXOR(&B[offset], &B[prev], &B[newOffset])
+			index, offset = index+1, offset+1
+		}
+		wg.Done()
+	}
+
+	for n := uint32(0); n < time; n++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go processSegment(n, slice, lane, &wg)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func extractKey(B []block, memory, threads, keyLen uint32) []byte {
+	lanes := memory / threads
+	for lane := uint32(0); lane < threads-1; lane++ {
+		for i, v := range B[(lane*lanes)+lanes-1] {
+			B[memory-1][i] ^= v
+		}
+	}
+
+	var b [1024]byte
+	for i, v := range B[memory-1] {
+		binary.LittleEndian.PutUint64(b[i*8:], v)
+	}
+	return hashLong(keyLen, b[:])
+}
+
+func indexAlpha(rand uint64, lanes, segments, threads, n, slice, lane, index uint32) uint32 {
+	refLane := uint32(rand>>32) % threads
+	if n == 0 && slice == 0 {
+		refLane = lane
+	}
+	m, s := 3*segments, ((slice+1)%syncPoints)*segments
+	if lane == refLane {
+		m += index
+	}
+	if n == 0 {
+		m, s = slice*segments, 0
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		m--
+	}
+	return phi(rand, uint64(m), uint64(s), refLane, lanes)
+}
+
+func phi(rand, m, s uint64, lane, lanes uint32) uint32 {
+	p := rand & 0xFFFFFFFF
+	p = (p * p) >> 32
+	p = (p * m) >> 32
+	return lane*lanes + uint32((s+m-(p+1))%uint64(lanes))
+}
+
+// hashLong is the variable-length hash function H' of RFC 9106,
+// Section 3.3.
+func hashLong(size uint32, in ...[]byte) []byte {
+	in = append([][]byte{le32(size)}, in...)
+	if size <= 64 {
+		return blake2b(int(size), in...)
+	}
+
+	out := make([]byte, 0, size)
+	v := blake2b(64, in...)
+	r := (size+31)/32 - 2
+	for i := uint32(0); i < r; i++ {
+		out = append(out, v[:32]...)
+		if i+1 < r {
+			v = blake2b(64, v)
+		}
+	}
+	return append(out, blake2b(int(size-32*r), v)...)
+}
+
+func processBlock(out, in1, in2 *block) {
+	processBlockGeneric(out, in1, in2, false)
+}
+
+func processBlockXOR(out, in1, in2 *block) {
+	processBlockGeneric(out, in1, in2, true)
+}
+
+func processBlockGeneric(out, in1, in2 *block, xor bool) {
+	var t block
+	for i := range t {
+		t[i] = in1[i] ^ in2[i]
+	}
+	for i := 0; i < blockLength; i += 16 {
+		blamka(
+			&t[i+0], &t[i+1], &t[i+2], &t[i+3],
+			&t[i+4], &t[i+5], &t[i+6], &t[i+7],
+			&t[i+8], &t[i+9], &t[i+10], &t[i+11],
+			&t[i+12], &t[i+13], &t[i+14], &t[i+15],
+		)
+	}
+	for i := 0; i < blockLength/8; i += 2 {
+		blamka(
+			&t[i], &t[i+1], &t[16+i], &t[16+i+1],
+			&t[32+i], &t[32+i+1], &t[48+i], &t[48+i+1],
+			&t[64+i], &t[64+i+1], &t[80+i], &t[80+i+1],
+			&t[96+i], &t[96+i+1], &t[112+i], &t[112+i+1],
+		)
+	}
+	if xor {
+		for i := range t {
+			out[i] ^= in1[i] ^ in2[i] ^ t[i]
+		}
+	} else {
+		for i := range t {
+			out[i] = in1[i] ^ in2[i] ^ t[i]
+		}
+	}
+}
+
+// blamka is the permutation P of RFC 9106, Section 3.6, with the
+// multiplication-hardened round function GB.
+func blamka(t00, t01, t02, t03, t04, t05, t06, t07, t08, t09, t10, t11, t12, t13, t14, t15 *uint64) {
+	gb(t00, t04, t08, t12)
+	gb(t01, t05, t09, t13)
+	gb(t02, t06, t10, t14)
+	gb(t03, t07, t11, t15)
+	gb(t00, t05, t10, t15)
+	gb(t01, t06, t11, t12)
+	gb(t02, t07, t08, t13)
+	gb(t03, t04, t09, t14)
+}
+
+func gb(a, b, c, d *uint64) {
+	fBlaMka := func(x, y uint64) uint64 {
+		return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+	}
+	*a = fBlaMka(*a, *b)
+	*d ^= *a
+	*d = *d>>32 | *d<<32
+	*c = fBlaMka(*c, *d)
+	*b ^= *c
+	*b = *b>>24 | *b<<40
+	*a = fBlaMka(*a, *b)
+	*d ^= *a
+	*d = *d>>16 | *d<<48
+	*c = fBlaMka(*c, *d)
+	*b ^= *c
+	*b = *b>>63 | *b<<1
+}
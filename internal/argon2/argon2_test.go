@@ -0,0 +1,44 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package argon2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBlake2b(t *testing.T) {
+	tests := []struct {
+		size int
+		in   []byte
+		want string
+	}{
+		{64, []byte("abc"), "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{64, nil, "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		{20, bytes.Repeat([]byte("x"), 300), "5cdff8b6d7145ae42f4dabf69e299160b8ce7a30"},
+		{64, bytes.Repeat([]byte("y"), 256), "88fae5ed39dccbc801bee57a2bf4f1337e570b2c1a39f4062cfcf5dcb8e2b52fb4b794c857c030e78fa66e9b33568741488506f3ddaf5744ec1504d783b16fbf"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(blake2b(tt.size, tt.in)); got != tt.want {
+			t.Errorf("blake2b(%d, %d bytes) = %s, want %s", tt.size, len(tt.in), got, tt.want)
+		}
+	}
+}
+
+// TestRFC9106 checks the Argon2id test vector of RFC 9106, Section 5.3.
+func TestRFC9106(t *testing.T) {
+	got := deriveKey(
+		bytes.Repeat([]byte{0x01}, 32),
+		bytes.Repeat([]byte{0x02}, 16),
+		bytes.Repeat([]byte{0x03}, 8),
+		bytes.Repeat([]byte{0x04}, 12),
+		3, 32, 4, 32,
+	)
+	want := "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("unexpected tag: got %x want %s", got, want)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package jwk implements the subset of JSON Web Keys (RFC 7517) that
+// is needed to publish and consume the public signing keys of the
+// login server.
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key is a public JSON Web Key.
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// OKP and EC keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	// RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// Set is a JSON Web Key Set.
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// New returns the JSON Web Key of the given public key. The key must
+// be an ed25519.PublicKey, *ecdsa.PublicKey or *rsa.PublicKey.
+func New(kid, alg string, pub crypto.PublicKey) (Key, error) {
+	k := Key{Kid: kid, Use: "sig", Alg: alg}
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		k.Kty = "OKP"
+		k.Crv = "Ed25519"
+		k.X = b64.EncodeToString(pub)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k.Kty = "EC"
+		k.Crv = pub.Curve.Params().Name
+		k.X = b64.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		k.Y = b64.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = b64.EncodeToString(pub.N.Bytes())
+		k.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return Key{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return k, nil
+}
+
+// PublicKey returns the public key described by k.
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return pub, nil
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// Thumbprint returns the JWK thumbprint of k as defined by RFC 7638,
+// which is suitable as a key ID.
+func Thumbprint(k Key) string {
+	// The members must be in lexicographic order and the JSON must
+	// not contain whitespace, see RFC 7638, Section 3.2.
+	var s string
+	switch k.Kty {
+	case "OKP":
+		s = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.Kty, k.N)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return b64.EncodeToString(sum[:])
+}
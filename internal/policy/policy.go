@@ -0,0 +1,627 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package policy implements the expression language of access rules,
+// which decide whether a user may access a service. An expression is
+// evaluated over the claims of the user, the IP address of the
+// request, the time and the service, for instance
+//
+//	"admin" in roles ||
+//		"contractors" in groups && inNetwork(ip, "10.1.0.0/16") &&
+//		!(weekday in ["Saturday", "Sunday"])
+//
+// allows admins at any time, and contractors only from the office
+// network and only on weekdays.
+//
+// The language is small and sandboxed: expressions cannot loop, assign
+// or reach anything but their input, are type checked when they are
+// compiled, and take time linear in their length to evaluate. The
+// grammar is
+//
+//	expr    = and { "||" and }
+//	and     = not { "&&" not }
+//	not     = "!" not | compare
+//	compare = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) operand ]
+//	operand = string | number | "true" | "false" | variable |
+//	          function "(" [ list ] ")" | "[" [ list ] "]" | "(" expr ")"
+//	list    = expr { "," expr }
+//
+// where strings are double-quoted Go strings and numbers are decimal
+// integers. Strings, numbers and booleans compare with == and !=,
+// numbers also with <, <=, > and >=, and "in" tests whether a string is
+// an element of a list of strings.
+//
+// The variables are
+//
+//	user     string  the username
+//	roles    list    the roles of the user
+//	groups   list    the groups of the user
+//	amr      list    the authentication methods, such as "pwd" or "otp"
+//	ip       string  the IP address of the request
+//	service  string  the service that is accessed
+//	weekday  string  the day of the week, "Monday" to "Sunday"
+//	hour     number  the hour of the day, 0 to 23
+//
+// where weekday and hour are in the location of the time of the input,
+// and the functions are
+//
+//	inNetwork(ip, network...)  whether ip is in one of the networks,
+//	                           which are CIDR blocks or addresses
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLength is the maximum length of an expression.
+	maxLength = 4096
+	// maxDepth is the maximum nesting depth of an expression.
+	maxDepth = 32
+)
+
+// Input is what an expression is evaluated over.
+type Input struct {
+	User    string
+	Roles   []string
+	Groups  []string
+	AMR     []string
+	IP      string
+	Service string
+	Time    time.Time
+}
+
+// Expr is a compiled expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses and type checks the given expression, which must be
+// a boolean expression.
+func Compile(src string) (*Expr, error) {
+	if len(src) > maxLength {
+		return nil, fmt.Errorf("expression longer than %d bytes", maxLength)
+	}
+	toks, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	if root.typ() != typeBool {
+		return nil, fmt.Errorf("expression is a %s, not a bool", root.typ())
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// Eval reports whether the expression is true for the given input.
+func (e *Expr) Eval(in *Input) bool {
+	return e.root.eval(in).(bool)
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string { return e.src }
+
+// typ is the type of a value. Values are represented by string, int,
+// bool and []string.
+type typ int
+
+const (
+	typeString typ = iota
+	typeNumber
+	typeBool
+	typeList
+)
+
+func (t typ) String() string {
+	return [...]string{"string", "number", "bool", "list"}[t]
+}
+
+// variables are the variables of expressions.
+var variables = map[string]struct {
+	typ typ
+	get func(in *Input) interface{}
+}{
+	"user":    {typeString, func(in *Input) interface{} { return in.User }},
+	"roles":   {typeList, func(in *Input) interface{} { return in.Roles }},
+	"groups":  {typeList, func(in *Input) interface{} { return in.Groups }},
+	"amr":     {typeList, func(in *Input) interface{} { return in.AMR }},
+	"ip":      {typeString, func(in *Input) interface{} { return in.IP }},
+	"service": {typeString, func(in *Input) interface{} { return in.Service }},
+	"weekday": {typeString, func(in *Input) interface{} { return in.Time.Weekday().String() }},
+	"hour":    {typeNumber, func(in *Input) interface{} { return in.Time.Hour() }},
+}
+
+// functions are the functions of expressions. A function has at least
+// as many arguments as params, and the last one may repeat.
+var functions = map[string]struct {
+	params []typ
+	result typ
+	check  func(args []node) error
+	call   func(args []interface{}) interface{}
+}{
+	"inNetwork": {[]typ{typeString, typeString}, typeBool, checkNetworks, inNetwork},
+}
+
+// checkNetworks rejects networks of inNetwork that are literals but
+// no valid networks, as they would never match.
+func checkNetworks(args []node) error {
+	for _, a := range args[1:] {
+		if l, ok := a.(*literal); ok {
+			if _, err := parseNetwork(l.v.(string)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func inNetwork(args []interface{}) interface{} {
+	ip := net.ParseIP(args[0].(string))
+	if ip == nil {
+		return false
+	}
+	for _, a := range args[1:] {
+		n, err := parseNetwork(a.(string))
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetwork parses a CIDR block, or an address as the block that
+// only contains the address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network: %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// node is a type checked node of the syntax tree. eval returns a value
+// of the type of the node.
+type node interface {
+	typ() typ
+	eval(in *Input) interface{}
+}
+
+type literal struct {
+	t typ
+	v interface{}
+}
+
+func (n *literal) typ() typ                   { return n.t }
+func (n *literal) eval(in *Input) interface{} { return n.v }
+
+type variable struct {
+	t   typ
+	get func(in *Input) interface{}
+}
+
+func (n *variable) typ() typ                   { return n.t }
+func (n *variable) eval(in *Input) interface{} { return n.get(in) }
+
+type list struct {
+	elems []node
+}
+
+func (n *list) typ() typ { return typeList }
+func (n *list) eval(in *Input) interface{} {
+	l := make([]string, len(n.elems))
+	for i, e := range n.elems {
+		l[i] = e.eval(in).(string)
+	}
+	return l
+}
+
+type call struct {
+	t    typ
+	fn   func(args []interface{}) interface{}
+	args []node
+}
+
+func (n *call) typ() typ { return n.t }
+func (n *call) eval(in *Input) interface{} {
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		args[i] = a.eval(in)
+	}
+	return n.fn(args)
+}
+
+type not struct {
+	x node
+}
+
+func (n *not) typ() typ                   { return typeBool }
+func (n *not) eval(in *Input) interface{} { return !n.x.eval(in).(bool) }
+
+type binary struct {
+	op   string
+	x, y node
+}
+
+func (n *binary) typ() typ { return typeBool }
+func (n *binary) eval(in *Input) interface{} {
+	switch n.op {
+	case "||":
+		return n.x.eval(in).(bool) || n.y.eval(in).(bool)
+	case "&&":
+		return n.x.eval(in).(bool) && n.y.eval(in).(bool)
+	case "in":
+		s := n.x.eval(in).(string)
+		for _, e := range n.y.eval(in).([]string) {
+			if e == s {
+				return true
+			}
+		}
+		return false
+	}
+	x, y := n.x.eval(in), n.y.eval(in)
+	switch n.op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	case "<":
+		return x.(int) < y.(int)
+	case "<=":
+		return x.(int) <= y.(int)
+	case ">":
+		return x.(int) > y.(int)
+	default: // ">="
+		return x.(int) >= y.(int)
+	}
+}
+
+// parser is a recursive descent parser of expressions, which type
+// checks the nodes it creates.
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given operator or
+// keyword.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokOp || t.kind == tokName) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("%d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expr() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, p.errorf(p.peek(), "expression nested too deeply")
+	}
+
+	x, err := p.and()
+	for err == nil {
+		t := p.peek()
+		if !p.accept("||") {
+			break
+		}
+		var y node
+		y, err = p.and()
+		if err == nil {
+			x, err = p.logical(t, x, y)
+		}
+	}
+	return x, err
+}
+
+func (p *parser) and() (node, error) {
+	x, err := p.not()
+	for err == nil {
+		t := p.peek()
+		if !p.accept("&&") {
+			break
+		}
+		var y node
+		y, err = p.not()
+		if err == nil {
+			x, err = p.logical(t, x, y)
+		}
+	}
+	return x, err
+}
+
+// logical returns the node of the logical operator t.
+func (p *parser) logical(t token, x, y node) (node, error) {
+	if x.typ() != typeBool || y.typ() != typeBool {
+		return nil, p.errorf(t, "invalid operands of %s: %s and %s", t.text, x.typ(), y.typ())
+	}
+	return &binary{op: t.text, x: x, y: y}, nil
+}
+
+func (p *parser) not() (node, error) {
+	t := p.peek()
+	if !p.accept("!") {
+		return p.compare()
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, p.errorf(t, "expression nested too deeply")
+	}
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != typeBool {
+		return nil, p.errorf(t, "invalid operand of !: %s", x.typ())
+	}
+	return &not{x}, nil
+}
+
+func (p *parser) compare() (node, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" ||
+		t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+	case t.kind == tokName && t.text == "in":
+	default:
+		return x, nil
+	}
+	p.next()
+	y, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	switch t.text {
+	case "in":
+		ok = x.typ() == typeString && y.typ() == typeList
+	case "==", "!=":
+		ok = x.typ() == y.typ() && x.typ() != typeList
+	default:
+		ok = x.typ() == typeNumber && y.typ() == typeNumber
+	}
+	if !ok {
+		return nil, p.errorf(t, "invalid operands of %s: %s and %s", t.text, x.typ(), y.typ())
+	}
+	return &binary{op: t.text, x: x, y: y}, nil
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literal{typeString, t.text}, nil
+	case tokNumber:
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number: %s", t.text)
+		}
+		return &literal{typeNumber, n}, nil
+	case tokName:
+		switch t.text {
+		case "true":
+			return &literal{typeBool, true}, nil
+		case "false":
+			return &literal{typeBool, false}, nil
+		case "in":
+			return nil, p.errorf(t, "unexpected %s", t)
+		}
+		if p.accept("(") {
+			return p.call(t)
+		}
+		v, ok := variables[t.text]
+		if !ok {
+			return nil, p.errorf(t, "unknown variable %s", t.text)
+		}
+		return &variable{v.typ, v.get}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, p.errorf(p.peek(), "expected ), found %s", p.peek())
+			}
+			return x, nil
+		case "[":
+			elems, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range elems {
+				if e.typ() != typeString {
+					return nil, p.errorf(t, "list of %s, only lists of strings are supported", e.typ())
+				}
+			}
+			return &list{elems}, nil
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// call parses the arguments of a call of the function name, whose
+// opening parenthesis was consumed.
+func (p *parser) call(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %s", name.text)
+	}
+	args, err := p.list(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < len(fn.params) {
+		return nil, p.errorf(name, "not enough arguments in call to %s", name.text)
+	}
+	for i, a := range args {
+		want := fn.params[len(fn.params)-1]
+		if i < len(fn.params) {
+			want = fn.params[i]
+		}
+		if a.typ() != want {
+			return nil, p.errorf(name, "argument %d of %s is a %s, not a %s", i+1, name.text, a.typ(), want)
+		}
+	}
+	if fn.check != nil {
+		if err := fn.check(args); err != nil {
+			return nil, p.errorf(name, "%v", err)
+		}
+	}
+	return &call{fn.result, fn.call, args}, nil
+}
+
+// list parses a comma separated list of expressions up to the given
+// closing token.
+func (p *parser) list(end string) ([]node, error) {
+	var elems []node
+	if p.accept(end) {
+		return elems, nil
+	}
+	for {
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, x)
+		if p.accept(end) {
+			return elems, nil
+		}
+		if !p.accept(",") {
+			return nil, p.errorf(p.peek(), "expected , or %s, found %s", end, p.peek())
+		}
+	}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // the value of strings
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+// operators are the operators and punctuation of expressions, longer
+// ones first.
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+// scan splits src into tokens, which end with an EOF token.
+func scan(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, token{tokName, src[i:j], i})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			toks = append(toks, token{tokNumber, src[i:j], i})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("%d: unterminated string", i+1)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("%d: invalid string: %s", i+1, src[i:j+1])
+			}
+			toks = append(toks, token{tokString, s, i})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%d: unexpected character %q", i+1, c)
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+func isLetter(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' }
+func isDigit(c byte) bool  { return '0' <= c && c <= '9' }
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	// 2021-06-07 is a Monday.
+	monday := time.Date(2021, 6, 7, 10, 30, 0, 0, time.UTC)
+	sunday := monday.AddDate(0, 0, 6)
+	office := `"admin" in roles ||
+		"contractors" in groups && inNetwork(ip, "10.1.0.0/16") && !(weekday in ["Saturday", "Sunday"])`
+
+	for _, tt := range []struct {
+		expr string
+		in   Input
+		want bool
+	}{
+		{office, Input{Roles: []string{"admin"}, IP: "1.2.3.4", Time: sunday}, true},
+		{office, Input{Groups: []string{"contractors"}, IP: "10.1.2.3", Time: monday}, true},
+		{office, Input{Groups: []string{"contractors"}, IP: "10.2.0.1", Time: monday}, false},
+		{office, Input{Groups: []string{"contractors"}, IP: "10.1.2.3", Time: sunday}, false},
+		{office, Input{IP: "10.1.2.3", Time: monday}, false},
+		{`user == "changkun" && service != "wiki"`, Input{User: "changkun", Service: "blog"}, true},
+		{`hour >= 9 && hour < 18`, Input{Time: monday}, true},
+		{`hour > 10 || hour <= 9`, Input{Time: monday}, false},
+		{`"otp" in amr || "hwk" in amr`, Input{AMR: []string{"pwd", "otp"}}, true},
+		{`!!true && !false`, Input{}, true},
+		{`user in []`, Input{}, false},
+		{`inNetwork(ip, "::1", "192.168.1.1")`, Input{IP: "192.168.1.1"}, true},
+		{`inNetwork(ip, "10.0.0.0/8")`, Input{IP: "not an ip"}, false},
+		{`inNetwork(ip, service)`, Input{IP: "10.0.0.1", Service: "wiki"}, false},
+		{`user == "say \"hi\""`, Input{User: `say "hi"`}, true},
+	} {
+		e, err := Compile(tt.expr)
+		if err != nil {
+			t.Fatalf("failed to compile %s: %v", tt.expr, err)
+		}
+		if got := e.Eval(&tt.in); got != tt.want {
+			t.Errorf("%s with %+v: got %v want %v", tt.expr, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		err  string
+	}{
+		{``, "unexpected end of expression"},
+		{`user`, "expression is a string, not a bool"},
+		{`role == "admin"`, "unknown variable role"},
+		{`exec("rm")`, "unknown function exec"},
+		{`roles in groups`, "invalid operands of in: list and list"},
+		{`hour == "9"`, "invalid operands of ==: number and string"},
+		{`roles == groups`, "invalid operands of ==: list and list"},
+		{`user < "m"`, "invalid operands of <: string and string"},
+		{`user && true`, "invalid operands of &&: string and bool"},
+		{`!user`, "invalid operand of !: string"},
+		{`user in [1]`, "only lists of strings are supported"},
+		{`inNetwork(ip)`, "not enough arguments"},
+		{`inNetwork(ip, "10.0.0.0/33")`, "invalid CIDR address"},
+		{`inNetwork(hour, "10.0.0.0/8")`, "argument 1 of inNetwork is a number"},
+		{`(true`, "expected ), found end of expression"},
+		{`true true`, "unexpected true"},
+		{`user == "open`, "unterminated string"},
+		{`user == 'x'`, "unexpected character"},
+		{strings.Repeat("(", 40) + "true" + strings.Repeat(")", 40), "nested too deeply"},
+		{strings.Repeat("!", 40) + "true", "nested too deeply"},
+		{strings.Repeat("true || ", 1000) + "true", "longer than"},
+	} {
+		_, err := Compile(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expect error %q, got %v", tt.expr, tt.err, err)
+		}
+	}
+}
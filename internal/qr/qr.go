@@ -0,0 +1,441 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package qr encodes short texts, such as otpauth:// URIs, as QR codes
+// (ISO/IEC 18004) and renders them as SVG images.
+//
+// Only byte mode, error correction level M and versions 1 to 10 are
+// supported, which is enough for up to 213 bytes of text.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	Size    int      // number of modules per side
+	modules [][]bool // [y][x], true is dark
+}
+
+// Dark reports whether the module at column x and row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// ErrTooLong is returned if the text does not fit into a supported
+// QR code version.
+var ErrTooLong = errors.New("qr: text too long")
+
+// version describes the error correction blocks of a version at
+// level M: n1 blocks of d1 data codewords, followed by n2 blocks of
+// d1+1 data codewords, each with ec error correction codewords.
+type version struct {
+	ec, n1, d1, n2 int
+	align          []int
+}
+
+var versions = [...]version{
+	1:  {10, 1, 16, 0, nil},
+	2:  {16, 1, 28, 0, []int{6, 18}},
+	3:  {26, 1, 44, 0, []int{6, 22}},
+	4:  {18, 2, 32, 0, []int{6, 26}},
+	5:  {24, 2, 43, 0, []int{6, 30}},
+	6:  {16, 4, 27, 0, []int{6, 34}},
+	7:  {18, 4, 31, 0, []int{6, 22, 38}},
+	8:  {22, 2, 38, 2, []int{6, 24, 42}},
+	9:  {22, 3, 36, 2, []int{6, 26, 46}},
+	10: {26, 4, 43, 1, []int{6, 28, 50}},
+}
+
+func (v version) dataLen() int {
+	return v.n1*v.d1 + v.n2*(v.d1+1)
+}
+
+// Encode encodes text into the smallest QR code that can hold it.
+func Encode(text string) (*Code, error) {
+	for ver := 1; ver < len(versions); ver++ {
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) > 8*versions[ver].dataLen() {
+			continue
+		}
+		return encode(ver, countBits, []byte(text)), nil
+	}
+	return nil, ErrTooLong
+}
+
+func encode(ver, countBits int, data []byte) *Code {
+	v := versions[ver]
+
+	// Segment in byte mode, terminator and padding.
+	var bb bitBuffer
+	bb.append(0b0100, 4)
+	bb.append(uint32(len(data)), countBits)
+	for _, b := range data {
+		bb.append(uint32(b), 8)
+	}
+	capacity := 8 * v.dataLen()
+	term := capacity - len(bb)
+	if term > 4 {
+		term = 4
+	}
+	bb.append(0, term)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := uint32(0xEC); len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	c := &Code{Size: 17 + 4*ver}
+	c.modules = make([][]bool, c.Size)
+	isFunction := make([][]bool, c.Size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, c.Size)
+		isFunction[i] = make([]bool, c.Size)
+	}
+	c.drawFunctionPatterns(ver, isFunction)
+	c.drawCodewords(interleave(v, codewords), isFunction)
+
+	// Choose the mask with the lowest penalty.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask, isFunction)
+		c.drawFormatBits(mask, isFunction)
+		p := c.penalty()
+		if bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask, isFunction) // undo
+	}
+	c.applyMask(best, isFunction)
+	c.drawFormatBits(best, isFunction)
+	return c
+}
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(val uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, (val>>uint(i))&1 != 0)
+	}
+}
+
+// interleave splits the data into blocks, appends the error correction
+// codewords to each block and interleaves the blocks.
+func interleave(v version, data []byte) []byte {
+	var blocks, ecs [][]byte
+	for i := 0; i < v.n1+v.n2; i++ {
+		n := v.d1
+		if i >= v.n1 {
+			n++
+		}
+		blocks = append(blocks, data[:n])
+		ecs = append(ecs, reedSolomon(data[:n], v.ec))
+		data = data[n:]
+	}
+
+	var out []byte
+	for i := 0; i <= v.d1; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// reedSolomon returns the n error correction codewords of data.
+func reedSolomon(data []byte, n int) []byte {
+	// Generator polynomial (x - a^0)(x - a^1)...(x - a^(n-1)), with
+	// the leading coefficient omitted.
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+
+	rem := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+func (c *Code) set(x, y int, dark bool, isFunction [][]bool) {
+	c.modules[y][x] = dark
+	isFunction[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns(ver int, isFunction [][]bool) {
+	// Timing patterns.
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0, isFunction)
+		c.set(i, 6, i%2 == 0, isFunction)
+	}
+
+	// Finder patterns with separators.
+	for _, p := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := p[0]+dx, p[1]+dy
+				if x < 0 || x >= c.Size || y < 0 || y >= c.Size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				c.set(x, y, d != 2 && d != 4, isFunction)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they overlap finder patterns.
+	align := versions[ver].align
+	for i, ax := range align {
+		for j, ay := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1, isFunction)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information areas.
+	c.drawFormatBits(0, isFunction)
+
+	// Version information.
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := c.Size-11+i%3, i/3
+			c.set(a, b, dark, isFunction)
+			c.set(b, a, dark, isFunction)
+		}
+	}
+}
+
+// formatBits returns the 15 bit format information for level M and
+// the given mask.
+func formatBits(mask int) int {
+	data := 0b00<<3 | mask // level M
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(mask int, isFunction [][]bool) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// First copy, around the top left finder pattern.
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i), isFunction)
+	}
+	c.set(8, 7, bit(6), isFunction)
+	c.set(8, 8, bit(7), isFunction)
+	c.set(7, 8, bit(8), isFunction)
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i), isFunction)
+	}
+
+	// Second copy, split between the other finder patterns.
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i), isFunction)
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i), isFunction)
+	}
+	c.set(8, c.Size-8, true, isFunction) // dark module
+}
+
+// drawCodewords places the codewords in the zigzag order, starting at
+// the bottom right corner.
+func (c *Code) drawCodewords(data []byte, isFunction [][]bool) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert // upward
+				}
+				if !isFunction[y][x] && i < len(data)*8 {
+					c.modules[y][x] = (data[i>>3]>>(7-uint(i&7)))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int, isFunction [][]bool) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !isFunction[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the code according to the mask evaluation rules of
+// ISO/IEC 18004, Section 7.8.3. Lower is better.
+func (c *Code) penalty() int {
+	const n1, n2, n3, n4 = 3, 3, 40, 10
+	result := 0
+
+	line := func(get func(i int) bool) {
+		var sb strings.Builder
+		run := 1
+		for i := 0; i < c.Size; i++ {
+			if get(i) {
+				sb.WriteByte('1')
+			} else {
+				sb.WriteByte('0')
+			}
+			if i == 0 {
+				continue
+			}
+			if get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				result += n1 + run - 5
+			}
+			run = 1
+		}
+		if run >= 5 {
+			result += n1 + run - 5
+		}
+		s := "0000" + sb.String() + "0000"
+		result += n3 * (strings.Count(s, "10111010000") + strings.Count(s, "00001011101"))
+	}
+	for y := 0; y < c.Size; y++ {
+		line(func(x int) bool { return c.modules[y][x] })
+	}
+	for x := 0; x < c.Size; x++ {
+		line(func(y int) bool { return c.modules[y][x] })
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					result += n2
+				}
+			}
+		}
+	}
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return result + k*n4
+}
+
+// SVG renders the code as an SVG image with a quiet zone of four
+// modules. The image scales to the size of its container.
+func (c *Code) SVG() string {
+	const quiet = 4
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	n := c.Size + 2*quiet
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`, n, n, path.String())
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
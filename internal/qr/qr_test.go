@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// The "HELLO WORLD" 1-M example of ISO/IEC 18004, Annex I.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomon(data, 10); !bytes.Equal(got, want) {
+		t.Fatalf("unexpected error correction codewords, want %v, got %v", want, got)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	if got := formatBits(0); got != 0b101010000010010 {
+		t.Fatalf("unexpected format bits for M and mask 0: %015b", got)
+	}
+
+	c, err := Encode(strings.Repeat("a", 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != 45 {
+		t.Fatalf("expect version 7, got size %v", c.Size)
+	}
+	// The version information of version 7 is 0x07C94, placed above
+	// the bottom left finder pattern.
+	got := 0
+	for i := 17; i >= 0; i-- {
+		got <<= 1
+		if c.Dark(i/3, c.Size-11+i%3) {
+			got |= 1
+		}
+	}
+	if got != 0x07C94 {
+		t.Fatalf("unexpected version information: %#05x", got)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		n    int
+		size int
+	}{
+		{0, 21}, {14, 21}, {15, 25}, {106, 41}, {213, 57},
+	}
+	for _, tt := range tests {
+		c, err := Encode(strings.Repeat("x", tt.n))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tt.n, err)
+		}
+		if c.Size != tt.size {
+			t.Fatalf("%d bytes: expect size %d, got %d", tt.n, tt.size, c.Size)
+		}
+		// The dark module is always set.
+		if !c.Dark(8, c.Size-8) {
+			t.Fatalf("%d bytes: dark module is not set", tt.n)
+		}
+	}
+	if _, err := Encode(strings.Repeat("x", 214)); err != ErrTooLong {
+		t.Fatalf("expect ErrTooLong, got %v", err)
+	}
+
+	c, _ := Encode("otpauth://totp/login.changkun.de:changkun?secret=JBSWY3DPEHPK3PXP")
+	if svg := c.SVG(); !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, "M4,4h1v1h-1z") {
+		t.Fatalf("unexpected SVG output: %s", svg)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+// maxDepth limits the nesting of decoded CBOR items.
+const maxDepth = 16
+
+// decodeCBOR decodes the first CBOR item (RFC 8949) of b and returns
+// it with the remaining bytes. Only the subset used by WebAuthn is
+// supported: integers as int64, byte strings as []byte, text strings
+// as string, arrays as []interface{}, maps as map[interface{}]interface{}
+// and the simple values false, true and null.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBOR, info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(b) >= 1:
+		n, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		n, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		n, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		n, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported length encoding", errCBOR)
+	}
+
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(n), b, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if n > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		if major == 3 {
+			return string(b[:n]), b[n:], nil
+		}
+		return b[:n:n], b[n:], nil
+	case 4:
+		if n > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var v interface{}
+			var err error
+			v, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, b, nil
+	case 5:
+		if n > uint64(len(b)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			var err error
+			k, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			v, b, err = decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
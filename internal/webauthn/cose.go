@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers supported for credential public keys.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms are the supported COSE algorithms in order of preference,
+// as announced to authenticators during registration.
+var Algorithms = []int{AlgEdDSA, AlgES256, AlgRS256}
+
+var errKey = errors.New("webauthn: unsupported public key")
+
+// publicKey is a parsed COSE_Key (RFC 9052, Section 7).
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey parses the COSE encoding of a credential public key.
+func parsePublicKey(b []byte) (*publicKey, []byte, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errKey
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	y, _ := m[int64(-3)].([]byte)
+
+	switch {
+	case kty == 2 && alg == AlgES256 && crv == 1 && len(x) == 32 && len(y) == 32:
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, fmt.Errorf("%w: point not on curve", errKey)
+		}
+		return &publicKey{alg, pub}, rest, nil
+	case kty == 1 && alg == AlgEdDSA && crv == 6 && len(x) == ed25519.PublicKeySize:
+		return &publicKey{alg, ed25519.PublicKey(x)}, rest, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, fmt.Errorf("%w: invalid RSA key", errKey)
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n)}
+		for _, b := range e {
+			pub.E = pub.E<<8 | int(b)
+		}
+		return &publicKey{alg, pub}, rest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: kty %d, alg %d", errKey, kty, alg)
+}
+
+// verify checks the signature of the authenticator over data.
+func (k *publicKey) verify(data, sig []byte) bool {
+	switch pub := k.key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig)
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, h[:], sig)
+	case *rsa.PublicKey:
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies, see
+// https://www.w3.org/TR/webauthn-2/.
+//
+// Attestation statements are not verified: the relying party asks for
+// "none" attestation and trusts any authenticator the user registers.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the ceremonies. All of them wrap ErrInvalid.
+var (
+	ErrInvalid   = errors.New("webauthn: invalid response")
+	ErrSignCount = fmt.Errorf("%w: signature counter did not increase, the authenticator may be cloned", ErrInvalid)
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// RelyingParty is a website that users authenticate to.
+type RelyingParty struct {
+	ID     string // RP ID, the domain of the origin or a suffix of it
+	Name   string // human readable name
+	Origin string // origin of the pages that run the ceremonies
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID        []byte // credential ID chosen by the authenticator
+	PublicKey []byte // COSE encoded public key
+	SignCount uint32 // signature counter of the last ceremony
+}
+
+// Assertion is the result of a successful authentication.
+type Assertion struct {
+	SignCount    uint32 // new signature counter of the credential
+	UserVerified bool   // whether the authenticator verified the user, e.g. by PIN or biometrics
+}
+
+// NewChallenge returns a new random challenge.
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Challenge returns the challenge that the client data of a response
+// claims to answer, so that the relying party can look up the state
+// of the ceremony. The response must still be verified.
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return b, nil
+}
+
+func (rp *RelyingParty) checkClientData(b []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(b, &cd); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: unexpected type %q", ErrInvalid, cd.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalid)
+	}
+	if cd.Origin != rp.Origin || cd.CrossOrigin {
+		return fmt.Errorf("%w: unexpected origin %q", ErrInvalid, cd.Origin)
+	}
+	return nil
+}
+
+type authData struct {
+	flags     byte
+	signCount uint32
+	credID    []byte
+	publicKey []byte
+}
+
+// parseAuthData parses the authenticator data and checks that it is
+// meant for the relying party and that the user was present.
+func (rp *RelyingParty) parseAuthData(b []byte) (*authData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalid)
+	}
+	h := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(b[:32], h[:]) {
+		return nil, fmt.Errorf("%w: unexpected RP ID hash", ErrInvalid)
+	}
+	ad := &authData{flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalid)
+	}
+	if ad.flags&flagAttested == 0 {
+		return ad, nil
+	}
+
+	// Attested credential data: AAGUID, credential ID and public key.
+	b = b[37:]
+	if len(b) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalid)
+	}
+	n := int(binary.BigEndian.Uint16(b[16:18]))
+	b = b[18:]
+	if n == 0 || n > 1023 || len(b) < n {
+		return nil, fmt.Errorf("%w: invalid credential ID", ErrInvalid)
+	}
+	ad.credID = b[:n:n]
+	b = b[n:]
+	_, rest, err := parsePublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	ad.publicKey = b[: len(b)-len(rest) : len(b)-len(rest)]
+	return ad, nil
+}
+
+// Register verifies the response of navigator.credentials.create to
+// the given challenge and returns the new credential.
+func (rp *RelyingParty) Register(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	obj, _ := v.(map[interface{}]interface{})
+	raw, _ := obj["authData"].([]byte)
+	ad, err := rp.parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credID == nil {
+		return nil, fmt.Errorf("%w: missing attested credential data", ErrInvalid)
+	}
+	return &Credential{
+		ID:        append([]byte(nil), ad.credID...),
+		PublicKey: append([]byte(nil), ad.publicKey...),
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// Login verifies the response of navigator.credentials.get to the
+// given challenge, which must be signed by the given credential. The
+// caller must store the returned signature counter.
+func (rp *RelyingParty) Login(cred *Credential, challenge, clientDataJSON, authenticatorData, signature []byte) (*Assertion, error) {
+	err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := rp.parseAuthData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	h := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), h[:]...)
+	if !pub.verify(signed, signature) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalid)
+	}
+
+	// Authenticators without a counter always report zero.
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return nil, ErrSignCount
+	}
+	return &Assertion{
+		SignCount:    ad.signCount,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
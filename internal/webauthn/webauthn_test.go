@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package webauthn_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"changkun.de/x/login/internal/webauthn"
+	"changkun.de/x/login/internal/webauthn/webauthntest"
+)
+
+func TestCeremonies(t *testing.T) {
+	rp := &webauthn.RelyingParty{ID: "login.changkun.de", Origin: "https://login.changkun.de"}
+
+	for _, alg := range []int{webauthn.AlgEdDSA, webauthn.AlgES256} {
+		a := webauthntest.New(rp.ID, rp.Origin, alg)
+
+		challenge, _ := webauthn.NewChallenge()
+		clientData, attestation := a.Create(challenge, []byte("user"))
+		if got, err := webauthn.Challenge(clientData); err != nil || !bytes.Equal(got, challenge) {
+			t.Fatalf("%d: unexpected challenge: %v, %v", alg, got, err)
+		}
+		cred, err := rp.Register(challenge, clientData, attestation)
+		if err != nil {
+			t.Fatalf("%d: failed to register: %v", alg, err)
+		}
+		if !bytes.Equal(cred.ID, a.ID()) || cred.SignCount != 1 {
+			t.Fatalf("%d: unexpected credential: %+v", alg, cred)
+		}
+		other, _ := webauthn.NewChallenge()
+		if _, err := rp.Register(other, clientData, attestation); !errors.Is(err, webauthn.ErrInvalid) {
+			t.Fatalf("%d: expect challenge mismatch, got %v", alg, err)
+		}
+
+		challenge, _ = webauthn.NewChallenge()
+		clientData, authData, sig := a.Get(challenge)
+		as, err := rp.Login(cred, challenge, clientData, authData, sig)
+		if err != nil {
+			t.Fatalf("%d: failed to log in: %v", alg, err)
+		}
+		if as.SignCount != 2 || !as.UserVerified {
+			t.Fatalf("%d: unexpected assertion: %+v", alg, as)
+		}
+		cred.SignCount = as.SignCount
+
+		// A replayed response has an outdated counter.
+		if _, err := rp.Login(cred, challenge, clientData, authData, sig); !errors.Is(err, webauthn.ErrSignCount) {
+			t.Fatalf("%d: expect sign count error, got %v", alg, err)
+		}
+
+		tests := []struct {
+			name         string
+			rpID, origin string
+			flip         bool
+		}{
+			{"signature", rp.ID, rp.Origin, true},
+			{"origin", rp.ID, "https://evil.com", false},
+			{"rp id", "changkun.de", rp.Origin, false},
+		}
+		for _, tt := range tests {
+			a.RPID, a.Origin = tt.rpID, tt.origin
+			challenge, _ = webauthn.NewChallenge()
+			clientData, authData, sig = a.Get(challenge)
+			if tt.flip {
+				sig[len(sig)-1] ^= 1
+			}
+			if _, err := rp.Login(cred, challenge, clientData, authData, sig); !errors.Is(err, webauthn.ErrInvalid) {
+				t.Fatalf("%d: %s: expect invalid response, got %v", alg, tt.name, err)
+			}
+		}
+	}
+}
+
+func TestCBORLimits(t *testing.T) {
+	rp := &webauthn.RelyingParty{ID: "login.changkun.de", Origin: "https://login.changkun.de"}
+	challenge, _ := webauthn.NewChallenge()
+	a := webauthntest.New(rp.ID, rp.Origin, webauthn.AlgES256)
+	clientData, _ := a.Create(challenge, nil)
+
+	inputs := [][]byte{
+		nil,
+		{0xa1}, // map without entries
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+		bytes.Repeat([]byte{0x81}, 100),                        // deeply nested
+	}
+	for _, in := range inputs {
+		if _, err := rp.Register(challenge, clientData, in); !errors.Is(err, webauthn.ErrInvalid) {
+			t.Fatalf("%x: expect invalid response, got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+// Package webauthntest provides a software authenticator to test
+// WebAuthn relying parties.
+package webauthntest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"changkun.de/x/login/internal/webauthn"
+)
+
+// Authenticator is a software authenticator that holds a single
+// credential. It behaves like a platform authenticator that verifies
+// the user and counts its signatures.
+type Authenticator struct {
+	RPID      string
+	Origin    string
+	SignCount uint32 // incremented before each signature
+
+	alg        int
+	key        crypto.Signer
+	id         []byte
+	userHandle []byte
+}
+
+// New returns an authenticator for the given relying party with a new
+// key of the given COSE algorithm, webauthn.AlgES256 or AlgEdDSA.
+func New(rpID, origin string, alg int) *Authenticator {
+	a := &Authenticator{RPID: rpID, Origin: origin, alg: alg, id: make([]byte, 16)}
+	rand.Read(a.id)
+
+	var err error
+	switch alg {
+	case webauthn.AlgEdDSA:
+		_, a.key, err = ed25519.GenerateKey(rand.Reader)
+	case webauthn.AlgES256:
+		a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		panic("webauthntest: unsupported algorithm")
+	}
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// ID returns the credential ID.
+func (a *Authenticator) ID() []byte { return a.id }
+
+// UserHandle returns the user handle the credential was created for.
+func (a *Authenticator) UserHandle() []byte { return a.userHandle }
+
+// Create answers a registration challenge like
+// navigator.credentials.create.
+func (a *Authenticator) Create(challenge, userHandle []byte) (clientDataJSON, attestationObject []byte) {
+	a.userHandle = userHandle
+	clientDataJSON = a.clientData("webauthn.create", challenge)
+
+	ad := a.authData(0x40)
+	var idLen [2]byte
+	binary.BigEndian.PutUint16(idLen[:], uint16(len(a.id)))
+	ad = append(ad, make([]byte, 16)...) // AAGUID
+	ad = append(ad, idLen[:]...)
+	ad = append(ad, a.id...)
+	ad = append(ad, a.publicKey()...)
+
+	var obj []byte
+	obj = appendHead(obj, 5, 3)
+	obj = appendText(obj, "fmt")
+	obj = appendText(obj, "none")
+	obj = appendText(obj, "attStmt")
+	obj = appendHead(obj, 5, 0)
+	obj = appendText(obj, "authData")
+	obj = appendBytes(obj, ad)
+	return clientDataJSON, obj
+}
+
+// Get answers an authentication challenge like navigator.credentials.get.
+func (a *Authenticator) Get(challenge []byte) (clientDataJSON, authenticatorData, signature []byte) {
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authenticatorData = a.authData(0)
+
+	h := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authenticatorData...), h[:]...)
+	var err error
+	switch a.alg {
+	case webauthn.AlgEdDSA:
+		signature, err = a.key.Sign(rand.Reader, signed, crypto.Hash(0))
+	default:
+		d := sha256.Sum256(signed)
+		signature, err = a.key.Sign(rand.Reader, d[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return clientDataJSON, authenticatorData, signature
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.Origin,
+	})
+	return b
+}
+
+// authData returns the authenticator data with user presence and
+// verification flags and the incremented signature counter.
+func (a *Authenticator) authData(flags byte) []byte {
+	a.SignCount++
+	h := sha256.Sum256([]byte(a.RPID))
+	b := append(h[:], flags|0x01|0x04)
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], a.SignCount)
+	return append(b, n[:]...)
+}
+
+// publicKey returns the COSE encoding of the public key.
+func (a *Authenticator) publicKey() []byte {
+	var b []byte
+	switch pub := a.key.Public().(type) {
+	case ed25519.PublicKey:
+		b = appendHead(b, 5, 4)
+		b = appendInt(appendInt(b, 1), 1) // kty: OKP
+		b = appendInt(appendInt(b, 3), webauthn.AlgEdDSA)
+		b = appendInt(appendInt(b, -1), 6) // crv: Ed25519
+		b = appendBytes(appendInt(b, -2), pub)
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		b = appendHead(b, 5, 5)
+		b = appendInt(appendInt(b, 1), 2) // kty: EC2
+		b = appendInt(appendInt(b, 3), webauthn.AlgES256)
+		b = appendInt(appendInt(b, -1), 1) // crv: P-256
+		b = appendBytes(appendInt(b, -2), x)
+		b = appendBytes(appendInt(b, -3), y)
+	}
+	return b
+}
+
+func appendHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n < 1<<8:
+		return append(b, major<<5|24, byte(n))
+	case n < 1<<16:
+		return append(b, major<<5|25, byte(n>>8), byte(n))
+	}
+	return append(b, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendInt(b []byte, v int) []byte {
+	if v < 0 {
+		return appendHead(b, 1, uint64(-1-v))
+	}
+	return appendHead(b, 0, uint64(v))
+}
+
+func appendBytes(b, v []byte) []byte { return append(appendHead(b, 2, uint64(len(v))), v...) }
+func appendText(b []byte, v string) []byte {
+	return append(appendHead(b, 3, uint64(len(v))), v...)
+}
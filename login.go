@@ -5,111 +5,84 @@
 package login
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
+// DefaultBaseURL is the base URL of the login server used by clients
+// that are created without WithBaseURL.
+const DefaultBaseURL = "https://login.changkun.de"
+
 var (
 	// AuthEndpoint is the login authorization endpoint.
-	AuthEndpoint = "https://login.changkun.de/auth"
+	//
+	// Deprecated: Use a Client created with WithBaseURL instead. The
+	// variable is only consulted by the package-level functions, which
+	// derive the other endpoints from it unless VerifyEndpoint is set.
+	AuthEndpoint = DefaultBaseURL + "/auth"
 	// VerifyEndpoint is the login verify endpoint.
-	VerifyEndpoint = "https://login.changkun.de/verify"
+	//
+	// Deprecated: Use a Client created with WithBaseURL instead. The
+	// variable is only consulted by the package-level functions, which
+	// derive the other endpoints, such as /exchange and /token, from it.
+	VerifyEndpoint = DefaultBaseURL + "/verify"
 )
 
 var (
 	ErrBadRequest   = errors.New("bad request")
 	ErrUnauthorized = errors.New("unauthorized login")
+	ErrForbidden    = errors.New("access denied")
 )
 
-// Verify checks if the given login token is valid or not.
-func Verify(token string) (string, error) {
-	b, _ := json.Marshal(struct {
-		Token string `json:"token"`
-	}{
-		Token: token,
-	})
-	br := bytes.NewReader(b)
-
-	resp, err := http.DefaultClient.Post(VerifyEndpoint, "application/json", br)
-	if err != nil {
-		return "", ErrBadRequest
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", ErrUnauthorized
-	}
-
-	b, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return "", ErrBadRequest
-	}
-
-	x := &struct {
-		User string `json:"username"`
-	}{}
-	err = json.Unmarshal(b, x)
-	if err != nil {
-		return "", ErrBadRequest
+// defaultClient is the client behind the package-level functions.
+var defaultClient = NewClient()
+
+// pkgClient returns the default client with the endpoints taken from
+// the deprecated package-level variables, so that programs which
+// still modify them keep working. The base URL of the other endpoints
+// is the one of VerifyEndpoint, or else of AuthEndpoint, so that all
+// requests go to the same login server.
+func pkgClient() *Client {
+	c := *defaultClient
+	switch {
+	case VerifyEndpoint != DefaultBaseURL+"/verify" && strings.HasSuffix(VerifyEndpoint, "/verify"):
+		c.setBaseURL(strings.TrimSuffix(VerifyEndpoint, "/verify"))
+	case AuthEndpoint != DefaultBaseURL+"/auth" && strings.HasSuffix(AuthEndpoint, "/auth"):
+		c.setBaseURL(strings.TrimSuffix(AuthEndpoint, "/auth"))
 	}
+	c.authURL = AuthEndpoint
+	c.verifyURL = VerifyEndpoint
+	return &c
+}
 
-	return x.User, nil
+// Verify checks if the given login token is valid or not.
+func Verify(token string) (string, error) {
+	return pkgClient().Verify(context.Background(), token)
 }
 
-// Handle handles authentication by checking either query parameters
-// regarding token or cookie auth.
+// HandleAuth handles authentication by checking the code or token
+// query parameter, the "Authorization: Bearer" header and the cookie,
+// in this order.
 func HandleAuth(w http.ResponseWriter, r *http.Request) (string, error) {
-	// 1st try: query parameter.
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		// 2nd try: cookie.
-		c, err := r.Cookie("auth")
-		if err != nil {
-			return "", err
-		}
-		if c.Value == "" {
-			return "", ErrUnauthorized
-		}
-
-		token = c.Value
-	}
+	return pkgClient().HandleAuth(w, r)
+}
 
-	u, err := Verify(token)
-	if err == nil {
-		w.Header().Set("Set-Cookie", fmt.Sprintf("auth=%s; Domain=changkun.de; Path=/; Max-Age=%d; SameSite=Lax", token, 60*60*24*60)) // 3 months
-	}
-	return u, err
+// HandleAuthIdentity is like HandleAuth but returns the identity of
+// the token. See Client.HandleAuthIdentity.
+func HandleAuthIdentity(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	return pkgClient().HandleAuthIdentity(w, r)
 }
 
 // RequestToken requests the login endpoint and returns the token for login.
 func RequestToken(user, pass string) (string, error) {
-	b, _ := json.Marshal(struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}{Username: user, Password: pass})
-	br := bytes.NewReader(b)
-
-	resp, err := http.DefaultClient.Post(AuthEndpoint, "application/json", br)
-	if err != nil {
-		return "", ErrBadRequest
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", ErrUnauthorized
-	}
+	return pkgClient().RequestToken(context.Background(), user, pass)
+}
 
-	var result struct {
-		Token string `json:"token"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", ErrBadRequest
-	}
-	if result.Token == "" {
-		return "", ErrUnauthorized
-	}
-	return result.Token, nil
+// DeviceLogin logs in with the device flow and prints the instructions
+// for the user to w. See Client.DeviceLogin.
+func DeviceLogin(w io.Writer) (*Tokens, error) {
+	return pkgClient().DeviceLogin(context.Background(), w)
 }
@@ -48,3 +48,18 @@ func TestLogin2(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+func TestDeprecatedEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	defer func(auth, verify string) {
+		login.AuthEndpoint, login.VerifyEndpoint = auth, verify
+	}(login.AuthEndpoint, login.VerifyEndpoint)
+	login.VerifyEndpoint = ts.URL + "/verify"
+
+	// The code is exchanged at the server of VerifyEndpoint.
+	rr := httptest.NewRecorder()
+	u, err := login.HandleAuth(rr, httptest.NewRequest("GET", "/?code=code", nil))
+	if err != nil || u != "changkun" {
+		t.Fatalf("expect code to be exchanged at the verify server, got %v, %v", u, err)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type identityKey struct{}
+
+type clientIPKey struct{}
+
+// UserFromContext returns the username of the authenticated user
+// stored in ctx by Middleware or RequireAuth.
+func UserFromContext(ctx context.Context) (string, bool) {
+	id, ok := IdentityFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return id.Username, true
+}
+
+// IdentityFromContext returns the identity stored in ctx by Middleware
+// or RequireAuth.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// ContextWithIdentity returns a copy of ctx that carries id. It is
+// mostly useful to test handlers that are wrapped by RequireAuth.
+func ContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// ContextWithClientIP returns a copy of ctx that carries the address of
+// the client whose token is verified. VerifyToken sends it to the
+// verify endpoint, which applies the access policy of the service to
+// it. Middleware, RequireAuth and HandleAuth use the address of the
+// peer of the request unless its context carries one, so services
+// behind a reverse proxy set the address that the proxy forwards
+// before them.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientIPFromContext returns the address stored in ctx by
+// ContextWithClientIP.
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// withClientIP returns r with the address of its peer as client
+// address in its context, unless it already carries one.
+func withClientIP(r *http.Request) *http.Request {
+	if clientIPFromContext(r.Context()) != "" {
+		return r
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(ContextWithClientIP(r.Context(), ip))
+}
+
+// Middleware authenticates requests using the default client. See
+// Client.Middleware.
+func Middleware(next http.Handler) http.Handler {
+	return pkgClient().Middleware(next)
+}
+
+// RequireAuth rejects unauthenticated requests using the default
+// client. See Client.RequireAuth.
+func RequireAuth(next http.Handler) http.Handler {
+	return pkgClient().RequireAuth(next)
+}
+
+// Middleware returns a handler that authenticates requests before
+// calling next. Unauthenticated requests are passed to next as well,
+// but only authenticated requests carry an identity in their context,
+// see UserFromContext.
+//
+// Requests are authenticated with the token of the "code" query
+// parameter of a login redirect, which is exchanged with the login
+// server, the "token" query parameter, the "Authorization: Bearer"
+// header, or the cookie, in this order. If the token came from the
+// query, the cookie is set and GET requests are redirected to the same
+// URL without the query parameter, so that it does not linger in the
+// browser history, except for WebSocket handshakes. Expired tokens of
+// browser sessions are renewed with the refresh cookie.
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return c.authHandler(next, false)
+}
+
+// RequireAuth is like Middleware but rejects unauthenticated requests.
+// Browsers are redirected to the login page, which brings them back
+// to the requested URL after login, while API clients receive a 401
+// response with a JSON body. Users that the access policy of the
+// service denies receive a 403 response, see WithAudience.
+func (c *Client) RequireAuth(next http.Handler) http.Handler {
+	return c.authHandler(next, true)
+}
+
+// RequireRole rejects requests of users without the given role using
+// the default client. See Client.RequireRole.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return pkgClient().RequireRole(role)
+}
+
+// RequireGroup rejects requests of users that are not members of the
+// given group using the default client. See Client.RequireGroup.
+func RequireGroup(group string) func(http.Handler) http.Handler {
+	return pkgClient().RequireGroup(group)
+}
+
+// RequireRole returns a middleware that is like RequireAuth, but also
+// rejects authenticated users without the given role with a 403
+// response.
+func (c *Client) RequireRole(role string) func(http.Handler) http.Handler {
+	return c.requireIdentity(func(id *Identity) bool { return id.HasRole(role) })
+}
+
+// RequireGroup returns a middleware that is like RequireAuth, but also
+// rejects authenticated users that are not members of the given group
+// with a 403 response.
+func (c *Client) RequireGroup(group string) func(http.Handler) http.Handler {
+	return c.requireIdentity(func(id *Identity) bool { return id.HasGroup(group) })
+}
+
+// requireIdentity returns a middleware that requires authentication
+// and rejects identities for which allowed returns false.
+func (c *Client) requireIdentity(allowed func(*Identity) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return c.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := IdentityFromContext(r.Context())
+			if !ok || !allowed(id) {
+				forbid(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+func (c *Client) authHandler(next http.Handler, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withClientIP(r)
+		token, fromQuery, err := c.tokenFromRequest(r)
+		if err != nil {
+			c.reject(w, r, err)
+			return
+		}
+
+		var id *Identity
+		err = ErrUnauthorized
+		if token != "" {
+			id, err = c.VerifyToken(r.Context(), token)
+		}
+		if errors.Is(err, ErrUnauthorized) && bearerToken(r) == "" {
+			// The token of a browser session may just have expired.
+			if rid, rerr := c.refreshSession(w, r); rerr == nil {
+				id, err, fromQuery = rid, nil, false
+			}
+		}
+		if err != nil {
+			if !required {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c.reject(w, r, err)
+			return
+		}
+
+		if fromQuery {
+			c.SetCookie(w, token)
+			// WebSocket clients do not follow redirects.
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Header.Get("Upgrade") == "" {
+				u := *r.URL
+				u.RawQuery = stripToken(u.Query()).Encode()
+				http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithIdentity(r.Context(), id)))
+	})
+}
+
+// tokenFromRequest returns the token of the request and whether it
+// came from the query parameters. The query wins because it carries a
+// login that was just issued by the login page, either as code that is
+// exchanged for the token, or as token from legacy login servers. An
+// explicit Authorization header wins over the ambient cookie.
+func (c *Client) tokenFromRequest(r *http.Request) (token string, fromQuery bool, err error) {
+	q := r.URL.Query()
+	if code := q.Get("code"); code != "" {
+		t, err := c.Exchange(r.Context(), code)
+		if err == nil {
+			return t.AccessToken, true, nil
+		}
+		// A used or expired code, for instance of a reloaded page,
+		// leaves the other credentials of the request.
+		if !errors.Is(err, ErrUnauthorized) {
+			return "", false, err
+		}
+	}
+	if token = q.Get("token"); token != "" {
+		return token, true, nil
+	}
+	if token = bearerToken(r); token != "" {
+		return token, false, nil
+	}
+	if ck, err := r.Cookie(c.cookieName); err == nil {
+		return ck.Value, false, nil
+	}
+	return "", false, nil
+}
+
+// bearerToken returns the token of the Authorization header if it uses
+// the bearer scheme.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// reject responds to an unauthenticated request, or to a request of a
+// user that the access policy of the service denied.
+func (c *Client) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrForbidden) {
+		forbid(w, r)
+		return
+	}
+	if wantsHTML(r) {
+		http.Redirect(w, r, c.LoginURL(requestURL(r)), http.StatusFound)
+		return
+	}
+
+	status := http.StatusUnauthorized
+	if !errors.Is(err, ErrUnauthorized) {
+		// The login server could not be asked.
+		status = http.StatusBadGateway
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+c.baseURL+`"`)
+	}
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: strings.ToLower(http.StatusText(status))})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// forbid responds to an authenticated request that lacks permission.
+// Unlike unauthenticated requests, browsers are not sent to the login
+// page, as logging in again does not help.
+func forbid(w http.ResponseWriter, r *http.Request) {
+	if wantsHTML(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`{"error":"forbidden"}`))
+}
+
+// LoginURL returns the URL of the login page that redirects to the
+// given URL after a successful login.
+func (c *Client) LoginURL(redirect string) string {
+	return c.baseURL + "/?" + url.Values{"redirect": {redirect}}.Encode()
+}
+
+// wantsHTML reports whether r is a browser navigation rather than an
+// API call.
+func wantsHTML(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// requestURL reconstructs the absolute URL of r as seen by the user,
+// honouring the headers set by reverse proxies. The code and token
+// parameters are removed.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = strings.TrimSpace(strings.Split(p, ",")[0])
+	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = strings.TrimSpace(strings.Split(h, ",")[0])
+	}
+
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: stripToken(r.URL.Query()).Encode(),
+	}
+	return u.String()
+}
+
+// stripToken removes the code and token parameters from q and returns
+// it.
+func stripToken(q url.Values) url.Values {
+	q.Del("code")
+	q.Del("token")
+	return q
+}
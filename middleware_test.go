@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"changkun.de/x/login"
+)
+
+func TestRequireAuth(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	h := c.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := login.UserFromContext(r.Context())
+		if !ok {
+			t.Errorf("expect a user in the request context")
+		}
+		w.Write([]byte(u))
+	}))
+
+	t.Run("browser", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://app.changkun.de/page?x=1", nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusFound {
+			t.Fatalf("unexpected status: got %v want %v", rr.Code, http.StatusFound)
+		}
+		loc, _ := url.Parse(rr.Header().Get("Location"))
+		if got := loc.Query().Get("redirect"); got != "https://app.changkun.de/page?x=1" {
+			t.Fatalf("unexpected redirect parameter: %v", got)
+		}
+	})
+
+	t.Run("api", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.Header.Set("Authorization", "Bearer bad")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected status: got %v want %v", rr.Code, http.StatusUnauthorized)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("unexpected content type: %v", ct)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/page?token=good&x=1", nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/page?x=1" {
+			t.Fatalf("expect redirect without token, got %v %v", rr.Code, rr.Header().Get("Location"))
+		}
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Value != "good" {
+			t.Fatalf("expect the token to be stored in the cookie, got %v", cookies)
+		}
+	})
+
+	t.Run("code", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/page?code=code&x=1", nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/page?x=1" {
+			t.Fatalf("expect redirect without code, got %v %v", rr.Code, rr.Header().Get("Location"))
+		}
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Value != "good" {
+			t.Fatalf("expect the exchanged token to be stored in the cookie, got %v", cookies)
+		}
+	})
+
+	for name, set := range map[string]func(*http.Request){
+		"bearer": func(r *http.Request) { r.Header.Set("Authorization", "Bearer good") },
+		"cookie": func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "auth", Value: "good"}) },
+		"refresh": func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "auth", Value: "expired"})
+			r.AddCookie(&http.Cookie{Name: "auth_refresh", Value: "refresh"})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api", nil)
+			set(req)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK || rr.Body.String() != "changkun" {
+				t.Fatalf("unexpected response: %v %v", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	var (
+		called bool
+		user   string
+	)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		user, _ = login.UserFromContext(r.Context())
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called || user != "" {
+		t.Fatalf("expect anonymous requests to pass, got called=%v user=%v", called, user)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "auth", Value: "good"})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if user != "changkun" {
+		t.Fatalf("unexpected user: %v", user)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range []struct {
+		name   string
+		h      http.Handler
+		token  string
+		status int
+	}{
+		{"role", c.RequireRole("admin")(ok), "admin", http.StatusOK},
+		{"missing role", c.RequireRole("admin")(ok), "good", http.StatusForbidden},
+		{"group", c.RequireGroup("family")(ok), "admin", http.StatusOK},
+		{"missing group", c.RequireGroup("friends")(ok), "admin", http.StatusForbidden},
+		{"unauthenticated", c.RequireRole("admin")(ok), "bad", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			tt.h.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Fatalf("unexpected status: got %v want %v", rr.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestServicePolicy(t *testing.T) {
+	ts := newTestServer(t)
+	c := login.NewClient(login.WithBaseURL(ts.URL), login.WithAudience("private"))
+
+	_, err := c.VerifyToken(context.Background(), "good")
+	if !errors.Is(err, login.ErrForbidden) || errors.Is(err, login.ErrUnauthorized) ||
+		!strings.Contains(err.Error(), "user changkun is not allowed") {
+		t.Fatalf("expect the policy to deny the user, got %v", err)
+	}
+
+	h := c.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for token, status := range map[string]int{"admin": http.StatusOK, "good": http.StatusForbidden} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "text/html")
+		req.AddCookie(&http.Cookie{Name: "auth", Value: token})
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != status {
+			t.Fatalf("unexpected status for %s: got %v want %v", token, rr.Code, status)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var ip string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			IP string `json:"ip"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		ip = body.IP
+		w.Write([]byte(`{"username":"changkun"}`))
+	}))
+	defer ts.Close()
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+
+	// The middleware sends the address of the peer, unless the service
+	// names the client.
+	h := c.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.RemoteAddr = "203.0.113.7:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if ip != "203.0.113.7" {
+		t.Fatalf("expect the address of the peer to be sent, got %q", ip)
+	}
+	req = req.WithContext(login.ContextWithClientIP(req.Context(), "198.51.100.1"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if ip != "198.51.100.1" {
+		t.Fatalf("expect the address of the context to be sent, got %q", ip)
+	}
+
+	if _, err := c.VerifyToken(context.Background(), "good"); err != nil || ip != "" {
+		t.Fatalf("expect no address without a request, got %q, %v", ip, err)
+	}
+}
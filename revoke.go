@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// revocationRefresh is how long a fetched revocation list is used
+// before it is fetched again. Tokens that were revoked in the meantime
+// are still accepted by offline verification until then.
+const revocationRefresh = time.Minute
+
+// WithRevocationCheck sets whether offline verification rejects tokens
+// that were revoked at logout. The revocation list is fetched from the
+// login server and refreshed every minute. It is checked by default if
+// the keys are fetched with WithJWKS.
+func WithRevocationCheck(enabled bool) Option {
+	return func(c *Client) { c.revocationCheck = &enabled }
+}
+
+// revocationList is a cached copy of the revocation list of the login
+// server.
+type revocationList struct {
+	mu        sync.Mutex
+	revoked   map[string]int64
+	fetchedAt time.Time
+}
+
+// isRevoked reports whether the token with the given ID was revoked.
+// If the list cannot be fetched the last known list is used, so that
+// offline verification keeps working while the login server is down.
+func (rl *revocationList) isRevoked(ctx context.Context, c *Client, jti string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if time.Since(rl.fetchedAt) >= revocationRefresh {
+		// Failed fetches are not retried before the next refresh
+		// either, as every verification would wait for them.
+		rl.fetchedAt = time.Now()
+		revoked, err := c.fetchRevocations(ctx)
+		if err == nil {
+			rl.revoked = revoked
+		}
+	}
+	_, ok := rl.revoked[jti]
+	return ok
+}
+
+// fetchRevocations fetches the revocation list of the login server.
+func (c *Client) fetchRevocations(ctx context.Context) (map[string]int64, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/revocations", nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetching revocations: %s", ErrBadRequest, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+
+	var list struct {
+		Revoked map[string]int64 `json:"revoked"`
+	}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return list.Revoked, nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// serviceTokenRenewal is how long before its expiry a service token is
+// renewed, so that it does not expire on the way to the service.
+const serviceTokenRenewal = time.Minute
+
+// ServiceTokenSource provides the service tokens of a machine client
+// for calls to another service. Machine clients are registered on the
+// login server with a client ID, a secret and the audiences, that is
+// the services, they may call. Tokens are cached and renewed shortly
+// before they expire. A ServiceTokenSource is safe for concurrent use.
+type ServiceTokenSource struct {
+	c        *Client
+	clientID string
+	secret   string
+	audience string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// ServiceTokenSource returns a source of service tokens of the given
+// machine client for the given audience. An empty audience selects
+// the single audience of the client.
+func (c *Client) ServiceTokenSource(clientID, secret, audience string) *ServiceTokenSource {
+	return &ServiceTokenSource{c: c, clientID: clientID, secret: secret, audience: audience}
+}
+
+// Token returns a valid service token, which is requested from the
+// login server with the client credentials grant if the cached one is
+// about to expire. If the renewal fails, the cached token is returned
+// as long as it is valid.
+func (s *ServiceTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.token != "" && now.Add(serviceTokenRenewal).Before(s.expires) {
+		return s.token, nil
+	}
+
+	body := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.clientID},
+		"client_secret": {s.secret},
+	}
+	if s.audience != "" {
+		body.Set("audience", s.audience)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err := s.c.send(ctx, s.c.tokenURL, "application/x-www-form-urlencoded", []byte(body.Encode()), "", &result)
+	if err == nil && result.AccessToken == "" {
+		err = ErrUnauthorized
+	}
+	if err != nil {
+		if s.token != "" && now.Before(s.expires) {
+			return s.token, nil
+		}
+		return "", err
+	}
+	s.token = result.AccessToken
+	s.expires = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Transport returns an http.RoundTripper that sends the service token
+// as bearer token with every request. A nil base uses
+// http.DefaultTransport.
+func (s *ServiceTokenSource) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &serviceTransport{s: s, base: base}
+}
+
+type serviceTransport struct {
+	s    *ServiceTokenSource
+	base http.RoundTripper
+}
+
+func (t *serviceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.s.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	// A RoundTripper must not modify the given request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
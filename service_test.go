@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"changkun.de/x/login"
+)
+
+func TestServiceTokenSource(t *testing.T) {
+	var issued, expiresIn, failing int32 = 0, 900, 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.PostFormValue("grant_type") != "client_credentials" || r.PostFormValue("client_id") != "backup" ||
+			r.PostFormValue("client_secret") != "secret" || r.PostFormValue("audience") != "storage.changkun.de" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token":"service-%d","token_type":"Bearer","expires_in":%d}`, n, atomic.LoadInt32(&expiresIn))
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	c := login.NewClient(login.WithBaseURL(ts.URL))
+	ctx := context.Background()
+
+	if _, err := c.ServiceTokenSource("backup", "wrong", "storage.changkun.de").Token(ctx); !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+
+	// Tokens are cached until they are about to expire.
+	s := c.ServiceTokenSource("backup", "secret", "storage.changkun.de")
+	for i := 0; i < 2; i++ {
+		if token, err := s.Token(ctx); err != nil || token != "service-1" {
+			t.Fatalf("unexpected token: %v, %v", token, err)
+		}
+	}
+
+	// The transport sends the token with every request.
+	hc := &http.Client{Transport: s.Transport(nil)}
+	resp, err := hc.Get(ts.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [64]byte
+	n, _ := resp.Body.Read(b[:])
+	resp.Body.Close()
+	if got := string(b[:n]); got != "Bearer service-1" {
+		t.Fatalf("unexpected authorization header: %q", got)
+	}
+
+	// Short-lived tokens are renewed, and kept while the login server
+	// is not reachable.
+	s = c.ServiceTokenSource("backup", "secret", "storage.changkun.de")
+	atomic.StoreInt32(&expiresIn, 30)
+	if token, err := s.Token(ctx); err != nil || token != "service-2" {
+		t.Fatalf("unexpected token: %v, %v", token, err)
+	}
+	if token, err := s.Token(ctx); err != nil || token != "service-3" {
+		t.Fatalf("expect token to be renewed, got %v, %v", token, err)
+	}
+	atomic.StoreInt32(&failing, 1)
+	if token, err := s.Token(ctx); err != nil || token != "service-3" {
+		t.Fatalf("expect cached token on failure, got %v, %v", token, err)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"changkun.de/x/login/internal/jwk"
+	"github.com/golang-jwt/jwt"
+)
+
+// DefaultIssuer is the issuer of the tokens minted by the login server.
+const DefaultIssuer = "login.changkun.de"
+
+const (
+	// jwksRefresh is how long fetched keys are trusted before they
+	// are fetched again.
+	jwksRefresh = time.Hour
+	// jwksMinInterval limits how often unknown key IDs can trigger a
+	// fetch of the key set, so that forged tokens cannot be used to
+	// hammer the login server.
+	jwksMinInterval = 10 * time.Second
+)
+
+// WithVerificationKey enables offline verification with the given
+// key. Tokens are matched to keys by their "kid" header; an empty kid
+// matches tokens without a kid header. The key must be a []byte
+// secret for HMAC signed tokens, or an ed25519.PublicKey,
+// *ecdsa.PublicKey or *rsa.PublicKey for asymmetric signed tokens.
+func WithVerificationKey(kid string, key interface{}) Option {
+	return func(c *Client) {
+		if c.keys == nil {
+			c.keys = &keySet{}
+		}
+		if c.keys.static == nil {
+			c.keys.static = map[string]interface{}{}
+		}
+		c.keys.static[kid] = key
+	}
+}
+
+// WithJWKS enables offline verification with the public keys
+// published as a JSON Web Key Set at the given URL. An empty URL
+// refers to the key set of the login server, that is
+// "/.well-known/jwks.json" relative to the base URL.
+func WithJWKS(url string) Option {
+	return func(c *Client) {
+		if c.keys == nil {
+			c.keys = &keySet{}
+		}
+		c.keys.jwksURL = url
+		c.keys.jwks = true
+	}
+}
+
+// WithIssuer sets the issuer that offline verification expects in
+// tokens. It defaults to DefaultIssuer.
+func WithIssuer(iss string) Option {
+	return func(c *Client) { c.issuer = iss }
+}
+
+// WithAudience names the service that verifies tokens, usually its
+// host name. Tokens that were issued for a service, such as service
+// tokens, are only accepted by that service, while login tokens that
+// were issued for any service are accepted regardless. The audience
+// is sent to the verify endpoint, or checked locally by offline
+// verification.
+//
+// The audience is also the ID of the service at the login server. If
+// the service is registered there, the verify endpoint applies its
+// access policy and VerifyToken returns ErrForbidden for users that
+// the policy denies, see ContextWithClientIP for the address it
+// applies to. Offline verification cannot apply the policy.
+func WithAudience(aud string) Option {
+	return func(c *Client) { c.audience = aud }
+}
+
+// VerifyToken checks if the given login token is valid and returns
+// the identity it carries. If the client was configured with
+// WithVerificationKey or WithJWKS the token is verified locally,
+// otherwise the verify endpoint of the login server is asked.
+func (c *Client) VerifyToken(ctx context.Context, token string) (*Identity, error) {
+	if c.keys == nil {
+		id := &Identity{}
+		err := c.post(ctx, c.verifyURL, c.tokenBody(ctx, token), token, id)
+		if err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	return c.verifyLocal(ctx, token)
+}
+
+// tokenClaims are the claims of the tokens minted by the login server.
+// Since version 2 of the claim layout the user is the subject and the
+// audience is the service the token was issued for, if any. Tokens
+// without version carry the user as audience and "login" as subject.
+type tokenClaims struct {
+	jwt.StandardClaims
+	Version  int               `json:"ver,omitempty"`
+	AMR      []string          `json:"amr,omitempty"`
+	ClientID string            `json:"client_id,omitempty"`
+	Roles    []string          `json:"roles,omitempty"`
+	Groups   []string          `json:"groups,omitempty"`
+	Ext      map[string]string `json:"ext,omitempty"`
+}
+
+// verifyLocal verifies the given token without asking the login server.
+func (c *Client) verifyLocal(ctx context.Context, token string) (*Identity, error) {
+	var fetchErr error
+	claims := &tokenClaims{}
+	t, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := c.keys.lookup(ctx, c, kid)
+		if err != nil {
+			if errors.Is(err, ErrBadRequest) {
+				fetchErr = err
+			}
+			return nil, err
+		}
+		if !keyMatchesMethod(key, t.Method) {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	if !t.Valid {
+		return nil, ErrUnauthorized
+	}
+
+	// StandardClaims.Valid only checks exp, iat and nbf if they are
+	// present, but the login server always sets them.
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: missing expiration", ErrUnauthorized)
+	}
+	if !claims.VerifyIssuer(c.issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer: %s", ErrUnauthorized, claims.Issuer)
+	}
+	id := &Identity{
+		TokenID:   claims.Id,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		AMR:       claims.AMR,
+		Roles:     claims.Roles,
+		Groups:    claims.Groups,
+		Extra:     claims.Ext,
+	}
+	switch {
+	case claims.Version == 0 && claims.Subject == "login":
+		id.Username, id.Subject = claims.Audience, claims.Audience
+	case claims.Version == 2 && claims.Subject != "":
+		id.Subject, id.Audience = claims.Subject, claims.Audience
+		if claims.ClientID != "" {
+			id.ClientID = claims.ClientID
+		} else {
+			id.Username = claims.Subject
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported claim layout: %d", ErrUnauthorized, claims.Version)
+	}
+	if id.Audience != "" && id.Audience != c.audience {
+		return nil, fmt.Errorf("%w: token for %s", ErrUnauthorized, id.Audience)
+	}
+	if c.revoked != nil && claims.Id != "" && c.revoked.isRevoked(ctx, c, claims.Id) {
+		return nil, fmt.Errorf("%w: revoked token: %s", ErrUnauthorized, claims.Id)
+	}
+
+	return id, nil
+}
+
+// keyMatchesMethod reports whether key can be used with the given
+// signing method. This prevents tokens from picking an algorithm that
+// the key was not meant for, e.g. HMAC with a public key as secret.
+func keyMatchesMethod(key interface{}, m jwt.SigningMethod) bool {
+	switch key.(type) {
+	case []byte:
+		_, ok := m.(*jwt.SigningMethodHMAC)
+		return ok
+	case ed25519.PublicKey:
+		_, ok := m.(*jwt.SigningMethodEd25519)
+		return ok
+	case *ecdsa.PublicKey:
+		_, ok := m.(*jwt.SigningMethodECDSA)
+		return ok
+	case *rsa.PublicKey:
+		switch m.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	}
+	return false
+}
+
+// keySet holds the keys used for offline verification.
+type keySet struct {
+	static  map[string]interface{}
+	jwks    bool
+	jwksURL string
+
+	mu        sync.Mutex
+	fetched   map[string]interface{}
+	fetchedAt time.Time
+	triedAt   time.Time
+}
+
+// lookup returns the key with the given key ID. Keys from the key set
+// are refreshed periodically, and earlier if a token refers to a key
+// that is not known yet.
+func (ks *keySet) lookup(ctx context.Context, c *Client, kid string) (interface{}, error) {
+	if key, ok := ks.static[kid]; ok {
+		return key, nil
+	}
+	if !ks.jwks {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.fetched[kid]
+	now := time.Now()
+	if ok && now.Sub(ks.fetchedAt) < jwksRefresh {
+		return key, nil
+	}
+	if now.Sub(ks.triedAt) < jwksMinInterval {
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+
+	ks.triedAt = now
+	keys, err := c.fetchJWKS(ctx, ks.jwksURL)
+	if err != nil {
+		// Keep using the keys we already know if the login server
+		// is temporarily unreachable.
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	ks.fetched = keys
+	ks.fetchedAt = now
+
+	key, ok = ks.fetched[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	return key, nil
+}
+
+// fetchJWKS fetches and parses the JSON Web Key Set at the given URL.
+// Keys that cannot be parsed are skipped.
+func (c *Client) fetchJWKS(ctx context.Context, url string) (map[string]interface{}, error) {
+	if url == "" {
+		url = c.baseURL + "/.well-known/jwks.json"
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetching key set: %s", ErrBadRequest, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+
+	set := &jwk.Set{}
+	err = json.Unmarshal(b, set)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: empty key set", ErrBadRequest)
+	}
+	return keys, nil
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2021 Changkun Ou <hi@changkun.de>. All Rights Reserved.
+// Unauthorized using, copying, modifying and distributing, via any
+// medium is strictly prohibited.
+
+package login_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"changkun.de/x/login"
+	"changkun.de/x/login/internal/jwk"
+	"github.com/golang-jwt/jwt"
+)
+
+func newClaims(user string, lifetime time.Duration) jwt.StandardClaims {
+	now := time.Now().UTC()
+	return jwt.StandardClaims{
+		Id:        "test",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		Audience:  user,
+		Issuer:    login.DefaultIssuer,
+		Subject:   "login",
+	}
+}
+
+func TestVerifyOfflineHMAC(t *testing.T) {
+	secret := []byte("secret")
+	c := login.NewClient(
+		login.WithBaseURL("http://127.0.0.1:0"), // must not be reached
+		login.WithVerificationKey("", secret),
+	)
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("changkun", time.Hour)).SignedString(secret)
+	id, err := c.VerifyToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("expect to be valid, but failed: %v", err)
+	}
+	if id.Username != "changkun" || id.TokenID != "test" || id.HasAMR("otp") {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+
+	// Tokens of users with a second factor carry the amr claim.
+	token, _ = jwt.NewWithClaims(jwt.SigningMethodHS256, struct {
+		jwt.StandardClaims
+		AMR []string `json:"amr"`
+	}{newClaims("changkun", time.Hour), []string{"pwd", "otp"}}).SignedString(secret)
+	id, err = c.VerifyToken(context.Background(), token)
+	if err != nil || !id.HasAMR("otp") {
+		t.Fatalf("expect second factor in identity, got %+v, %v", id, err)
+	}
+
+	// Since version 2 the user is the subject, and tokens that were
+	// issued for a service are only accepted by clients of that
+	// service.
+	sc := login.NewClient(
+		login.WithBaseURL("http://127.0.0.1:0"),
+		login.WithVerificationKey("", secret),
+		login.WithAudience("storage.changkun.de"),
+	)
+	sign := func(sub, aud, clientID string) string {
+		cl := newClaims(aud, time.Hour)
+		cl.Subject = sub
+		s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, struct {
+			jwt.StandardClaims
+			Version  int    `json:"ver"`
+			ClientID string `json:"client_id,omitempty"`
+		}{cl, 2, clientID}).SignedString(secret)
+		return s
+	}
+	for _, cl := range []*login.Client{c, sc} {
+		id, err = cl.VerifyToken(context.Background(), sign("changkun", "", ""))
+		if err != nil || id.Username != "changkun" || id.Subject != "changkun" {
+			t.Fatalf("unexpected identity: %+v, %v", id, err)
+		}
+	}
+	token = sign("backup", "storage.changkun.de", "backup")
+	if _, err := c.VerifyToken(context.Background(), token); !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect service token without audience to be rejected, got: %v", err)
+	}
+	id, err = sc.VerifyToken(context.Background(), token)
+	if err != nil || id.ClientID != "backup" || id.Username != "" || id.Audience != "storage.changkun.de" {
+		t.Fatalf("unexpected service identity: %+v, %v", id, err)
+	}
+	if _, err := sc.VerifyToken(context.Background(), sign("changkun", "mail.changkun.de", "")); !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect token for other service to be rejected, got: %v", err)
+	}
+
+	tests := map[string]string{
+		"expired": func() string {
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("changkun", -time.Hour)).SignedString(secret)
+			return s
+		}(),
+		"wrong secret": func() string {
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("changkun", time.Hour)).SignedString([]byte("wrong"))
+			return s
+		}(),
+		"wrong issuer": func() string {
+			cl := newClaims("changkun", time.Hour)
+			cl.Issuer = "evil.com"
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, cl).SignedString(secret)
+			return s
+		}(),
+		"unsigned": func() string {
+			s, _ := jwt.NewWithClaims(jwt.SigningMethodNone, newClaims("changkun", time.Hour)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return s
+		}(),
+	}
+	for name, token := range tests {
+		_, err := c.VerifyToken(context.Background(), token)
+		if !errors.Is(err, login.ErrUnauthorized) {
+			t.Errorf("%s: expect unauthorized, got: %v", name, err)
+		}
+	}
+}
+
+func TestVerifyOfflineJWKS(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	k, err := jwk.New("k1", "EdDSA", pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/jwks.json":
+			fetches++
+			json.NewEncoder(w).Encode(jwk.Set{Keys: []jwk.Key{k}})
+		case "/revocations":
+			w.Write([]byte(`{"revoked":{"logged-out":4102444800}}`))
+		default:
+			t.Errorf("unexpected request: %v", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	c := login.NewClient(login.WithBaseURL(ts.URL), login.WithJWKS(""))
+	sign := func(kid string, cl jwt.StandardClaims) string {
+		tk := jwt.NewWithClaims(jwt.SigningMethodEdDSA, cl)
+		tk.Header["kid"] = kid
+		s, _ := tk.SignedString(priv)
+		return s
+	}
+
+	for i := 0; i < 3; i++ {
+		u, err := c.Verify(context.Background(), sign("k1", newClaims("changkun", time.Hour)))
+		if err != nil {
+			t.Fatalf("expect to be valid, but failed: %v", err)
+		}
+		if u != "changkun" {
+			t.Fatalf("unexpected username: %v", u)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expect key set to be fetched once, got %d", fetches)
+	}
+
+	// Unknown key IDs must not hammer the key set endpoint.
+	for i := 0; i < 3; i++ {
+		_, err := c.Verify(context.Background(), sign("k2", newClaims("changkun", time.Hour)))
+		if !errors.Is(err, login.ErrUnauthorized) {
+			t.Fatalf("expect unauthorized, got: %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expect key set to be fetched once, got %d", fetches)
+	}
+
+	// Tokens revoked at logout are rejected.
+	cl := newClaims("changkun", time.Hour)
+	cl.Id = "logged-out"
+	_, err = c.Verify(context.Background(), sign("k1", cl))
+	if !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect revoked token to be rejected, got: %v", err)
+	}
+	c = login.NewClient(login.WithBaseURL(ts.URL), login.WithJWKS(""), login.WithRevocationCheck(false))
+	if _, err := c.Verify(context.Background(), sign("k1", cl)); err != nil {
+		t.Fatalf("expect revocation check to be disabled, got: %v", err)
+	}
+
+	// A public key must not be usable as HMAC secret.
+	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("changkun", time.Hour))
+	tk.Header["kid"] = "k1"
+	s, _ := tk.SignedString([]byte(pub))
+	_, err = c.Verify(context.Background(), s)
+	if !errors.Is(err, login.ErrUnauthorized) {
+		t.Fatalf("expect unauthorized, got: %v", err)
+	}
+}